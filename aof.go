@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/open-ds/sm/lib"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const aofUsage = `usage: sm aof <command> [options] <file>
+
+<file> is a single AOF file or the manifest of a segmented AOF.
+
+commands:
+  verify   check every record and report the offset of the first bad one
+  stats    print record counts per trie and per operation
+  dump     print records as JSON, one object per line
+  fix      truncate the file at the first bad record
+  compact  rewrite the file into an equivalent minimal log
+  restore  write the data as it was at -until or -seq to the -o file, from
+           the newest snapshot before that point and the following segments
+
+The server must not be running on the file while it is fixed or compacted.
+`
+
+type aofRecord struct {
+	File   string   `json:"file,omitempty"`
+	Offset int64    `json:"offset"`
+	Seq    int64    `json:"seq,omitempty"`
+	Time   string   `json:"time,omitempty"`
+	Op     string   `json:"op"`
+	Name   string   `json:"name,omitempty"`
+	Args   []string `json:"args"`
+}
+
+// scanAOF calls fn for every record of a file or of every segment listed in
+// a manifest, and returns the first read error.
+func scanAOF(filename string, fn func(file string, offset int64, record *lib.Record) error) error {
+	if isManifest(filename) {
+		manifest, err := lib.ReadManifest(filename)
+		if err != nil {
+			return err
+		}
+		return manifest.Scan(filepath.Dir(filename), func(segment *lib.Segment, offset int64, record *lib.Record) error {
+			return fn(segment.Name, offset, record)
+		})
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := lib.NewAofReader(file)
+	for {
+		offset := reader.Offset
+		record, err := reader.NextRecord()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn("", offset, record); err != nil {
+			return &lib.AofError{Offset: offset, Err: err}
+		}
+	}
+}
+
+func isManifest(filename string) bool {
+	return strings.HasSuffix(filename, ".manifest")
+}
+
+// loadAOF replays file into an engine without writing any AOF.
+func loadAOF(filename string) (*lib.Engine, error) {
+	engine := lib.NewEngine()
+	replayer := lib.NewReplayer(engine)
+	err := scanAOF(filename, func(file string, offset int64, record *lib.Record) error {
+		return replayer.Apply(record.Args)
+	})
+	return engine, err
+}
+
+func aofVerify(filename string) int {
+	replayer := lib.NewReplayer(lib.NewEngine())
+	count := 0
+	err := scanAOF(filename, func(file string, offset int64, record *lib.Record) error {
+		count++
+		return replayer.Apply(record.Args)
+	})
+	if err == nil && replayer.Pending() {
+		err = errors.New("the last transaction has no EXEC")
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s (%d good records)\n", filename, err.Error(), count)
+		return 1
+	}
+
+	fmt.Printf("%s: ok, %d records\n", filename, count)
+	return 0
+}
+
+func aofStats(filename string) int {
+	stats := make(map[string]map[string]int)
+	ops := make(map[string]int)
+	count := 0
+
+	err := scanAOF(filename, func(file string, offset int64, record *lib.Record) error {
+		op := strings.ToUpper(string(record.Args[0]))
+		name := ""
+		if len(record.Args) > 1 {
+			name = string(record.Args[1])
+		}
+		if stats[name] == nil {
+			stats[name] = make(map[string]int)
+		}
+		stats[name][op]++
+		ops[op]++
+		count++
+		return nil
+	})
+
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("records: %d\n", count)
+	for _, op := range sortedKeys(ops) {
+		fmt.Printf("  %-8s %d\n", op, ops[op])
+	}
+	for _, name := range names {
+		fmt.Printf("trie %s\n", name)
+		for _, op := range sortedKeys(stats[name]) {
+			fmt.Printf("  %-8s %d\n", op, stats[name][op])
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err.Error())
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func aofDump(filename string) int {
+	encoder := json.NewEncoder(os.Stdout)
+	err := scanAOF(filename, func(file string, offset int64, record *lib.Record) error {
+		dump := aofRecord{File: file, Offset: offset, Seq: record.Seq, Op: strings.ToUpper(string(record.Args[0]))}
+		if record.Time > 0 {
+			dump.Time = time.Unix(0, record.Time*int64(time.Millisecond)).Format(time.RFC3339Nano)
+		}
+		for _, arg := range record.Args[1:] {
+			dump.Args = append(dump.Args, string(arg))
+		}
+		if len(dump.Args) > 0 {
+			dump.Name = dump.Args[0]
+		}
+		return encoder.Encode(&dump)
+	})
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err.Error())
+		return 1
+	}
+	return 0
+}
+
+func aofFix(filename string, dryRun bool) int {
+	err := scanAOF(filename, func(file string, offset int64, record *lib.Record) error {
+		return nil
+	})
+	if err == nil {
+		fmt.Printf("%s: ok, nothing to fix\n", filename)
+		return 0
+	}
+
+	aofErr, ok := err.(*lib.AofError)
+	if !ok {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	fmt.Printf("%s: %s\n", filename, aofErr.Error())
+
+	// 分段的AOF只能截断正在写入的最后一个段，已关闭的段有校验和
+	target := filename
+	if isManifest(filename) {
+		manifest, err := lib.ReadManifest(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		last := manifest.Last()
+		if last == nil || last.Closed || last.Name != aofErr.File {
+			fmt.Fprintf(os.Stderr, "%s is a closed segment and can't be truncated\n", aofErr.File)
+			return 1
+		}
+		target = filepath.Join(filepath.Dir(filename), last.Name)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	fmt.Printf("truncate %s to %d bytes, %d bytes discarded\n", target, aofErr.Offset, info.Size()-aofErr.Offset)
+	if dryRun {
+		return 0
+	}
+
+	if err = os.Truncate(target, aofErr.Offset); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+func aofCompact(filename string, output string) int {
+	server, err := loadAOF(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err.Error())
+		return 1
+	}
+
+	if output == "" && isManifest(filename) {
+		fmt.Fprintln(os.Stderr, "compact of a segmented AOF needs an output file")
+		return 2
+	}
+	if output == "" {
+		output = filename
+	}
+
+	if err = writeAOF(output, server.Rewrite); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	before, _ := os.Stat(filename)
+	after, _ := os.Stat(output)
+	if before != nil && after != nil && output != filename {
+		fmt.Printf("%s: %d bytes -> %s: %d bytes\n", filename, before.Size(), output, after.Size())
+	} else if after != nil {
+		fmt.Printf("%s: compacted to %d bytes\n", output, after.Size())
+	}
+	return 0
+}
+
+// writeAOF writes a temporary file and renames it, a failure halfway leaves
+// the output untouched.
+func writeAOF(output string, fn func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(output), filepath.Base(output)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = fn(tmp); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), output)
+	}
+	return err
+}
+
+func aofRestore(filename string, output string, target lib.RestoreTarget, archive string, name string, as string) int {
+	if !isManifest(filename) || output == "" {
+		fmt.Fprintln(os.Stderr, "restore needs the manifest of a segmented AOF and an output file")
+		return 2
+	}
+
+	prefix := strings.TrimSuffix(filepath.Base(filename), ".manifest")
+	server, err := lib.Restore(prefix, []string{filepath.Dir(filename), archive}, target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	write := server.Rewrite
+	if name != "" {
+		trie := server.GetTrie(name)
+		if trie == nil {
+			fmt.Fprintf(os.Stderr, "trie %s not found at %s\n", name, target)
+			return 1
+		}
+		if as == "" {
+			as = name
+		}
+		write = func(w io.Writer) error {
+			return lib.RewriteTrie(w, as, trie)
+		}
+	}
+
+	if err = writeAOF(output, write); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	fmt.Printf("restored %s at %s to %s\n", filename, target, output)
+	return 0
+}
+
+func aofMain(args []string) int {
+	flags := flag.NewFlagSet("sm aof", flag.ContinueOnError)
+	output := flags.String("o", "", "compact, restore: output file, compact rewrites the input in place by default")
+	dryRun := flags.Bool("n", false, "fix: only report what would be truncated")
+	until := flags.String("until", "", "restore: time to restore to, RFC3339, 2006-01-02 15:04[:05] or 15:04[:05] today")
+	seq := flags.Int64("seq", 0, "restore: last sequence number to replay")
+	archive := flags.String("archive", "", "restore: archive directory holding retired segments")
+	name := flags.String("trie", "", "restore: only restore this trie")
+	as := flags.String("as", "", "restore: name of the restored trie in the output")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, aofUsage+"\noptions:\n")
+		flags.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	command := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	filename := flags.Arg(0)
+
+	switch command {
+	case "verify":
+		return aofVerify(filename)
+	case "stats":
+		return aofStats(filename)
+	case "dump":
+		return aofDump(filename)
+	case "fix":
+		return aofFix(filename, *dryRun)
+	case "compact":
+		return aofCompact(filename, *output)
+	case "restore":
+		target := lib.RestoreTarget{Seq: *seq}
+		if *until != "" {
+			t, err := lib.ParseRestoreTime(*until, time.Now())
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				return 2
+			}
+			target.Time = t
+		}
+		if target.Seq == 0 && target.Time.IsZero() {
+			fmt.Fprintln(os.Stderr, "restore needs -until or -seq")
+			return 2
+		}
+		return aofRestore(filename, *output, target, *archive, *name, *as)
+	default:
+		flags.Usage()
+		return 2
+	}
+}
@@ -0,0 +1,727 @@
+// Package client is a Go client of the sm HTTP API.
+//
+//	c := client.New("http://localhost:8080")
+//	if err := c.CreateTrie(ctx, "dict"); err != nil {
+//		...
+//	}
+//	err := c.Insert(ctx, "dict", "北京", "北京大学")
+//	kv, err := c.Get(ctx, "dict", "北京")
+//	if err == client.ErrKeyNotFound {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTrieNotFound = errors.New("trie not found")
+	ErrKeyNotFound  = errors.New("key not found")
+	// 写请求发送到了replica
+	ErrReadOnly = errors.New("readonly replica")
+	// 条件写入的条件不满足
+	ErrConditionFailed = errors.New("condition failed")
+)
+
+// APIError is a request the server answered with an error status.
+type APIError struct {
+	StatusCode int
+	Message    string
+	// ErrTrieNotFound, ErrKeyNotFound, ErrReadOnly or ErrConditionFailed if
+	// the error is one of them
+	Err error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("sm: %d %s", e.StatusCode, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// TransportError is a request that did not get a response from the server.
+type TransportError struct {
+	Method string
+	URL    string
+	Err    error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("sm: %s %s: %s", e.Method, e.URL, e.Err.Error())
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// IsTrieNotFound, IsKeyNotFound, IsReadOnly and IsConditionFailed look
+// through *APIError.
+func IsTrieNotFound(err error) bool {
+	return errors.Is(err, ErrTrieNotFound)
+}
+
+func IsKeyNotFound(err error) bool {
+	return errors.Is(err, ErrKeyNotFound)
+}
+
+func IsReadOnly(err error) bool {
+	return errors.Is(err, ErrReadOnly)
+}
+
+func IsConditionFailed(err error) bool {
+	return errors.Is(err, ErrConditionFailed)
+}
+
+type Client struct {
+	// 例如http://localhost:8080
+	BaseURL    string
+	HTTPClient *http.Client
+
+	// 请求失败时重试的次数，每次重试的等待时间加倍，最长MaxBackoff。GET、PUT和DELETE在
+	// 连接失败或者服务返回502、503、504时重试，其他请求只在连接失败时重试
+	Retries    int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// 批量操作每个请求包含的key数量和同时发送的请求数量
+	BatchSize   int
+	Concurrency int
+}
+
+// New returns a client with a pooled transport and 3 retries.
+func New(baseURL string) *Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &Client{
+		BaseURL:     strings.TrimRight(baseURL, "/"),
+		HTTPClient:  &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		Retries:     3,
+		MinBackoff:  50 * time.Millisecond,
+		MaxBackoff:  2 * time.Second,
+		BatchSize:   1000,
+		Concurrency: 8,
+	}
+}
+
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.MinBackoff << uint(attempt)
+	if d <= 0 || d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	// 加入随机抖动，避免多个客户端同时重试
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func retryable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// 请求失败之后是否重试
+const (
+	retryNever = iota
+	// 只重试没有发送出去的请求，例如连接失败
+	retryUnsent
+	// 传输错误和502、503、504都重试
+	retryAll
+)
+
+// unsent reports whether a transport error happened before the request was
+// sent, the server cannot have applied it.
+func unsent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// do sends a request and decodes the JSON response into out. GET, PUT and
+// DELETE are idempotent and retried after any failure, other methods only
+// when the request was not sent.
+func (c *Client) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	retry := retryUnsent
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		retry = retryAll
+	}
+	return c.send(ctx, method, path, in, out, retry)
+}
+
+// send is do with the way to retry the request.
+func (c *Client) send(ctx context.Context, method string, path string, in interface{}, out interface{}, retry int) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	u := c.BaseURL + path
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		if err == nil {
+			err = c.decode(resp, out)
+			if apiErr, ok := err.(*APIError); !ok || !retryable(apiErr.StatusCode) || retry != retryAll {
+				return err
+			}
+		} else {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			sent := !unsent(err)
+			err = &TransportError{Method: method, URL: u, Err: err}
+			if retry == retryNever || (retry == retryUnsent && sent) {
+				return err
+			}
+		}
+
+		if attempt >= c.Retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.backoff(attempt)):
+		}
+	}
+}
+
+func (c *Client) decode(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return newAPIError(resp.StatusCode, strings.TrimSpace(string(buf)))
+	}
+
+	if out == nil {
+		_, err := io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// newAPIError recognizes the error messages of the server, a missing trie is
+// reported as `trie not found`, "trie `name` not found" or `no trie found`.
+func newAPIError(status int, message string) *APIError {
+	e := &APIError{StatusCode: status, Message: message}
+	switch {
+	case status == http.StatusForbidden && strings.HasPrefix(message, "readonly replica"):
+		e.Err = ErrReadOnly
+	case status == http.StatusPreconditionFailed:
+		e.Err = ErrConditionFailed
+	case message == "key not found":
+		e.Err = ErrKeyNotFound
+	case message == "no trie found" || (strings.HasPrefix(message, "trie ") && strings.HasSuffix(message, " not found")):
+		e.Err = ErrTrieNotFound
+	}
+	return e
+}
+
+func trieURL(name string) string {
+	return "/api/trie/" + url.PathEscape(name)
+}
+
+// CreateTrie creates a trie, it does nothing if the trie exists.
+func (c *Client) CreateTrie(ctx context.Context, name string) error {
+	// 重复创建没有影响，可以重试
+	return c.send(ctx, http.MethodPost, "/api/trie", map[string]string{"name": name}, nil, retryAll)
+}
+
+func (c *Client) DropTrie(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, trieURL(name), nil, nil)
+}
+
+// ClearTrie removes all keys of a trie and keeps its config.
+func (c *Client) ClearTrie(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodPost, trieURL(name)+"/clear", nil, nil)
+}
+
+// CloneTrie copies trie name with its keys and config as the new trie as.
+func (c *Client) CloneTrie(ctx context.Context, name string, as string) (*TrieState, error) {
+	var state TrieState
+	if err := c.do(ctx, http.MethodPost, trieURL(name)+"/clone", map[string]string{"as": as}, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// RenameTrie renames trie name to to, it fails with a 409 *APIError if to
+// exists.
+func (c *Client) RenameTrie(ctx context.Context, name string, to string) (*TrieState, error) {
+	var state TrieState
+	if err := c.do(ctx, http.MethodPost, trieURL(name)+"/rename", map[string]string{"to": to}, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// SwapTries exchanges two tries atomically, a trie rebuilt under a temporary
+// name replaces the one readers use in one step. It returns the states of
+// name and other after the swap. It is never retried: a second swap would
+// undo the first one.
+func (c *Client) SwapTries(ctx context.Context, name string, other string) ([]TrieState, error) {
+	var states []TrieState
+	if err := c.send(ctx, http.MethodPost, trieURL(name)+"/swap", map[string]string{"with": other}, &states, retryNever); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+type TrieState struct {
+	Name       string            `json:"name"`
+	NumberNode int32             `json:"number_node"`
+	NumberKey  int32             `json:"number_key"`
+	Memory     int64             `json:"memory"`
+	Config     map[string]string `json:"config"`
+}
+
+func (c *Client) TrieState(ctx context.Context, name string) (*TrieState, error) {
+	var state TrieState
+	if err := c.do(ctx, http.MethodGet, trieURL(name), nil, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// ListTries returns the state of every trie ordered by name.
+func (c *Client) ListTries(ctx context.Context) ([]TrieState, error) {
+	var states []TrieState
+	if err := c.do(ctx, http.MethodGet, "/api/trie", nil, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+type Info struct {
+	Role     string `json:"role"`
+	Tries    int    `json:"tries"`
+	Keys     int64  `json:"keys"`
+	Nodes    int64  `json:"nodes"`
+	Memory   int64  `json:"memory"`
+	Evicted  int64  `json:"evicted"`
+	AOF      bool   `json:"aof"`
+	Segments int    `json:"segments,omitempty"`
+	// 开启复制时才有，内容和GET /api/replication相同
+	Replication map[string]interface{} `json:"replication,omitempty"`
+}
+
+// Info summarizes the tries, the AOF and the replication of the server.
+func (c *Client) Info(ctx context.Context) (*Info, error) {
+	var info Info
+	if err := c.do(ctx, http.MethodGet, "/api/info", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// SetConfig updates the config of a trie, an empty value removes a setting.
+// It returns the config after the update.
+func (c *Client) SetConfig(ctx context.Context, name string, config map[string]string) (map[string]string, error) {
+	var result map[string]string
+	if err := c.do(ctx, http.MethodPut, trieURL(name), config, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Insert inserts keys into an existing trie in one request.
+func (c *Client) Insert(ctx context.Context, name string, keys ...string) error {
+	return c.do(ctx, http.MethodPost, trieURL(name), keys, nil)
+}
+
+func (c *Client) Remove(ctx context.Context, name string, key string) error {
+	return c.do(ctx, http.MethodDelete, trieURL(name)+"/"+url.PathEscape(key), nil, nil)
+}
+
+type KeyValue struct {
+	Key     string      `json:"key"`
+	Value   interface{} `json:"value"`
+	Version int64       `json:"version"`
+	// 剩余的过期时间，单位为秒，0表示不过期
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+func (c *Client) Get(ctx context.Context, name string, key string) (*KeyValue, error) {
+	var kv KeyValue
+	if err := c.do(ctx, http.MethodGet, trieURL(name)+"/"+url.PathEscape(key), nil, &kv); err != nil {
+		return nil, err
+	}
+	return &kv, nil
+}
+
+// Condition of Set and RemoveIf, the zero value always holds.
+type Condition struct {
+	IfAbsent bool
+	// key存在并且版本相同
+	IfVersion int64
+	// key存在并且value相同
+	IfValue *string
+}
+
+// Set inserts or replaces a key if cond holds and returns the new version,
+// it fails with ErrConditionFailed if not. A retry after a lost response can
+// fail the condition that the first attempt already changed.
+func (c *Client) Set(ctx context.Context, name string, key string, value string, cond Condition) (int64, error) {
+	return c.SetTTL(ctx, name, key, value, 0, cond)
+}
+
+// SetTTL is Set for a key that expires after ttl, rounded down to seconds.
+func (c *Client) SetTTL(ctx context.Context, name string, key string, value string, ttl time.Duration, cond Condition) (int64, error) {
+	req := map[string]interface{}{"value": value}
+	if ttl >= time.Second {
+		req["ttl"] = int64(ttl / time.Second)
+	}
+	if cond.IfAbsent {
+		req["if_absent"] = true
+	}
+	if cond.IfVersion > 0 {
+		req["if_version"] = cond.IfVersion
+	}
+	if cond.IfValue != nil {
+		req["if_value"] = *cond.IfValue
+	}
+
+	var kv KeyValue
+	if err := c.do(ctx, http.MethodPut, trieURL(name)+"/"+url.PathEscape(key), req, &kv); err != nil {
+		return 0, err
+	}
+	return kv.Version, nil
+}
+
+// RemoveIf removes a key if it exists and cond holds, IfAbsent is ignored.
+// With the zero Condition it is Remove.
+func (c *Client) RemoveIf(ctx context.Context, name string, key string, cond Condition) error {
+	query := url.Values{}
+	if cond.IfVersion > 0 {
+		query.Set("if_version", strconv.FormatInt(cond.IfVersion, 10))
+	}
+	if cond.IfValue != nil {
+		query.Set("if_value", *cond.IfValue)
+	}
+
+	path := trieURL(name) + "/" + url.PathEscape(key)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+const (
+	SearchForward  = "forward"
+	SearchBackward = "backward"
+	SearchMatch    = "match"
+	SearchSegment  = "segment"
+)
+
+type SearchRequest struct {
+	Name   string   `json:"name"`
+	Key    []string `json:"key"`
+	Option string   `json:"option"`
+	Limit  int      `json:"limit,omitempty"`
+}
+
+// Search runs a search for every key of the request, the result maps each
+// key to what was found for it.
+func (c *Client) Search(ctx context.Context, req *SearchRequest) (map[string][]string, error) {
+	var result map[string][]string
+	// 只读请求，可以重试
+	if err := c.send(ctx, http.MethodPost, "/api/trie/search", req, &result, retryAll); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *Client) search(ctx context.Context, name string, option string, text string, limit int) ([]string, error) {
+	result, err := c.Search(ctx, &SearchRequest{Name: name, Key: []string{text}, Option: option, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	return result[text], nil
+}
+
+// PrefixSearch returns up to limit keys starting with prefix, the server
+// default is 10.
+func (c *Client) PrefixSearch(ctx context.Context, name string, prefix string, limit int) ([]string, error) {
+	return c.search(ctx, name, SearchBackward, prefix, limit)
+}
+
+type keyListResponse struct {
+	Keys []string `json:"keys"`
+}
+
+// Keys returns up to limit keys greater than after in lexicographic order,
+// pass the last key as after to get the next page. A page shorter than limit
+// is the last one.
+func (c *Client) Keys(ctx context.Context, name string, after string, limit int) ([]string, error) {
+	var result keyListResponse
+	path := "/api/keys?" + url.Values{"name": {name}, "after": {after}, "limit": {strconv.Itoa(limit)}}.Encode()
+	if err := c.do(ctx, http.MethodGet, path, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Keys, nil
+}
+
+// ForwardMatch returns the keys that are prefixes of text.
+func (c *Client) ForwardMatch(ctx context.Context, name string, text string) ([]string, error) {
+	return c.search(ctx, name, SearchForward, text, 0)
+}
+
+// Match returns every key occurring in text.
+func (c *Client) Match(ctx context.Context, name string, text string) ([]string, error) {
+	return c.search(ctx, name, SearchMatch, text, 0)
+}
+
+func (c *Client) Segment(ctx context.Context, name string, text string) ([]string, error) {
+	return c.search(ctx, name, SearchSegment, text, 0)
+}
+
+const (
+	OpInsert = "insert"
+	OpUpdate = "update"
+	OpRemove = "remove"
+)
+
+// BatchOp is one operation of Batch, Value is only used by inserts and updates.
+type BatchOp struct {
+	Op    string  `json:"op"`
+	Name  string  `json:"name"`
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	// 写入的key在多少秒之后过期
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// BatchResult.Status is created, updated, removed, not_found or invalid.
+type BatchResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// 插入和更新之后key的版本
+	Version int64 `json:"version"`
+}
+
+// Batch applies mixed operations across tries in one request, the results
+// are in the order of ops.
+func (c *Client) Batch(ctx context.Context, ops []BatchOp) ([]BatchResult, error) {
+	var result struct {
+		Results []BatchResult `json:"results"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/batch", map[string]interface{}{"ops": ops}, &result); err != nil {
+		return nil, err
+	}
+	return result.Results, nil
+}
+
+// Transaction applies ops all together or not at all. It fails if an op is
+// invalid, its trie does not exist or it updates a missing key.
+func (c *Client) Transaction(ctx context.Context, ops []BatchOp) ([]BatchResult, error) {
+	var result struct {
+		Results []BatchResult `json:"results"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/transaction", map[string]interface{}{"ops": ops}, &result); err != nil {
+		return nil, err
+	}
+	return result.Results, nil
+}
+
+// DiffEntry is a key added, removed or changed from one trie to the other,
+// Value is its value in the second trie and Old in the first one.
+type DiffEntry struct {
+	Op    string      `json:"op"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value,omitempty"`
+	Old   interface{} `json:"old,omitempty"`
+}
+
+// Diff calls fn in key order for every key that differs from trie from to
+// trie to, the entries are streamed so fn is called before the whole diff
+// is received. It stops at the first error of fn and is not retried.
+func (c *Client) Diff(ctx context.Context, from string, to string, fn func(entry DiffEntry) error) error {
+	u := c.BaseURL + "/api/diff?" + url.Values{"from": {from}, "to": {to}}.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return &TransportError{Method: http.MethodGet, URL: u, Err: err}
+	}
+	if resp.StatusCode/100 != 2 {
+		return c.decode(resp, nil)
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var entry DiffEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// Merge policies for the keys with different values in both tries.
+const (
+	MergeKeepSource = "keep-source"
+	MergeKeepTarget = "keep-target"
+	MergeError      = "error"
+)
+
+type MergeResult struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+}
+
+// Merge copies the keys of trie source missing in trie target to target in
+// one transaction. With MergeError it fails with a 409 *APIError if a key
+// has different values and nothing is merged.
+func (c *Client) Merge(ctx context.Context, source string, target string, policy string) (*MergeResult, error) {
+	var result MergeResult
+	req := map[string]string{"source": source, "target": target, "policy": policy}
+	if err := c.do(ctx, http.MethodPost, "/api/merge", req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Wait blocks until n replicas applied every write made before it, or the
+// timeout expires. It returns the number of replicas that did.
+func (c *Client) Wait(ctx context.Context, n int, timeout time.Duration) (int, error) {
+	var result struct {
+		Replicas int `json:"replicas"`
+	}
+	req := map[string]int{"replicas": n, "timeout": int(timeout / time.Millisecond)}
+	// 只读请求，可以重试
+	if err := c.send(ctx, http.MethodPost, "/api/replication/wait", req, &result, retryAll); err != nil {
+		return 0, err
+	}
+	return result.Replicas, nil
+}
+
+// parallel runs fn for every batch of keys with at most Concurrency requests
+// at a time and returns the first error.
+func (c *Client) parallel(ctx context.Context, keys []string, size int, fn func(ctx context.Context, batch []string) error) error {
+	if size <= 0 {
+		size = 1
+	}
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var first error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for start := 0; start < len(keys); start += size {
+		end := start + size
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(batch []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(ctx, batch); err != nil {
+				once.Do(func() {
+					first = err
+					cancel()
+				})
+			}
+		}(keys[start:end])
+	}
+	wg.Wait()
+
+	if first == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return first
+}
+
+// InsertBatch inserts keys in requests of BatchSize keys.
+func (c *Client) InsertBatch(ctx context.Context, name string, keys []string) error {
+	return c.parallel(ctx, keys, c.BatchSize, func(ctx context.Context, batch []string) error {
+		return c.Insert(ctx, name, batch...)
+	})
+}
+
+// RemoveBatch removes keys, one request per key.
+func (c *Client) RemoveBatch(ctx context.Context, name string, keys []string) error {
+	return c.parallel(ctx, keys, 1, func(ctx context.Context, batch []string) error {
+		return c.Remove(ctx, name, batch[0])
+	})
+}
+
+// GetBatch looks up keys, missing keys are left out of the result.
+func (c *Client) GetBatch(ctx context.Context, name string, keys []string) (map[string]interface{}, error) {
+	var mutex sync.Mutex
+	result := make(map[string]interface{}, len(keys))
+
+	err := c.parallel(ctx, keys, 1, func(ctx context.Context, batch []string) error {
+		kv, err := c.Get(ctx, name, batch[0])
+		if IsKeyNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mutex.Lock()
+		result[kv.Key] = kv.Value
+		mutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
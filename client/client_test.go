@@ -0,0 +1,246 @@
+package client
+
+import (
+	"context"
+	"github.com/open-ds/sm/lib"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T) (*Client, *lib.Server, func()) {
+	server := lib.NewServer()
+	ts := httptest.NewServer(server.Router())
+	c := New(ts.URL)
+	c.MinBackoff = time.Millisecond
+	return c, server, ts.Close
+}
+
+func TestClient(t *testing.T) {
+	c, _, done := newTestClient(t)
+	defer done()
+	ctx := context.Background()
+
+	if err := c.Insert(ctx, "dict", "abc"); !IsTrieNotFound(err) {
+		t.Fatalf("expected trie not found, got %v", err)
+	}
+	if err := c.CreateTrie(ctx, "dict"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.Insert(ctx, "dict", "北京", "北京大学", "大学"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := c.Get(ctx, "dict", "清华"); !IsKeyNotFound(err) {
+		t.Errorf("expected key not found, got %v", err)
+	}
+	if _, err := c.Get(ctx, "nothing", "清华"); !IsTrieNotFound(err) {
+		t.Errorf("expected trie not found, got %v", err)
+	}
+	if kv, err := c.Get(ctx, "dict", "北京"); err != nil || kv.Key != "北京" || kv.Version != 1 {
+		t.Errorf("unexpected get %v %v", kv, err)
+	}
+
+	version, err := c.Set(ctx, "dict", "北京", "首都", Condition{IfVersion: 1})
+	if err != nil || version != 2 {
+		t.Errorf("unexpected set %d %v", version, err)
+	}
+	if _, err = c.Set(ctx, "dict", "北京", "首都", Condition{IfAbsent: true}); !IsConditionFailed(err) {
+		t.Errorf("expected condition failed, got %v", err)
+	}
+	old := "北京"
+	if err = c.RemoveIf(ctx, "dict", "北京", Condition{IfValue: &old}); !IsConditionFailed(err) {
+		t.Errorf("expected condition failed, got %v", err)
+	}
+
+	keys, err := c.ForwardMatch(ctx, "dict", "北京大学生")
+	if err != nil || !reflect.DeepEqual(keys, []string{"北京", "北京大学"}) {
+		t.Errorf("unexpected forward match %v %v", keys, err)
+	}
+	keys, err = c.PrefixSearch(ctx, "dict", "北京", 1)
+	if err != nil || !reflect.DeepEqual(keys, []string{"北京"}) {
+		t.Errorf("unexpected prefix search %v %v", keys, err)
+	}
+	keys, err = c.Segment(ctx, "dict", "北京大学生")
+	if err != nil || !reflect.DeepEqual(keys, []string{"北京大学", "生"}) {
+		t.Errorf("unexpected segments %v %v", keys, err)
+	}
+
+	config, err := c.SetConfig(ctx, "dict", map[string]string{"owner": "search"})
+	if err != nil || config["owner"] != "search" {
+		t.Errorf("unexpected config %v %v", config, err)
+	}
+	state, err := c.TrieState(ctx, "dict")
+	if err != nil || state.NumberKey != 3 {
+		t.Errorf("unexpected state %v %v", state, err)
+	}
+
+	if err = c.Remove(ctx, "dict", "大学"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = c.Remove(ctx, "dict", "大学"); err != nil {
+		t.Errorf("expected removing a missing key to succeed, got %v", err)
+	}
+	if err = c.DropTrie(ctx, "dict"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = c.DropTrie(ctx, "dict"); !IsTrieNotFound(err) {
+		t.Errorf("expected trie not found, got %v", err)
+	}
+	if err = c.Remove(ctx, "dict", "大学"); !IsTrieNotFound(err) {
+		t.Errorf("expected trie not found, got %v", err)
+	}
+}
+
+func TestClient_Batch(t *testing.T) {
+	c, server, done := newTestClient(t)
+	defer done()
+	ctx := context.Background()
+	c.BatchSize = 7
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+
+	if err := c.CreateTrie(ctx, "dict"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.InsertBatch(ctx, "dict", keys); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := server.GetTrie("dict").NumberKey; n != 100 {
+		t.Fatalf("expected 100 keys, got %d", n)
+	}
+
+	if err := c.RemoveBatch(ctx, "dict", keys[:50]); err != nil {
+		t.Fatal(err.Error())
+	}
+	found, err := c.GetBatch(ctx, "dict", keys)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(found) != 50 {
+		t.Errorf("expected 50 keys, got %d", len(found))
+	}
+
+	results, err := c.Batch(ctx, []BatchOp{
+		{Op: OpInsert, Name: "dict", Key: "key0"},
+		{Op: OpUpdate, Name: "dict", Key: "key99"},
+		{Op: OpRemove, Name: "nothing", Key: "key99"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 3 || results[0].Status != "created" || results[1].Status != "updated" || results[2].Status != "not_found" {
+		t.Errorf("unexpected batch results %v", results)
+	}
+	if results[0].Version != 1 || results[1].Version != 2 || results[2].Version != 0 {
+		t.Errorf("unexpected versions %v", results)
+	}
+}
+
+func TestClient_Keys(t *testing.T) {
+	c, _, done := newTestClient(t)
+	defer done()
+	ctx := context.Background()
+
+	if _, err := c.Keys(ctx, "dict", "", 10); !IsTrieNotFound(err) {
+		t.Fatalf("expected trie not found, got %v", err)
+	}
+	if err := c.CreateTrie(ctx, "dict"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.Insert(ctx, "dict", "b", "ab", "a", "abc", "ba", "c"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var all []string
+	for after := ""; ; {
+		keys, err := c.Keys(ctx, "dict", after, 4)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		all = append(all, keys...)
+		if len(keys) < 4 {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	if !reflect.DeepEqual(all, []string{"a", "ab", "abc", "b", "ba", "c"}) {
+		t.Errorf("unexpected keys %v", all)
+	}
+
+	// after不需要是存在的key
+	for after, expected := range map[string][]string{"aa": {"ab", "abc"}, "abd": {"b", "ba"}, "c": {}} {
+		keys, err := c.Keys(ctx, "dict", after, 2)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(keys) != len(expected) || len(keys) > 0 && !reflect.DeepEqual(keys, expected) {
+			t.Errorf("after %q: expected %v, got %v", after, expected, keys)
+		}
+	}
+	if _, err := c.Keys(ctx, "dict", "", 0); err == nil {
+		t.Errorf("expected an error for limit 0")
+	}
+}
+
+func TestClient_Retry(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "loading", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL)
+	c.MinBackoff = time.Millisecond
+	if err := c.CreateTrie(context.Background(), "dict"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+
+	atomic.StoreInt32(&calls, -10)
+	c.Retries = 1
+	err := c.CreateTrie(context.Background(), "dict")
+	if apiErr, ok := err.(*APIError); !ok || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after the retries, got %v", err)
+	}
+
+	// POST写请求收到响应之后不重试，GET重试
+	atomic.StoreInt32(&calls, -10)
+	c.Retries = 2
+	c.Insert(context.Background(), "dict", "a", "1")
+	if calls != -9 {
+		t.Errorf("expected one attempt for a POST, got %d", calls+10)
+	}
+	atomic.StoreInt32(&calls, -10)
+	c.Get(context.Background(), "dict", "a")
+	if calls != -7 {
+		t.Errorf("expected 3 attempts for a GET, got %d", calls+10)
+	}
+
+	// 第二次交换会撤销第一次，SwapTries从不重试
+	atomic.StoreInt32(&calls, -10)
+	c.SwapTries(context.Background(), "dict", "tmp")
+	if calls != -9 {
+		t.Errorf("expected one attempt for a swap, got %d", calls+10)
+	}
+
+	// 连接失败是TransportError
+	ts.Close()
+	c.Retries = 0
+	if _, ok := c.CreateTrie(context.Background(), "dict").(*TransportError); !ok {
+		t.Error("expected a transport error")
+	}
+}
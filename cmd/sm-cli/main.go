@@ -0,0 +1,593 @@
+// sm-cli is a command line client of the sm HTTP API. Without a command it
+// starts an interactive shell.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/open-ds/sm/client"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const usage = `usage: sm-cli [-addr url] [-json] <command> [args]
+
+commands:
+  create <name> ...          create tries
+  list                       list tries with their sizes
+  drop <name> ...            drop tries
+  clone <name> <as>          copy a trie with its keys and config
+  rename <name> <to>         rename a trie
+  swap <name> <other>        exchange two tries atomically
+  diff <from> <to>           keys added (+), removed (-) and changed (~) from one trie to the other
+  merge <source> <target> [keep-source|keep-target|error]
+                             copy the missing keys of source to target, default error on conflicts
+  insert <name> [key ...]    insert keys, read one key per line from stdin if none given
+  remove <name> <key> ...    remove keys
+  get <name> <key>           print the value of a key
+  prefix <name> <prefix> [limit]
+                             keys starting with prefix, default limit 10
+  forward <name> <text>      keys that are prefixes of text
+  match <name> <file|->      count every key occurring in the file
+  import <name> <file|->     insert one key per line
+  export <name> [file]       write every key without its value, one per line
+  stats [name ...]           number of keys and nodes and the config of tries
+  info                       role, tries, AOF and replication of the server
+
+exit status: 0 ok, 1 error, 2 usage error, 3 trie or key not found
+`
+
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+var errUsage = errors.New("usage")
+
+type command struct {
+	args string
+	// 参数数量的范围，max为-1时不限制
+	min int
+	max int
+	run func(cli *CLI, args []string) error
+}
+
+var commands = map[string]command{
+	"create":  {"<name> ...", 1, -1, (*CLI).create},
+	"list":    {"", 0, 0, (*CLI).list},
+	"drop":    {"<name> ...", 1, -1, (*CLI).drop},
+	"clone":   {"<name> <as>", 2, 2, (*CLI).clone},
+	"rename":  {"<name> <to>", 2, 2, (*CLI).rename},
+	"swap":    {"<name> <other>", 2, 2, (*CLI).swap},
+	"diff":    {"<from> <to>", 2, 2, (*CLI).diff},
+	"merge":   {"<source> <target> [policy]", 2, 3, (*CLI).merge},
+	"insert":  {"<name> [key ...]", 1, -1, (*CLI).insert},
+	"remove":  {"<name> <key> ...", 2, -1, (*CLI).remove},
+	"get":     {"<name> <key>", 2, 2, (*CLI).get},
+	"prefix":  {"<name> <prefix> [limit]", 2, 3, (*CLI).prefix},
+	"forward": {"<name> <text>", 2, 2, (*CLI).forward},
+	"match":   {"<name> <file|->", 2, 2, (*CLI).match},
+	"import":  {"<name> <file|->", 2, 2, (*CLI).importKeys},
+	"export":  {"<name> [file]", 1, 2, (*CLI).export},
+	"stats":   {"[name ...]", 0, -1, (*CLI).stats},
+	"info":    {"", 0, 0, (*CLI).info},
+}
+
+type CLI struct {
+	Client *client.Client
+	JSON   bool
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// 交互模式下insert不从stdin读取key
+	interactive bool
+}
+
+func main() {
+	flags := flag.NewFlagSet("sm-cli", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	addr := flags.String("addr", envOr("SM_ADDR", "http://localhost:8080"), "address of the server, $SM_ADDR")
+	asJSON := flags.Bool("json", false, "print results as JSON")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		os.Exit(exitUsage)
+	}
+
+	cli := &CLI{
+		Client: client.New(*addr),
+		JSON:   *asJSON,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	if flags.NArg() == 0 {
+		os.Exit(cli.Shell())
+	}
+	os.Exit(cli.Run(flags.Args()))
+}
+
+func envOr(name string, value string) string {
+	if env := os.Getenv(name); env != "" {
+		return env
+	}
+	return value
+}
+
+// Run executes one command and returns the exit status.
+func (cli *CLI) Run(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(cli.Stderr, "unknown command %s\n", args[0])
+		if !cli.interactive {
+			fmt.Fprint(cli.Stderr, usage)
+		}
+		return exitUsage
+	}
+
+	n := len(args) - 1
+	if n < cmd.min || (cmd.max >= 0 && n > cmd.max) {
+		fmt.Fprintf(cli.Stderr, "usage: %s %s\n", args[0], cmd.args)
+		return exitUsage
+	}
+
+	err := cmd.run(cli, args[1:])
+	switch {
+	case err == nil:
+		return exitOK
+	case err == errUsage:
+		fmt.Fprintf(cli.Stderr, "usage: %s %s\n", args[0], cmd.args)
+		return exitUsage
+	case client.IsTrieNotFound(err), client.IsKeyNotFound(err):
+		fmt.Fprintln(cli.Stderr, err.Error())
+		return exitNotFound
+	default:
+		fmt.Fprintln(cli.Stderr, err.Error())
+		return exitError
+	}
+}
+
+// Shell reads commands from stdin until EOF or exit, it returns the status
+// of the last command.
+func (cli *CLI) Shell() int {
+	cli.interactive = true
+	scanner := bufio.NewScanner(cli.Stdin)
+	status := exitOK
+	for {
+		fmt.Fprint(cli.Stdout, "sm> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(cli.Stdout)
+			return status
+		}
+
+		args, err := splitLine(scanner.Text())
+		if err != nil {
+			fmt.Fprintln(cli.Stderr, err.Error())
+			status = exitUsage
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "exit", "quit":
+			return status
+		case "help":
+			fmt.Fprint(cli.Stdout, usage)
+			continue
+		}
+		status = cli.Run(args)
+	}
+}
+
+// splitLine splits a line of the shell into words, double quotes keep spaces
+// and a backslash escapes the next character.
+func splitLine(line string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord, quoted, escaped := false, false, false
+
+	for _, c := range line {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped, inWord = true, true
+		case c == '"':
+			quoted, inWord = !quoted, true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if quoted || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+func (cli *CLI) print(value interface{}, table func(w *tabwriter.Writer)) error {
+	if cli.JSON {
+		encoder := json.NewEncoder(cli.Stdout)
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(value)
+	}
+
+	w := tabwriter.NewWriter(cli.Stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+func (cli *CLI) printKeys(keys []string) error {
+	if keys == nil {
+		keys = []string{}
+	}
+	return cli.print(keys, func(w *tabwriter.Writer) {
+		for _, key := range keys {
+			fmt.Fprintln(w, key)
+		}
+	})
+}
+
+// open returns stdin for "-".
+func (cli *CLI) open(filename string) (io.ReadCloser, error) {
+	if filename == "-" {
+		return ioutil.NopCloser(cli.Stdin), nil
+	}
+	return os.Open(filename)
+}
+
+// readKeys reads one key per line and skips empty lines.
+func readKeys(r io.Reader) ([]string, error) {
+	var keys []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		key := strings.TrimRight(scanner.Text(), "\r")
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, scanner.Err()
+}
+
+func (cli *CLI) create(args []string) error {
+	for _, name := range args {
+		if err := cli.Client.CreateTrie(context.Background(), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cli *CLI) list(args []string) error {
+	states, err := cli.Client.ListTries(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if cli.JSON {
+		names := make([]string, 0, len(states))
+		for _, state := range states {
+			names = append(names, state.Name)
+		}
+		return cli.print(names, nil)
+	}
+	return cli.print(nil, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "NAME\tKEYS\tNODES")
+		for _, state := range states {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", state.Name, state.NumberKey, state.NumberNode)
+		}
+	})
+}
+
+func (cli *CLI) drop(args []string) error {
+	for _, name := range args {
+		if err := cli.Client.DropTrie(context.Background(), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cli *CLI) clone(args []string) error {
+	_, err := cli.Client.CloneTrie(context.Background(), args[0], args[1])
+	return err
+}
+
+func (cli *CLI) rename(args []string) error {
+	_, err := cli.Client.RenameTrie(context.Background(), args[0], args[1])
+	return err
+}
+
+func (cli *CLI) swap(args []string) error {
+	_, err := cli.Client.SwapTries(context.Background(), args[0], args[1])
+	return err
+}
+
+func (cli *CLI) diff(args []string) error {
+	// 差异可能很多，边接收边输出
+	encoder := json.NewEncoder(cli.Stdout)
+	encoder.SetEscapeHTML(false)
+	signs := map[string]string{"added": "+", "removed": "-", "changed": "~"}
+	return cli.Client.Diff(context.Background(), args[0], args[1], func(entry client.DiffEntry) error {
+		if cli.JSON {
+			return encoder.Encode(&entry)
+		}
+		var err error
+		switch {
+		case entry.Op == "changed":
+			_, err = fmt.Fprintf(cli.Stdout, "~ %s\t%v -> %v\n", entry.Key, entry.Old, entry.Value)
+		case entry.Value != nil:
+			_, err = fmt.Fprintf(cli.Stdout, "%s %s\t%v\n", signs[entry.Op], entry.Key, entry.Value)
+		case entry.Old != nil:
+			_, err = fmt.Fprintf(cli.Stdout, "%s %s\t%v\n", signs[entry.Op], entry.Key, entry.Old)
+		default:
+			_, err = fmt.Fprintf(cli.Stdout, "%s %s\n", signs[entry.Op], entry.Key)
+		}
+		return err
+	})
+}
+
+func (cli *CLI) merge(args []string) error {
+	policy := client.MergeError
+	if len(args) == 3 {
+		switch args[2] {
+		case client.MergeKeepSource, client.MergeKeepTarget, client.MergeError:
+			policy = args[2]
+		default:
+			return errUsage
+		}
+	}
+
+	result, err := cli.Client.Merge(context.Background(), args[0], args[1], policy)
+	if err != nil {
+		return err
+	}
+	return cli.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ADDED\tUPDATED\tSKIPPED")
+		fmt.Fprintf(w, "%d\t%d\t%d\n", result.Added, result.Updated, result.Skipped)
+	})
+}
+
+func (cli *CLI) insert(args []string) error {
+	keys := args[1:]
+	if len(keys) == 0 {
+		if cli.interactive {
+			return errUsage
+		}
+		var err error
+		if keys, err = readKeys(cli.Stdin); err != nil {
+			return err
+		}
+	}
+	return cli.Client.InsertBatch(context.Background(), args[0], keys)
+}
+
+func (cli *CLI) remove(args []string) error {
+	return cli.Client.RemoveBatch(context.Background(), args[0], args[1:])
+}
+
+func (cli *CLI) get(args []string) error {
+	kv, err := cli.Client.Get(context.Background(), args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return cli.print(kv, func(w *tabwriter.Writer) {
+		if kv.Value != nil {
+			fmt.Fprintln(w, kv.Value)
+		} else {
+			fmt.Fprintln(w, kv.Key)
+		}
+	})
+}
+
+func (cli *CLI) prefix(args []string) error {
+	limit := 10
+	if len(args) == 3 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n <= 0 {
+			return errUsage
+		}
+		limit = n
+	}
+
+	keys, err := cli.Client.PrefixSearch(context.Background(), args[0], args[1], limit)
+	if err != nil {
+		return err
+	}
+	return cli.printKeys(keys)
+}
+
+func (cli *CLI) forward(args []string) error {
+	keys, err := cli.Client.ForwardMatch(context.Background(), args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return cli.printKeys(keys)
+}
+
+type matchCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+func (cli *CLI) match(args []string) error {
+	file, err := cli.open(args[1])
+	if err != nil {
+		return err
+	}
+	text, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	hits, err := cli.Client.Match(context.Background(), args[0], string(text))
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for _, key := range hits {
+		counts[key]++
+	}
+	result := make([]matchCount, 0, len(counts))
+	for key, count := range counts {
+		result = append(result, matchCount{Key: key, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+
+	return cli.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "KEY\tCOUNT")
+		for _, mc := range result {
+			fmt.Fprintf(w, "%s\t%d\n", mc.Key, mc.Count)
+		}
+	})
+}
+
+func (cli *CLI) importKeys(args []string) error {
+	file, err := cli.open(args[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	keys, err := readKeys(file)
+	if err != nil {
+		return err
+	}
+	if err = cli.Client.InsertBatch(context.Background(), args[0], keys); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.Stderr, "imported %d keys\n", len(keys))
+	return nil
+}
+
+// export每次请求的key数
+const exportPageSize = 1000
+
+// export writes the keys only, values are not exported, so that import can
+// read the file back. The keys are fetched exportPageSize keys at a time.
+func (cli *CLI) export(args []string) error {
+	out := cli.Stdout
+	if len(args) == 2 && args[1] != "-" {
+		file, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	w := bufio.NewWriter(out)
+	after := ""
+	for {
+		keys, err := cli.Client.Keys(context.Background(), args[0], after, exportPageSize)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			w.WriteString(key)
+			w.WriteByte('\n')
+		}
+		if len(keys) < exportPageSize {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	return w.Flush()
+}
+
+func (cli *CLI) stats(args []string) error {
+	var states []client.TrieState
+	if len(args) == 0 {
+		var err error
+		if states, err = cli.Client.ListTries(context.Background()); err != nil {
+			return err
+		}
+	}
+	for _, name := range args {
+		state, err := cli.Client.TrieState(context.Background(), name)
+		if err != nil {
+			return err
+		}
+		states = append(states, *state)
+	}
+	if states == nil {
+		states = []client.TrieState{}
+	}
+
+	return cli.print(states, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "NAME\tKEYS\tNODES\tMEMORY\tCONFIG")
+		for _, state := range states {
+			config := make([]string, 0, len(state.Config))
+			for key, value := range state.Config {
+				config = append(config, key+"="+value)
+			}
+			sort.Strings(config)
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", state.Name, state.NumberKey, state.NumberNode, state.Memory, strings.Join(config, ","))
+		}
+	})
+}
+
+// formatValue prints the numbers decoded from JSON without an exponent.
+func formatValue(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+func (cli *CLI) info(args []string) error {
+	info, err := cli.Client.Info(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return cli.print(info, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "role\t%s\n", info.Role)
+		fmt.Fprintf(w, "tries\t%d\n", info.Tries)
+		fmt.Fprintf(w, "keys\t%d\n", info.Keys)
+		fmt.Fprintf(w, "nodes\t%d\n", info.Nodes)
+		fmt.Fprintf(w, "memory\t%d\n", info.Memory)
+		fmt.Fprintf(w, "evicted\t%d\n", info.Evicted)
+		fmt.Fprintf(w, "aof\t%t\n", info.AOF)
+		if info.AOF {
+			fmt.Fprintf(w, "segments\t%d\n", info.Segments)
+		}
+		for _, key := range []string{"replid", "offset", "primary", "link_up", "primary_offset"} {
+			if value, ok := info.Replication[key]; ok {
+				fmt.Fprintf(w, "%s\t%s\n", key, formatValue(value))
+			}
+		}
+		if replicas, ok := info.Replication["replicas"].([]interface{}); ok {
+			fmt.Fprintf(w, "replicas\t%d\n", len(replicas))
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/open-ds/sm/client"
+	"github.com/open-ds/sm/lib"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCLI(t *testing.T) (*CLI, *bytes.Buffer, func()) {
+	ts := httptest.NewServer(lib.NewServer().Router())
+	c := client.New(ts.URL)
+	c.Retries = 0
+	c.MinBackoff = time.Millisecond
+
+	stdout := &bytes.Buffer{}
+	cli := &CLI{Client: c, Stdin: strings.NewReader(""), Stdout: stdout, Stderr: ioutil.Discard}
+	return cli, stdout, ts.Close
+}
+
+func TestCLI(t *testing.T) {
+	cli, stdout, done := newTestCLI(t)
+	defer done()
+
+	run := func(status int, args ...string) string {
+		stdout.Reset()
+		if got := cli.Run(args); got != status {
+			t.Fatalf("%v: expected exit status %d, got %d", args, status, got)
+		}
+		return stdout.String()
+	}
+
+	run(exitNotFound, "insert", "dict", "北京")
+	run(exitUsage, "get", "dict")
+	run(exitUsage, "nothing")
+	run(exitOK, "create", "dict", "other")
+
+	cli.Stdin = strings.NewReader("北京\n北京大学\r\n\n大学\n学生\n")
+	run(exitOK, "insert", "dict")
+	run(exitNotFound, "get", "dict", "清华")
+	if out := run(exitOK, "get", "dict", "北京"); out != "北京\n" {
+		t.Errorf("unexpected get %q", out)
+	}
+	if out := run(exitOK, "forward", "dict", "北京大学生"); out != "北京\n北京大学\n" {
+		t.Errorf("unexpected forward match %q", out)
+	}
+
+	cli.JSON = true
+	var keys []string
+	json.Unmarshal([]byte(run(exitOK, "prefix", "dict", "北京", "1")), &keys)
+	if !reflect.DeepEqual(keys, []string{"北京"}) {
+		t.Errorf("unexpected prefix search %v", keys)
+	}
+	json.Unmarshal([]byte(run(exitOK, "list")), &keys)
+	if !reflect.DeepEqual(keys, []string{"dict", "other"}) {
+		t.Errorf("unexpected tries %v", keys)
+	}
+
+	var counts []matchCount
+	cli.Stdin = strings.NewReader("北京大学的学生在北京")
+	json.Unmarshal([]byte(run(exitOK, "match", "dict", "-")), &counts)
+	if len(counts) != 4 || counts[0] != (matchCount{Key: "北京", Count: 2}) {
+		t.Errorf("unexpected match %v", counts)
+	}
+
+	var info client.Info
+	json.Unmarshal([]byte(run(exitOK, "info")), &info)
+	if info.Role != "primary" || info.Tries != 2 || info.Keys != 4 {
+		t.Errorf("unexpected info %+v", info)
+	}
+	cli.JSON = false
+
+	dir, err := ioutil.TempDir("", "sm-cli")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "keys.txt")
+
+	run(exitOK, "export", "dict", filename)
+	run(exitOK, "import", "other", filename)
+	if out := run(exitOK, "stats", "other"); !strings.Contains(out, "other  4") {
+		t.Errorf("unexpected stats %q", out)
+	}
+
+	run(exitOK, "remove", "dict", "北京", "大学")
+	run(exitOK, "drop", "other")
+	run(exitNotFound, "drop", "other")
+	if out := run(exitOK, "export", "dict"); out != "北京大学\n学生\n" {
+		t.Errorf("unexpected export %q", out)
+	}
+}
+
+func TestCLI_ExportPages(t *testing.T) {
+	cli, stdout, done := newTestCLI(t)
+	defer done()
+
+	keys := make([]string, exportPageSize*2+1)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%05d", i)
+	}
+	if err := cli.Client.CreateTrie(context.Background(), "dict"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := cli.Client.InsertBatch(context.Background(), "dict", keys); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if status := cli.Run([]string{"export", "dict"}); status != exitOK {
+		t.Fatalf("expected exit status %d, got %d", exitOK, status)
+	}
+	if out := stdout.String(); out != strings.Join(keys, "\n")+"\n" {
+		t.Errorf("expected %d keys in order, got %d lines", len(keys), strings.Count(out, "\n"))
+	}
+}
+
+func TestCLI_Shell(t *testing.T) {
+	cli, stdout, done := newTestCLI(t)
+	defer done()
+
+	cli.Stdin = strings.NewReader("create dict\ninsert dict \"北京 大学\" 学生\n\nget dict \"北京 大学\"\nget dict 清华\n")
+	if status := cli.Shell(); status != exitNotFound {
+		t.Errorf("expected the status of the last command, got %d", status)
+	}
+	if !strings.Contains(stdout.String(), "sm> 北京 大学\n") {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+
+	args, err := splitLine(`get dict "a b" c\ d`)
+	if err != nil || !reflect.DeepEqual(args, []string{"get", "dict", "a b", "c d"}) {
+		t.Errorf("unexpected words %v %v", args, err)
+	}
+	if _, err = splitLine(`get "dict`); err == nil {
+		t.Error("expected an unterminated quote")
+	}
+}
+
+func TestCLI_DiffMerge(t *testing.T) {
+	cli, stdout, done := newTestCLI(t)
+	defer done()
+
+	run := func(status int, args ...string) string {
+		stdout.Reset()
+		if got := cli.Run(args); got != status {
+			t.Fatalf("%v: expected exit status %d, got %d", args, status, got)
+		}
+		return stdout.String()
+	}
+
+	run(exitOK, "create", "staging", "production")
+	run(exitOK, "insert", "staging", "北京", "上海")
+	run(exitOK, "insert", "production", "北京", "广州")
+	run(exitOK, "clone", "production", "backup")
+	if out := run(exitOK, "diff", "production", "staging"); out != "+ 上海\n- 广州\n" {
+		t.Errorf("unexpected diff %q", out)
+	}
+	run(exitUsage, "merge", "staging", "production", "random")
+	if out := run(exitOK, "merge", "staging", "production"); !strings.Contains(out, "\n1      0        0\n") {
+		t.Errorf("unexpected merge %q", out)
+	}
+	if out := run(exitOK, "diff", "backup", "production"); out != "+ 上海\n" {
+		t.Errorf("expected the clone to keep the keys before the merge, got %q", out)
+	}
+	run(exitNotFound, "diff", "staging", "missing")
+
+	run(exitOK, "swap", "staging", "production")
+	run(exitOK, "rename", "staging", "previous")
+	if out := run(exitOK, "diff", "backup", "previous"); out != "+ 上海\n" {
+		t.Errorf("expected the merged trie under the new name, got %q", out)
+	}
+	run(exitError, "rename", "previous", "production")
+}
@@ -1,5 +1,7 @@
 package lib
 
+import "time"
+
 type AC struct {
 	Trie *Trie
 }
@@ -7,7 +9,8 @@ type AC struct {
 func NewAC() *AC {
 	trie := NewTrie()
 	ac := &AC{Trie: trie}
-	ac.Trie.Root.Fail = ac.Trie.Root
+	root := ac.Trie.Root()
+	root.Fail = root
 	return ac
 }
 
@@ -19,9 +22,10 @@ func (ac *AC) Remove(key []byte) {
 	ac.Trie.Remove(key)
 }
 
-// 构建AC自动机的时候需要广度优先遍历字典树
+// 构建AC自动机的时候需要广度优先遍历字典树，插入会复制节点，所以在插入之后构建
 func (ac *AC) Build() {
-	root := ac.Trie.Root
+	root := ac.Trie.Root()
+	root.Fail = root
 
 	ac.Trie.BFS(func(key []byte, node *Node, parent *Node) {
 		if node == root {
@@ -53,8 +57,9 @@ func (ac *AC) Build() {
 }
 
 func (ac *AC) Match(key []byte) (position [][]int) {
-	root := ac.Trie.Root
+	root := ac.Trie.Root()
 	node := root
+	now := Millisecond(time.Now())
 
 	for i := 0; i < len(key); i++ {
 		ord := key[i]
@@ -70,7 +75,7 @@ func (ac *AC) Match(key []byte) (position [][]int) {
 		}
 
 		for current := node; current != root; current = current.Fail {
-			if current.IsKey {
+			if current.alive(now) {
 				position = append(position, []int{i - current.Height, i})
 			}
 		}
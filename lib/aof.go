@@ -2,193 +2,1001 @@ package lib
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// 单条记录的参数个数和参数长度上限，超过即认为文件损坏
+	maxRecordArgs   = 1024 * 1024
+	maxRecordArgLen = 512 * 1024 * 1024
+	// 按长度读参数时，数据到达之前最多预先分配的字节数
+	bulkChunk = 64 * 1024
+)
+
+var (
+	// 文件在一条记录的中间结束，一般是写入时进程退出造成的
+	ErrAofTruncated = errors.New("unexpected end of file")
+	// 记录格式错误或者校验和不匹配
+	ErrAofCorrupt = errors.New("corrupt record")
+)
+
+// AofError reports the offset of the first record that could not be read.
+type AofError struct {
+	File   string
+	Offset int64
+	Err    error
+}
+
+func (e *AofError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("aof: bad record in %s at offset %d: %s", e.File, e.Offset, e.Err.Error())
+	}
+	return fmt.Sprintf("aof: bad record at offset %d: %s", e.Offset, e.Err.Error())
+}
+
+var ErrSnapshotInProgress = errors.New("aof: snapshot already in progress")
+
+const (
+	// 不写AOF
+	FsyncDisabled = -1
+	// 每秒写入文件，由操作系统决定何时落盘
+	FsyncNo = 0
+	// 每条命令写入文件并fsync
+	FsyncAlways = 1
+	// 每秒写入文件并fsync
+	FsyncEverySec = 2
+)
+
 type AofWriter struct {
-	Filename      string
-	Buffer        []byte
-	Mutex         sync.RWMutex
-	SyncOffset    int32
-	CurrentOffset int32
-	File          *os.File
-	Fsync         int
-	Ticker        *time.Ticker
+	// 段文件名的前缀
+	Filename string
+	Dir      string
+	Buffer   []byte
+	Mutex    sync.RWMutex
+	// 最后一条记录的序列号
+	Seq int64
+	// 写入文件的字节数和Feed的字节数
+	SyncOffset    int64
+	CurrentOffset int64
+	// 当前正在写入的段
+	File   *os.File
+	Fsync  int
+	Ticker *time.Ticker
+	done   chan struct{}
+	// 启动加载时遇到不完整的最后一条记录，截断文件而不是拒绝启动
+	LoadTruncated bool
+
+	// 段超过大小或时间后切换到下一个段，0表示不限制
+	SegmentSize int64
+	SegmentAge  time.Duration
+	// 已关闭的增量段达到这个数量时自动生成快照，0表示只手动生成
+	SnapshotSegments int
+	// 被快照覆盖的段移动到归档目录并最多保留Retention个，没有归档目录时直接删除
+	ArchiveDir string
+	Retention  int
+	// 生成快照时暂停写入并调用mark切换段，返回写出这一刻数据的函数
+	Capture  func(mark func() error) (func(w io.Writer) error, error)
+	Manifest *Manifest
+
+	fileLock      sync.Mutex
+	manifestDirty bool
+	segment       *Segment
+	segmentSize   int64
+	segmentCRC    uint32
+	segmentOpened time.Time
+	snapshotting  int32
+
+	// 写入和fsync的耗时和失败次数，在/metrics中输出
+	flushLatency *Histogram
+	syncLatency  *Histogram
+	flushErrors  int64
+	syncErrors   int64
 }
 
-func LogIt(msg string) {
-	log.Println(msg)
+// Record is one entry of the AOF. Records appended by Feed carry a sequence
+// number and the time in milliseconds, records of a snapshot have neither.
+type Record struct {
+	Seq  int64
+	Time int64
+	Args [][]byte
+}
+
+// EncodeRecord frames args as one AOF record:
+//
+//	[@<seq> <time>\r\n]*<argc>\r\n($<len>\r\n<arg>\r\n)...#<crc32>\r\n
+//
+// The checksum covers every byte of the record before the `#`.
+func EncodeRecord(args ...[]byte) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		buf.Write(arg)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString(fmt.Sprintf("#%08x\r\n", crc32.ChecksumIEEE(buf.Bytes())))
+
+	return buf.Bytes()
+}
+
+// StampRecord replaces the header of an encoded record with seq and ms and
+// updates the checksum.
+func StampRecord(seq int64, ms int64, cmd []byte) []byte {
+	if len(cmd) > 0 && cmd[0] == '@' {
+		cmd = cmd[bytes.IndexByte(cmd, '\n')+1:]
+	}
+	// 去掉原来的校验和"#xxxxxxxx\r\n"
+	body := cmd[:len(cmd)-11]
+	header := "@" + strconv.FormatInt(seq, 10) + " " + strconv.FormatInt(ms, 10) + "\r\n"
+
+	buf := make([]byte, 0, len(header)+len(cmd))
+	buf = append(buf, header...)
+	buf = append(buf, body...)
+	buf = append(buf, fmt.Sprintf("#%08x\r\n", crc32.ChecksumIEEE(buf))...)
+	return buf
+}
+
+// Millisecond returns t as milliseconds since the epoch, the unit of Record.Time.
+func Millisecond(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
 }
 
 func ConvertInsert(name string, key string, value string) []byte {
-	op := "INSERT"
-	params := []string{
-		"*4",
-		"$" + strconv.Itoa(len(op)),
-		op,
-		"$" + strconv.Itoa(len(name)),
-		name,
-		"$" + strconv.Itoa(len(key)),
-		key,
-		"$" + strconv.Itoa(len(value)),
-		value,
-	}
-	cmd := strings.Join(params, "\r\n")
-	return []byte(cmd)
+	return EncodeRecord([]byte("INSERT"), []byte(name), []byte(key), []byte(value))
+}
+
+// ConvertInsertVersion records the version of the key too, replaying it
+// restores the same version. INSERT without the version increases it.
+func ConvertInsertVersion(name string, key string, value string, version int64) []byte {
+	return EncodeRecord([]byte("INSERT"), []byte(name), []byte(key), []byte(value), []byte(strconv.FormatInt(version, 10)))
+}
+
+// ConvertInsertExpire records when the key expires in milliseconds too, it
+// is ConvertInsertVersion if the key never expires.
+func ConvertInsertExpire(name string, key string, value string, version int64, expireAt int64) []byte {
+	if expireAt == 0 {
+		return ConvertInsertVersion(name, key, value, version)
+	}
+	return EncodeRecord([]byte("INSERT"), []byte(name), []byte(key), []byte(value),
+		[]byte(strconv.FormatInt(version, 10)), []byte(strconv.FormatInt(expireAt, 10)))
 }
 
 func ConvertRemove(name string, key string) []byte {
-	op := "REMOVE"
+	return EncodeRecord([]byte("REMOVE"), []byte(name), []byte(key))
+}
+
+func ConvertCreate(name string) []byte {
+	return EncodeRecord([]byte("CREATE"), []byte(name))
+}
+
+func ConvertDrop(name string) []byte {
+	return EncodeRecord([]byte("DROP"), []byte(name))
+}
+
+func ConvertClone(name string, as string) []byte {
+	return EncodeRecord([]byte("CLONE"), []byte(name), []byte(as))
+}
+
+func ConvertRename(name string, to string) []byte {
+	return EncodeRecord([]byte("RENAME"), []byte(name), []byte(to))
+}
+
+func ConvertSwap(name string, other string) []byte {
+	return EncodeRecord([]byte("SWAP"), []byte(name), []byte(other))
+}
+
+func ConvertClear(name string) []byte {
+	return EncodeRecord([]byte("CLEAR"), []byte(name))
+}
+
+func ConvertConfig(name string, key string, value string) []byte {
+	return EncodeRecord([]byte("CONFIG"), []byte(name), []byte(key), []byte(value))
+}
+
+// ConvertMulti starts a transaction, the commands up to EXEC are replayed
+// together or not at all.
+func ConvertMulti() []byte {
+	return EncodeRecord([]byte("MULTI"))
+}
+
+// ConvertExec ends the transaction started by MULTI.
+func ConvertExec() []byte {
+	return EncodeRecord([]byte("EXEC"))
+}
+
+// ConvertSnapshot marks the end of a snapshot.
+func ConvertSnapshot() []byte {
+	return EncodeRecord([]byte("SNAPSHOT"))
+}
+
+// AofReader reads framed records and keeps track of the offset of the next one.
+type AofReader struct {
+	reader *bufio.Reader
+	hash   io.Writer
+	Offset int64
+	read   int64
+}
+
+func NewAofReader(r io.Reader) *AofReader {
+	return &AofReader{reader: bufio.NewReader(r)}
+}
+
+// readLine returns a line without the trailing \r\n.
+func (r *AofReader) readLine() ([]byte, error) {
+	line, err := r.reader.ReadSlice('\n')
+	r.read += int64(len(line))
+
+	if err == bufio.ErrBufferFull {
+		return nil, ErrAofCorrupt
+	}
+	if err == io.EOF {
+		return nil, ErrAofTruncated
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrAofCorrupt
+	}
+
+	if r.hash != nil {
+		r.hash.Write(line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// readHeader parses a `<prefix><number>` line.
+func (r *AofReader) readHeader(prefix byte, max int64) (int64, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 2 || line[0] != prefix {
+		return 0, ErrAofCorrupt
+	}
+
+	n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || n < 0 || n > max {
+		return 0, ErrAofCorrupt
+	}
+	return n, nil
+}
+
+// readStamp parses the `@<seq> <time>` line.
+func (r *AofReader) readStamp(record *Record) error {
+	line, err := r.readLine()
+	if err != nil {
+		return err
+	}
+
+	fields := bytes.Fields(line[1:])
+	if len(fields) != 2 {
+		return ErrAofCorrupt
+	}
+	if record.Seq, err = strconv.ParseInt(string(fields[0]), 10, 64); err != nil || record.Seq < 0 {
+		return ErrAofCorrupt
+	}
+	if record.Time, err = strconv.ParseInt(string(fields[1]), 10, 64); err != nil {
+		return ErrAofCorrupt
+	}
+	return nil
+}
+
+func (r *AofReader) next() (record *Record, err error) {
+	h := crc32.NewIEEE()
+	r.hash = h
+	defer func() {
+		r.hash = nil
+	}()
+
+	prefix, err := r.reader.Peek(1)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+
+	record = &Record{}
+	if err == nil && prefix[0] == '@' {
+		if err = r.readStamp(record); err != nil {
+			return nil, err
+		}
+	}
+
+	argc, err := r.readHeader('*', maxRecordArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([][]byte, 0, min(argc, 16))
+	for i := int64(0); i < argc; i++ {
+		argLen, err := r.readHeader('$', maxRecordArgLen)
+		if err != nil {
+			return nil, err
+		}
+
+		arg, err := readBulk(r.reader, argLen+2)
+		r.read += int64(len(arg))
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrAofTruncated
+		}
+		if err != nil {
+			return nil, err
+		}
+		if arg[argLen] != '\r' || arg[argLen+1] != '\n' {
+			return nil, ErrAofCorrupt
+		}
+		h.Write(arg)
+
+		args = append(args, arg[:argLen])
+	}
+
+	sum := h.Sum32()
+	r.hash = nil
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) != 9 || line[0] != '#' {
+		return nil, ErrAofCorrupt
+	}
+	expected, err := strconv.ParseUint(string(line[1:]), 16, 32)
+	if err != nil || uint32(expected) != sum {
+		return nil, ErrAofCorrupt
+	}
+
+	record.Args = args
+	return record, nil
+}
+
+// readBulk reads n bytes. The buffer grows as the data arrives, so a corrupt
+// length allocates no more than the bytes that really follow it. It returns
+// io.EOF if r ends first.
+func readBulk(r io.Reader, n int64) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(int(min(n, bulkChunk)))
+	_, err := io.CopyN(&buf, r, n)
+	return buf.Bytes(), err
+}
+
+// NextRecord returns the next record, io.EOF at a clean end of file, or an
+// *AofError carrying the offset of the bad record.
+func (r *AofReader) NextRecord() (*Record, error) {
+	record, err := r.next()
+
+	if err == io.EOF {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &AofError{Offset: r.Offset, Err: err}
+	}
+
+	r.Offset = r.read
+	return record, nil
+}
+
+// Next returns the arguments of the next record.
+func (r *AofReader) Next() ([][]byte, error) {
+	record, err := r.NextRecord()
+	if err != nil {
+		return nil, err
+	}
+	return record.Args, nil
+}
+
+// NewAOF opens the segmented AOF in dir, named after filename. If dir has no
+// manifest yet, an existing single file at filename becomes the first segment.
+func NewAOF(dir string, filename string) (*AofWriter, error) {
+	if dir == "" {
+		dir = filepath.Dir(filename)
+	}
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+
+	aof := &AofWriter{flushLatency: NewHistogram(aofBuckets), syncLatency: NewHistogram(aofBuckets)}
+	aof.Dir = dir
+	aof.Filename = filepath.Base(filename)
+	aof.Fsync = FsyncEverySec
+	slog.Info("AOF open manifest", "path", aof.manifestPath())
+
+	manifest, err := ReadManifest(aof.manifestPath())
+	if os.IsNotExist(err) {
+		manifest, err = aof.initManifest(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	aof.Manifest = manifest
+
+	if last := manifest.Last(); last == nil || last.Closed || last.Type != SegmentIncr {
+		aof.Manifest.Segments = append(aof.Manifest.Segments, aof.nextSegment())
+		if err = aof.writeManifest(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = aof.openSegment(); err != nil {
+		return nil, err
+	}
+	return aof, nil
+}
+
+func (aof *AofWriter) manifestPath() string {
+	return filepath.Join(aof.Dir, aof.Filename+".manifest")
+}
+
+func (aof *AofWriter) segmentPath(segment *Segment) string {
+	return filepath.Join(aof.Dir, segment.Name)
+}
+
+func (aof *AofWriter) nextSegment() *Segment {
+	var seq int64 = 1
+	if last := aof.Manifest.Last(); last != nil {
+		seq = last.Seq + 1
+	}
+	return &Segment{Type: SegmentIncr, Seq: seq, Name: SegmentName(aof.Filename, seq, SegmentIncr)}
+}
+
+// initManifest creates the first manifest, adopting a single file AOF
+// written before segments existed. A file written before records were
+// framed is converted and kept as <filename>.legacy.
+func (aof *AofWriter) initManifest(filename string) (*Manifest, error) {
+	aof.Manifest = &Manifest{}
+	segment := aof.nextSegment()
+
+	if info, err := os.Stat(filename); err == nil && info.Mode().IsRegular() {
+		legacy, err := isLegacyAOF(filename)
+		if err != nil {
+			return nil, err
+		}
+		if legacy {
+			slog.Info("AOF convert legacy file to segment", "file", filename, "segment", segment.Name)
+			if err = convertLegacyAOF(filename, aof.segmentPath(segment)); err != nil {
+				return nil, err
+			}
+			if err = os.Rename(filename, filename+".legacy"); err != nil {
+				return nil, err
+			}
+		} else {
+			slog.Info("AOF adopt file as segment", "file", filename, "segment", segment.Name)
+			if err = os.Rename(filename, aof.segmentPath(segment)); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-	params := []string{
-		"*3",
-		"$" + strconv.Itoa(len(op)),
-		op,
-		"$" + strconv.Itoa(len(name)),
-		name,
-		"$" + strconv.Itoa(len(key)),
-		key,
+	aof.Manifest.Segments = append(aof.Manifest.Segments, segment)
+	if err := aof.writeManifest(); err != nil {
+		return nil, err
 	}
-	cmd := strings.Join(params, "\r\n")
-	return []byte(cmd)
+	return aof.Manifest, nil
 }
 
-func NewAOF(filename string) *AofWriter {
-	log.Printf("Load config file: %s\n", filename)
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0664)
+func (aof *AofWriter) writeManifest() error {
+	if err := aof.Manifest.WriteFile(aof.manifestPath()); err != nil {
+		aof.manifestDirty = true
+		return err
+	}
+	aof.manifestDirty = false
+	return nil
+}
+
+// openSegment opens the last segment of the manifest for appending.
+func (aof *AofWriter) openSegment() error {
+	segment := aof.Manifest.Last()
+	file, err := os.OpenFile(aof.segmentPath(segment), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
 
+	size, sum, err := checksumFile(aof.segmentPath(segment))
 	if err != nil {
-		log.Fatal(err.Error())
+		file.Close()
+		return err
 	}
 
-	aof := &AofWriter{}
 	aof.File = file
-	aof.Fsync = 2 // default fsync every second
-	aof.Filename = filename
-	return aof
+	aof.segment = segment
+	aof.segmentSize = size
+	aof.segmentCRC = sum
+	aof.segmentOpened = time.Now()
+	return nil
 }
 
+// Feed stamps cmd with the next sequence number and the current time and
+// appends it to the buffer.
 func (aof *AofWriter) Feed(cmd []byte) {
-	log.Println(string(cmd))
 	aof.Mutex.Lock()
+	aof.Seq++
+	cmd = StampRecord(aof.Seq, Millisecond(time.Now()), cmd)
 	aof.Buffer = append(aof.Buffer, cmd...)
-	aof.CurrentOffset += int32(len(cmd))
+	aof.CurrentOffset += int64(len(cmd))
 	aof.Mutex.Unlock()
 }
 
-// Write buffer to disk
+// FeedBlock appends the commands at once, they are flushed to the same segment.
+func (aof *AofWriter) FeedBlock(cmds [][]byte) {
+	now := Millisecond(time.Now())
+	aof.Mutex.Lock()
+	for _, cmd := range cmds {
+		aof.Seq++
+		cmd = StampRecord(aof.Seq, now, cmd)
+		aof.Buffer = append(aof.Buffer, cmd...)
+		aof.CurrentOffset += int64(len(cmd))
+	}
+	aof.Mutex.Unlock()
+}
+
+// Write buffer to disk and rotate the segment when it is full or too old.
 func (aof *AofWriter) Flush() {
-	aof.Mutex.RLock()
-	n, err := aof.File.Write(aof.Buffer)
-	aof.Mutex.RUnlock()
+	aof.fileLock.Lock()
+	defer aof.fileLock.Unlock()
 
-	if err != nil {
-		// log it
-		LogIt(err.Error())
+	if !aof.flush() {
 		return
 	}
 
+	if aof.manifestDirty {
+		if err := aof.writeManifest(); err != nil {
+			slog.Error("AOF write manifest", "err", err)
+		}
+	}
+
+	full := aof.SegmentSize > 0 && aof.segmentSize >= aof.SegmentSize
+	old := aof.SegmentAge > 0 && time.Since(aof.segmentOpened) >= aof.SegmentAge
+	if aof.segmentSize > 0 && (full || old) {
+		if err := aof.rotate(); err != nil {
+			slog.Error("AOF rotate segment", "err", err)
+			return
+		}
+
+		if aof.SnapshotSegments > 0 && aof.coveredSegments() >= aof.SnapshotSegments {
+			go func() {
+				if err := aof.Snapshot(); err != nil && err != ErrSnapshotInProgress {
+					slog.Error("AOF snapshot", "err", err)
+				}
+			}()
+		}
+	}
+}
+
+// flush writes the buffer to the current segment, it returns false if the
+// write failed. The buffer only holds whole records, so a successful flush
+// ends at a record boundary.
+func (aof *AofWriter) flush() bool {
+	aof.Mutex.RLock()
+	buf := aof.Buffer
+	aof.Mutex.RUnlock()
+
+	start := time.Now()
+	n, err := aof.File.Write(buf)
+	aof.flushLatency.Observe(time.Since(start).Seconds())
+	aof.segmentSize += int64(n)
+	aof.segmentCRC = crc32.Update(aof.segmentCRC, crc32.IEEETable, buf[:n])
+
 	aof.Mutex.Lock()
 	aof.Buffer = aof.Buffer[n:]
-	aof.SyncOffset = int32(n)
+	aof.SyncOffset += int64(n)
 	aof.Mutex.Unlock()
+
+	if err != nil {
+		atomic.AddInt64(&aof.flushErrors, 1)
+		slog.Error("AOF flush", "segment", aof.segment.Name, "err", err)
+		return false
+	}
+	return true
+}
+
+// rotate closes the current segment and starts the next one. The caller
+// holds fileLock and has flushed the buffer.
+func (aof *AofWriter) rotate() error {
+	segment := aof.nextSegment()
+	file, err := os.OpenFile(aof.segmentPath(segment), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+
+	if err = aof.File.Sync(); err != nil {
+		slog.Error("AOF fsync closed segment", "segment", aof.segment.Name, "err", err)
+	}
+	if err = aof.File.Close(); err != nil {
+		slog.Error("AOF close segment", "segment", aof.segment.Name, "err", err)
+	}
+
+	aof.segment.Closed = true
+	aof.segment.Size = aof.segmentSize
+	aof.segment.Checksum = aof.segmentCRC
+	aof.Manifest.Segments = append(aof.Manifest.Segments, segment)
+
+	aof.File = file
+	aof.segment = segment
+	aof.segmentSize = 0
+	aof.segmentCRC = 0
+	aof.segmentOpened = time.Now()
+
+	slog.Info("AOF rotate", "segment", segment.Name)
+	return aof.writeManifest()
+}
+
+// coveredSegments counts the closed incremental segments a snapshot would replace.
+func (aof *AofWriter) coveredSegments() int {
+	count := 0
+	for _, segment := range aof.Manifest.Segments {
+		if segment.Type == SegmentIncr && segment.Closed {
+			count++
+		}
+	}
+	return count
+}
+
+// Snapshot writes a base segment with the current data and retires every
+// segment before it. The data is captured while the writes are paused to
+// switch to a new incremental segment, so every record is either in the base
+// or in the segments after it, never in both. The dump itself does not block
+// the writes.
+func (aof *AofWriter) Snapshot() error {
+	if aof.Capture == nil {
+		return errors.New("aof: snapshot is not supported")
+	}
+	if !atomic.CompareAndSwapInt32(&aof.snapshotting, 0, 1) {
+		return ErrSnapshotInProgress
+	}
+	defer atomic.StoreInt32(&aof.snapshotting, 0)
+
+	var seq, last, ms int64
+	write, err := aof.Capture(func() error {
+		aof.fileLock.Lock()
+		defer aof.fileLock.Unlock()
+		if !aof.flush() {
+			return errors.New("aof: flush failed before snapshot")
+		}
+		if aof.segmentSize > 0 {
+			if err := aof.rotate(); err != nil {
+				return err
+			}
+		}
+		seq = aof.segment.Seq
+
+		aof.Mutex.RLock()
+		last = aof.Seq
+		aof.Mutex.RUnlock()
+		ms = Millisecond(time.Now())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	base := &Segment{Type: SegmentBase, Seq: seq, Name: SegmentName(aof.Filename, seq, SegmentBase), Closed: true}
+	start := time.Now()
+	err = writeFileAtomic(aof.segmentPath(base), func(w io.Writer) error {
+		if err := write(w); err != nil {
+			return err
+		}
+
+		// 快照最后一条记录标记数据对应的序列号和时间，按时间恢复时据此选择快照
+		_, err := w.Write(StampRecord(last, ms, ConvertSnapshot()))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if base.Size, base.Checksum, err = checksumFile(aof.segmentPath(base)); err != nil {
+		return err
+	}
+
+	aof.fileLock.Lock()
+	defer aof.fileLock.Unlock()
+
+	segments := []*Segment{base}
+	var covered []*Segment
+	for _, segment := range aof.Manifest.Segments {
+		switch {
+		case segment.Type == SegmentBase && segment.Seq == seq:
+			// 上次快照之后没有写入，新快照替换了同名的文件
+		case segment.Seq < seq || segment.Type == SegmentBase:
+			covered = append(covered, segment)
+		default:
+			segments = append(segments, segment)
+		}
+	}
+	aof.Manifest.Segments = segments
+	if err = aof.writeManifest(); err != nil {
+		return err
+	}
+
+	slog.Info("AOF snapshot written", "segment", base.Name, "duration", time.Since(start), "bytes", base.Size, "retired", len(covered))
+	aof.retire(covered)
+	return nil
+}
+
+// retire moves segments covered by a snapshot to the archive directory, or
+// deletes them if there is none, and keeps at most Retention archived segments.
+func (aof *AofWriter) retire(segments []*Segment) {
+	if aof.ArchiveDir == "" {
+		for _, segment := range segments {
+			if err := os.Remove(aof.segmentPath(segment)); err != nil {
+				slog.Error("AOF remove retired segment", "segment", segment.Name, "err", err)
+			}
+		}
+		return
+	}
+
+	if err := os.MkdirAll(aof.ArchiveDir, 0775); err != nil {
+		slog.Error("AOF create archive directory", "dir", aof.ArchiveDir, "err", err)
+		return
+	}
+
+	archivePath := filepath.Join(aof.ArchiveDir, aof.Filename+".manifest")
+	archive, err := ReadManifest(archivePath)
+	if os.IsNotExist(err) {
+		archive, err = &Manifest{}, nil
+	}
+	if err != nil {
+		slog.Error("AOF read archive manifest", "err", err)
+		return
+	}
+
+	for _, segment := range segments {
+		if err = moveFile(aof.segmentPath(segment), filepath.Join(aof.ArchiveDir, segment.Name)); err != nil {
+			slog.Error("AOF archive segment", "segment", segment.Name, "err", err)
+			continue
+		}
+		archive.Segments = append(archive.Segments, segment)
+	}
+	archive.Sort()
+
+	if aof.Retention > 0 && len(archive.Segments) > aof.Retention {
+		expired := archive.Segments[:len(archive.Segments)-aof.Retention]
+		archive.Segments = archive.Segments[len(archive.Segments)-aof.Retention:]
+		for _, segment := range expired {
+			if err = os.Remove(filepath.Join(aof.ArchiveDir, segment.Name)); err != nil && !os.IsNotExist(err) {
+				slog.Error("AOF remove archived segment", "segment", segment.Name, "err", err)
+			}
+		}
+	}
+
+	if err = archive.WriteFile(archivePath); err != nil {
+		slog.Error("AOF write archive manifest", "err", err)
+	}
+}
+
+// Restore rebuilds the data as it was at target from the segments on disk,
+// snapshots are held off meanwhile so no segment is retired under it.
+func (aof *AofWriter) Restore(target RestoreTarget) (*Engine, error) {
+	if !atomic.CompareAndSwapInt32(&aof.snapshotting, 0, 1) {
+		return nil, ErrSnapshotInProgress
+	}
+	defer atomic.StoreInt32(&aof.snapshotting, 0)
+
+	aof.Flush()
+	return Restore(aof.Filename, []string{aof.Dir, aof.ArchiveDir}, target)
+}
+
+// Segments returns a copy of the manifest.
+func (aof *AofWriter) Segments() []Segment {
+	aof.fileLock.Lock()
+	defer aof.fileLock.Unlock()
+
+	segments := make([]Segment, 0, len(aof.Manifest.Segments))
+	for _, segment := range aof.Manifest.Segments {
+		segments = append(segments, *segment)
+	}
+	return segments
 }
 
 func (aof *AofWriter) Sync() {
+	aof.fileLock.Lock()
+	defer aof.fileLock.Unlock()
+
+	start := time.Now()
 	err := aof.File.Sync()
+	aof.syncLatency.Observe(time.Since(start).Seconds())
 	if err != nil {
-		//log it
-		LogIt(err.Error())
+		atomic.AddInt64(&aof.syncErrors, 1)
+		slog.Error("AOF fsync", "err", err)
 	}
 }
 
-func (aof *AofWriter) Close() {
+// Close writes the buffer and the manifest and closes the current segment,
+// it returns the first error.
+func (aof *AofWriter) Close() error {
 	if aof.Ticker != nil {
 		aof.Ticker.Stop()
+		close(aof.done)
 	}
 
 	aof.Flush()
 	aof.Sync()
-	err := aof.File.Close()
+
+	aof.fileLock.Lock()
+	defer aof.fileLock.Unlock()
+	var err error
+	if aof.manifestDirty {
+		err = aof.writeManifest()
+	}
+	if closeErr := aof.File.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		//log it
-		LogIt(err.Error())
+		slog.Error("AOF close", "err", err)
 	}
+	return err
 }
 
+// Cron writes the buffer every second, and fsyncs it with FsyncEverySec.
 func (aof *AofWriter) Cron() {
-	if aof.Fsync == 2 {
-		aof.Ticker = time.NewTicker(time.Second)
-		go func() {
-			for {
-				<-aof.Ticker.C
-				aof.Flush()
+	if aof.Fsync != FsyncNo && aof.Fsync != FsyncEverySec {
+		return
+	}
+
+	aof.Ticker = time.NewTicker(time.Second)
+	aof.done = make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-aof.Ticker.C:
+			case <-aof.done:
+				return
+			}
+			aof.Flush()
+			if aof.Fsync == FsyncEverySec {
 				aof.Sync()
 			}
-		}()
-	}
+		}
+	}()
 }
 
-func (aof *AofWriter) Load(server *Server) {
-	log.Printf("AOF Load from file %s\n", aof.Filename)
-	reader := bufio.NewReader(aof.File)
-	for {
-		buf, _, err := reader.ReadLine()
+// Load replays every segment into engine. A torn last record of the segment
+// being written is cut off when LoadTruncated is set, any other bad record
+// stops the load with an *AofError.
+func (aof *AofWriter) Load(engine *Engine) error {
+	slog.Info("AOF load", "manifest", aof.manifestPath())
 
-		if err == io.EOF {
-			break
+	count := 0
+	replayer := NewReplayer(engine)
+	// 最后一个MULTI的位置，事务没有EXEC时从这里截断
+	var txSegment string
+	var txOffset int64
+	err := aof.Manifest.Scan(aof.Dir, func(segment *Segment, offset int64, record *Record) error {
+		count++
+		if record.Seq > aof.Seq {
+			aof.Seq = record.Seq
 		}
+		if !replayer.Pending() {
+			txSegment, txOffset = segment.Name, offset
+		}
+		return replayer.Apply(record.Args)
+	})
 
-		if err != nil {
-			log.Fatalln(err.Error())
+	truncate := int64(-1)
+	if aofErr, ok := err.(*AofError); ok && aofErr.Err == ErrAofTruncated && aofErr.File == aof.segment.Name && aof.LoadTruncated {
+		slog.Warn("AOF truncate incomplete record", "err", err, "size", aofErr.Offset)
+		truncate = aofErr.Offset
+	} else if err != nil {
+		return err
+	}
+
+	if replayer.Pending() {
+		if txSegment != aof.segment.Name || !aof.LoadTruncated {
+			return &AofError{File: txSegment, Offset: txOffset, Err: errors.New("transaction without EXEC")}
 		}
+		slog.Warn("AOF truncate transaction without EXEC", "segment", txSegment, "size", txOffset)
+		truncate = txOffset
+	}
 
-		if buf[0] != 42 {
-			log.Fatalln("aof file format error")
+	if truncate >= 0 {
+		aof.fileLock.Lock()
+		defer aof.fileLock.Unlock()
+		if err = aof.File.Truncate(truncate); err != nil {
+			return err
 		}
+		aof.File.Close()
+		if err = aof.openSegment(); err != nil {
+			return err
+		}
+	}
 
-		lenArgc, err := strconv.ParseInt(string(buf[1:]), 10, 32)
+	slog.Info("AOF loaded", "records", count)
+	return nil
+}
 
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
-		cmd := make([][]byte, 0)
-		for i := 0; i < int(lenArgc); i++ {
-			buf, _, err = reader.ReadLine()
+// ValueString converts a key value to the string stored in the AOF.
+func ValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
 
-			if buf[0] != 36 {
-				log.Fatalln("aof file format error")
-			}
+// Rewrite writes the minimal log that rebuilds the current data of engine:
+// CREATE and CONFIG for every trie followed by one INSERT per key, tries and
+// keys in lexicographic order.
+func (engine *Engine) Rewrite(w io.Writer) error {
+	write, err := engine.Capture(nil)
+	if err != nil {
+		return err
+	}
+	return write(w)
+}
 
-			lenValue, err := strconv.ParseInt(string(buf[1:]), 10, 32)
+// Capture waits for the running writes and transactions, calls mark while no
+// write can start and freezes the tries at that point. The returned function
+// writes the frozen data like Rewrite once the writes went on: a write logged
+// after mark is not in it, a write logged before is.
+func (engine *Engine) Capture(mark func() error) (func(w io.Writer) error, error) {
+	engine.txMutex.Lock()
+	defer engine.txMutex.Unlock()
 
-			if err != nil {
-				log.Fatalln(err.Error())
-			}
+	if mark != nil {
+		if err := mark(); err != nil {
+			return nil, err
+		}
+	}
 
-			value := make([]byte, lenValue+2)
-			if lenValue == 0 {
-				value = nil
-			} else {
-				_, err = io.ReadFull(reader, value)
-				if err != nil {
-					log.Fatalln(err.Error())
-				}
-			}
+	engine.Mutex.RLock()
+	tries := make(map[string]*Trie, len(engine.DB))
+	names := make([]string, 0, len(engine.DB))
+	for name, trie := range engine.DB {
+		// Clone只复制root，之后的写入不会改变它
+		tries[name] = trie.Clone()
+		names = append(names, name)
+	}
+	engine.Mutex.RUnlock()
+	sort.Strings(names)
 
-			cmd = append(cmd, value[0:lenValue])
+	return func(w io.Writer) error {
+		writer := bufio.NewWriter(w)
+		for _, name := range names {
+			if err := RewriteTrie(writer, name, tries[name]); err != nil {
+				return err
+			}
 		}
-		switch len(cmd) {
-		case 4:
-			server.Insert(string(cmd[1]), cmd[2], cmd[3])
-		case 3:
-			server.Remove(string(cmd[1]), cmd[2])
+		return writer.Flush()
+	}, nil
+}
+
+// RewriteTrie writes the records that rebuild trie under name.
+func RewriteTrie(w io.Writer, name string, trie *Trie) error {
+	if _, err := w.Write(ConvertCreate(name)); err != nil {
+		return err
+	}
+
+	config := trie.ConfigMap()
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := w.Write(ConvertConfig(name, key, config[key])); err != nil {
+			return err
 		}
 	}
+
+	var err error
+	trie.Range(func(key []byte, node *Node) bool {
+		_, err = w.Write(ConvertInsertExpire(name, string(key), ValueString(node.Value), node.Version, node.ExpireAt))
+		return err == nil
+	})
+	return err
 }
@@ -0,0 +1,384 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// applyAll replays every record of r into server.
+func applyAll(t *testing.T, server *Engine, r io.Reader) {
+	reader := NewAofReader(r)
+	for {
+		args, err := reader.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err = server.Apply(args); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestAofReader_Next(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(ConvertInsert("test", "abc", "value"))
+	buf.Write(ConvertRemove("test", "abc"))
+	buf.Write(ConvertInsert("test", "", ""))
+
+	reader := NewAofReader(&buf)
+	expected := [][]string{
+		{"INSERT", "test", "abc", "value"},
+		{"REMOVE", "test", "abc"},
+		{"INSERT", "test", "", ""},
+	}
+
+	for _, cmd := range expected {
+		args, err := reader.Next()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(args) != len(cmd) {
+			t.Fatalf("expected %d args, got %d", len(cmd), len(args))
+		}
+		for i := range cmd {
+			if string(args[i]) != cmd[i] {
+				t.Errorf("expected %q, got %q", cmd[i], args[i])
+			}
+		}
+	}
+
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestAofReader_Corrupt(t *testing.T) {
+	first := ConvertInsert("test", "abc", "abc")
+	second := ConvertInsert("test", "abd", "abd")
+
+	data := append(append([]byte{}, first...), second...)
+	// 修改第二条记录的key，校验和不再匹配
+	data[len(first)+bytes.Index(second, []byte("abd"))] = 'x'
+
+	reader := NewAofReader(bytes.NewReader(data))
+	if _, err := reader.Next(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err := reader.Next()
+	aofErr, ok := err.(*AofError)
+	if !ok {
+		t.Fatalf("expected *AofError, got %v", err)
+	}
+	if aofErr.Err != ErrAofCorrupt || aofErr.Offset != int64(len(first)) {
+		t.Errorf("unexpected error %s", err.Error())
+	}
+}
+
+// 损坏的长度不能导致按长度预先分配内存
+func TestAofReader_CorruptLength(t *testing.T) {
+	first := ConvertInsert("test", "abc", "abc")
+	data := append(append([]byte{}, first...), "*4\r\n$6\r\nINSERT\r\n$536870000\r\ntest"...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	reader := NewAofReader(bytes.NewReader(data))
+	if _, err := reader.Next(); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err := reader.Next()
+	runtime.ReadMemStats(&after)
+
+	if aofErr, ok := err.(*AofError); !ok || aofErr.Err != ErrAofTruncated || aofErr.Offset != int64(len(first)) {
+		t.Errorf("expected a truncated record, got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16*1024*1024 {
+		t.Errorf("allocated %d bytes for a record of %d bytes", allocated, len(data))
+	}
+}
+
+func TestAofWriter_LoadTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	first := ConvertInsert("test", "abc", "abc")
+	second := ConvertInsert("test", "abd", "abd")
+	filename := filepath.Join(dir, "aof.log")
+	data := append(append([]byte{}, first...), second[:len(second)-5]...)
+	if err = ioutil.WriteFile(filename, data, 0664); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	aof, err := NewAOF("", filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer aof.Close()
+
+	if err = aof.Load(NewEngine()); err == nil {
+		t.Fatal("expected load to fail on a torn record")
+	}
+
+	aof.LoadTruncated = true
+	server := NewEngine()
+	if err = aof.Load(server); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ret, value := server.DB["test"].Find([]byte("abc")); !ret || value != "abc" {
+		t.Errorf("key abc not loaded")
+	}
+
+	info, err := aof.File.Stat()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if info.Size() != int64(len(first)) {
+		t.Errorf("expected file truncated to %d bytes, got %d", len(first), info.Size())
+	}
+}
+
+// 分帧之前的AOF没有校验和，REMOVE的最后一个参数后面没有\r\n
+func TestAofWriter_LoadLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "aof.log")
+	legacy := "*4\r\n$6\r\nINSERT\r\n$4\r\ndict\r\n$1\r\na\r\n$0\r\n" +
+		"*3\r\n$6\r\nREMOVE\r\n$4\r\ndict\r\n$1\r\na" +
+		"*4\r\n$6\r\nINSERT\r\n$4\r\ndict\r\n$2\r\nab\r\n$0\r\n"
+	if err = ioutil.WriteFile(filename, []byte(legacy), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	aof, err := NewAOF(dir, filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer aof.Close()
+	engine := NewEngine()
+	if err = aof.Load(engine); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ret, _ := engine.GetTrie("dict").Find([]byte("a")); ret {
+		t.Error("expected the removed key to stay removed")
+	}
+	if ret, _ := engine.GetTrie("dict").Find([]byte("ab")); !ret {
+		t.Error("expected the legacy key to be loaded")
+	}
+	if _, err = os.Stat(filename + ".legacy"); err != nil {
+		t.Errorf("expected the legacy file to be kept, got %v", err)
+	}
+}
+
+func TestServer_RewriteLifecycle(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(ConvertCreate("empty"))
+	buf.Write(ConvertConfig("empty", "owner", "search"))
+	buf.Write(ConvertInsert("dropped", "abc", ""))
+	buf.Write(ConvertDrop("dropped"))
+	buf.Write(ConvertInsert("cleared", "abc", ""))
+	buf.Write(ConvertClear("cleared"))
+	buf.Write(ConvertInsert("cleared", "abd", "v"))
+
+	server := NewEngine()
+	applyAll(t, server, &buf)
+
+	var rewritten bytes.Buffer
+	if err := server.Rewrite(&rewritten); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	loaded := NewEngine()
+	applyAll(t, loaded, &rewritten)
+
+	for _, s := range []*Engine{server, loaded} {
+		if len(s.DB) != 2 || s.GetTrie("dropped") != nil {
+			t.Fatalf("unexpected tries %v", s.DB)
+		}
+		if value, _ := s.GetTrie("empty").GetConfig("owner"); value != "search" {
+			t.Errorf("config of empty trie lost")
+		}
+		cleared := s.GetTrie("cleared")
+		if ret, _ := cleared.Find([]byte("abc")); ret || cleared.NumberKey != 1 {
+			t.Errorf("trie not cleared")
+		}
+		if ret, value := cleared.Find([]byte("abd")); !ret || value != "v" {
+			t.Errorf("key abd not found")
+		}
+	}
+}
+
+func TestAofWriter_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	server := NewEngine()
+	aof, err := NewAOF(dir, "aof.log")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	aof.SegmentSize = 100
+	aof.ArchiveDir = filepath.Join(dir, "archive")
+	aof.Retention = 2
+	aof.Capture = server.Capture
+
+	for _, key := range []string{"a", "ab", "abc", "abd", "b", "bc"} {
+		server.Insert("test", []byte(key), key)
+		aof.Feed(ConvertInsert("test", key, key))
+		aof.Flush()
+	}
+	if len(aof.Segments()) < 3 {
+		t.Fatalf("expected segments to rotate, got %v", aof.Segments())
+	}
+
+	if err = aof.Snapshot(); err != nil {
+		t.Fatal(err.Error())
+	}
+	server.Remove("test", []byte("ab"))
+	aof.Feed(ConvertRemove("test", "ab"))
+	aof.Close()
+
+	segments := aof.Segments()
+	if segments[0].Type != SegmentBase || len(segments) != 2 {
+		t.Fatalf("unexpected manifest after snapshot %v", segments)
+	}
+	archive, err := ReadManifest(filepath.Join(dir, "archive", "aof.log.manifest"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(archive.Segments) != 2 {
+		t.Errorf("expected 2 archived segments, got %d", len(archive.Segments))
+	}
+
+	aof, err = NewAOF(dir, "aof.log")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer aof.Close()
+
+	loaded := NewEngine()
+	if err = aof.Load(loaded); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, key := range []string{"a", "abc", "abd", "b", "bc"} {
+		if ret, value := loaded.DB["test"].Find([]byte(key)); !ret || value != key {
+			t.Errorf("key %s not loaded", key)
+		}
+	}
+	if ret, _ := loaded.DB["test"].Find([]byte("ab")); ret {
+		t.Errorf("removed key ab loaded")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	server := NewEngine()
+	aof, err := NewAOF(dir, "aof.log")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	aof.ArchiveDir = filepath.Join(dir, "archive")
+	aof.Capture = server.Capture
+	defer aof.Close()
+
+	write := func(cmd []byte) {
+		reader := NewAofReader(bytes.NewReader(cmd))
+		args, err := reader.Next()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err = server.Apply(args); err != nil {
+			t.Fatal(err.Error())
+		}
+		aof.Feed(cmd)
+		aof.Flush()
+	}
+
+	write(ConvertInsert("test", "a", "1")) // seq 1
+	write(ConvertInsert("test", "b", "1")) // seq 2
+	write(ConvertInsert("test", "a", "2")) // seq 3
+	if err = aof.Snapshot(); err != nil {
+		t.Fatal(err.Error())
+	}
+	write(ConvertRemove("test", "b"))      // seq 4
+	write(ConvertInsert("test", "c", "1")) // seq 5
+
+	cases := []struct {
+		seq      int64
+		expected map[string]interface{}
+	}{
+		{2, map[string]interface{}{"a": "1", "b": "1"}},
+		{3, map[string]interface{}{"a": "2", "b": "1"}},
+		{4, map[string]interface{}{"a": "2"}},
+		{5, map[string]interface{}{"a": "2", "c": "1"}},
+	}
+
+	for _, c := range cases {
+		restored, err := aof.Restore(RestoreTarget{Seq: c.seq})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		trie := restored.GetTrie("test")
+		if int(trie.NumberKey) != len(c.expected) {
+			t.Errorf("seq %d: expected %d keys, got %d", c.seq, len(c.expected), trie.NumberKey)
+		}
+		for key, value := range c.expected {
+			if ret, v := trie.Find([]byte(key)); !ret || v != value {
+				t.Errorf("seq %d: expected %s=%v, got %v", c.seq, key, value, v)
+			}
+		}
+	}
+
+	// 归档被删除后，快照之前的时间点无法恢复
+	os.RemoveAll(aof.ArchiveDir)
+	if _, err = aof.Restore(RestoreTarget{Seq: 2}); err == nil {
+		t.Errorf("expected restore before the snapshot to fail without the archive")
+	}
+	if _, err = aof.Restore(RestoreTarget{Seq: 4}); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestParseRestoreTime(t *testing.T) {
+	now := time.Date(2020, 5, 6, 20, 0, 0, 0, time.Local)
+
+	cases := map[string]time.Time{
+		"14:05":                time.Date(2020, 5, 6, 14, 5, 0, 0, time.Local),
+		"14:05:30":             time.Date(2020, 5, 6, 14, 5, 30, 0, time.Local),
+		"2020-05-01 14:05":     time.Date(2020, 5, 1, 14, 5, 0, 0, time.Local),
+		"2020-05-01T14:05:00Z": time.Date(2020, 5, 1, 14, 5, 0, 0, time.UTC),
+	}
+
+	for value, expected := range cases {
+		parsed, err := ParseRestoreTime(value, now)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !parsed.Equal(expected) {
+			t.Errorf("%s: expected %s, got %s", value, expected, parsed)
+		}
+	}
+}
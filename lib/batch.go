@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"fmt"
+	"time"
+)
+
+// 一个批量请求最多包含的操作数量
+const MaxBatchOps = 100000
+
+const (
+	BatchInsert = "insert"
+	BatchUpdate = "update"
+	BatchRemove = "remove"
+)
+
+const (
+	BatchCreated  = "created"
+	BatchUpdated  = "updated"
+	BatchRemoved  = "removed"
+	BatchNotFound = "not_found"
+	BatchInvalid  = "invalid"
+	// 超过内存限制
+	BatchRejected = "rejected"
+)
+
+// BatchOp is one operation of a batch. insert adds or replaces a key, update
+// only replaces an existing key and remove deletes it.
+type BatchOp struct {
+	Op    string  `json:"op"`
+	Name  string  `json:"name"`
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	// insert和update写入的key在多少秒之后过期，0表示不过期
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// value is the value op writes, nil for a missing or empty value.
+func (op BatchOp) value() interface{} {
+	if op.Value != nil && *op.Value != "" {
+		return *op.Value
+	}
+	return nil
+}
+
+type BatchResult struct {
+	Status string `json:"status"`
+	// status为invalid或not_found时的原因
+	Error string `json:"error,omitempty"`
+	// 插入和更新之后key的版本
+	Version int64 `json:"version,omitempty"`
+}
+
+// Batch applies the operations in order and writes them to the AOF as one
+// contiguous block, an operation that fails does not stop the others.
+func (engine *Engine) Batch(ops []BatchOp) []BatchResult {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+	engine.feedMutex.Lock()
+	defer engine.feedMutex.Unlock()
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = engine.batchOp(op)
+	}
+	engine.syncAlways()
+	return results
+}
+
+func (engine *Engine) batchOp(op BatchOp) BatchResult {
+	if op.Key == "" {
+		return BatchResult{Status: BatchInvalid, Error: "key is required"}
+	}
+	switch op.Op {
+	case BatchInsert, BatchUpdate, BatchRemove:
+	default:
+		return BatchResult{Status: BatchInvalid, Error: fmt.Sprintf("unknown op `%s`", op.Op)}
+	}
+	if op.TTL < 0 {
+		return BatchResult{Status: BatchInvalid, Error: "ttl must not be negative"}
+	}
+
+	trie := engine.GetTrie(op.Name)
+	if trie == nil {
+		return BatchResult{Status: BatchNotFound, Error: fmt.Sprintf("trie `%s` not found", op.Name)}
+	}
+
+	key := []byte(op.Key)
+	exists, _ := trie.Find(key)
+	if op.Op == BatchRemove {
+		if !exists {
+			return BatchResult{Status: BatchNotFound, Error: ErrKeyNotFound.Error()}
+		}
+		trie.Remove(key)
+		engine.feed(ConvertRemove(op.Name, op.Key))
+		return BatchResult{Status: BatchRemoved}
+	}
+
+	if op.Op == BatchUpdate && !exists {
+		return BatchResult{Status: BatchNotFound, Error: ErrKeyNotFound.Error()}
+	}
+	value := op.value()
+	if err := engine.reserveKey(op.Name, key, value, engine.feed); err != nil {
+		return BatchResult{Status: BatchRejected, Error: err.Error()}
+	}
+	expire := expireAt(time.Duration(op.TTL) * time.Second)
+	version := trie.InsertExpire(key, value, 0, expire)
+	engine.feed(ConvertInsertExpire(op.Name, op.Key, ValueString(value), version, expire))
+	if exists {
+		return BatchResult{Status: BatchUpdated, Version: version}
+	}
+	return BatchResult{Status: BatchCreated, Version: version}
+}
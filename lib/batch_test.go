@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestServer_HandleBatch(t *testing.T) {
+	server := NewServer()
+	server.CreateTrie("dict")
+	server.CreateTrie("other")
+	server.InsertKey("dict", "北京", nil)
+	server.InsertKey("other", "大学", nil)
+
+	one := "1"
+	body, _ := json.Marshal(BatchRequest{Ops: []BatchOp{
+		{Op: BatchInsert, Name: "dict", Key: "北京", Value: &one},
+		{Op: BatchInsert, Name: "dict", Key: "清华"},
+		{Op: BatchUpdate, Name: "dict", Key: "复旦", Value: &one},
+		{Op: BatchRemove, Name: "other", Key: "大学"},
+		{Op: BatchRemove, Name: "other", Key: "大学"},
+		{Op: BatchInsert, Name: "nothing", Key: "abc"},
+		{Op: "upsert", Name: "dict", Key: "abc"},
+	}})
+
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+	resp, err := http.Post(ts.URL+"/api/batch", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+
+	var response BatchResponse
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err.Error())
+	}
+	var statuses []string
+	for _, result := range response.Results {
+		statuses = append(statuses, result.Status)
+	}
+	expected := []string{BatchUpdated, BatchCreated, BatchNotFound, BatchRemoved, BatchNotFound, BatchNotFound, BatchInvalid}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("unexpected results %v", statuses)
+	}
+
+	if value, _ := server.GetKey("dict", "北京"); value != "1" {
+		t.Errorf("key not updated")
+	}
+	if _, err = server.GetKey("dict", "复旦"); err != ErrKeyNotFound {
+		t.Errorf("update inserted a missing key")
+	}
+
+	resp, err = http.Post(ts.URL+"/api/batch", "application/json", bytes.NewReader([]byte(`{"ops":[]}`)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("expected 400 for an empty batch, got %d", resp.StatusCode)
+	}
+}
+
+func TestEngine_BatchContiguous(t *testing.T) {
+	engine := NewEngine()
+	engine.CreateTrie("batch")
+	engine.CreateTrie("single")
+
+	var mutex sync.Mutex
+	var fed [][]byte
+	engine.OnFeed = func(cmd []byte) {
+		mutex.Lock()
+		fed = append(fed, cmd)
+		mutex.Unlock()
+	}
+
+	ops := make([]BatchOp, 200)
+	for i := range ops {
+		ops[i] = BatchOp{Op: BatchInsert, Name: "batch", Key: "key" + strconv.Itoa(i)}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			engine.InsertKey("single", "key"+strconv.Itoa(i), nil)
+		}
+	}()
+	engine.Batch(ops)
+	wg.Wait()
+
+	first, last := -1, -1
+	for i, cmd := range fed {
+		if bytes.Contains(cmd, []byte("batch")) {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if last-first != len(ops)-1 {
+		t.Errorf("batch interleaved with other writes, from %d to %d", first, last)
+	}
+}
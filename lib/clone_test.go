@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTrie_Clone(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert([]byte("ab"), "1")
+	trie.Insert([]byte("abc"), "2")
+	trie.SetConfig(ConfigMaxNodes, "100")
+	clone := trie.Clone()
+
+	// 两边的写入互不影响
+	trie.Insert([]byte("abd"), "3")
+	clone.Remove([]byte("abc"))
+	clone.Insert([]byte("ab"), "4")
+	clone.SetConfig(ConfigMaxNodes, "")
+
+	if ret, value := trie.Find([]byte("ab")); !ret || value != "1" {
+		t.Errorf("expected the source to keep its value, got %v", value)
+	}
+	if ret, _ := trie.Find([]byte("abc")); !ret {
+		t.Error("expected the source to keep the key removed from the clone")
+	}
+	if ret, _ := clone.Find([]byte("abd")); ret {
+		t.Error("expected the clone not to see a key inserted after cloning")
+	}
+	if trie.NumberKey != 3 || clone.NumberKey != 1 || clone.NumberNode != 2 {
+		t.Errorf("unexpected counts %d %d %d", trie.NumberKey, clone.NumberKey, clone.NumberNode)
+	}
+	if _, ok := trie.GetConfig(ConfigMaxNodes); !ok {
+		t.Error("expected the source to keep its config")
+	}
+}
+
+func TestEngine_Clone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clone")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	options := DefaultOptions(dir)
+	options.Fsync = FsyncAlways
+	engine, err := Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	engine.CreateTrie("dict")
+	engine.InsertKey("dict", "a", "1")
+	if err = engine.CloneTrie("dict", "backup"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = engine.CloneTrie("dict", "backup"); err != ErrTrieExists {
+		t.Errorf("expected ErrTrieExists, got %v", err)
+	}
+	if err = engine.CloneTrie("missing", "other"); err != ErrTrieNotFound {
+		t.Errorf("expected ErrTrieNotFound, got %v", err)
+	}
+	engine.InsertKey("dict", "b", "2")
+	engine.RemoveKey("backup", "a")
+	engine.InsertKey("backup", "c", "3")
+	engine.Close()
+
+	engine, err = Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer engine.Close()
+	check := func(name string, keys ...string) {
+		var found []string
+		engine.GetTrie(name).Range(func(key []byte, node *Node) bool {
+			found = append(found, string(key))
+			return true
+		})
+		if strings.Join(found, ",") != strings.Join(keys, ",") {
+			t.Errorf("expected %s to have %v after replay, got %v", name, keys, found)
+		}
+	}
+	check("dict", "a", "b")
+	check("backup", "c")
+}
+
+// 快照和CLONE并发时，重新打开后的数据和关闭前一样
+func TestEngine_SnapshotClone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clone")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	options := DefaultOptions(dir)
+	engine, err := Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	engine.CreateTrie("dict")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			engine.InsertKey("dict", strconv.Itoa(i), nil)
+			engine.CloneTrie("dict", "copy"+strconv.Itoa(i))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err = engine.Snapshot(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	wg.Wait()
+
+	var live bytes.Buffer
+	engine.Rewrite(&live)
+	engine.Close()
+
+	engine, err = Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer engine.Close()
+	var loaded bytes.Buffer
+	engine.Rewrite(&loaded)
+	if live.String() != loaded.String() {
+		t.Error("expected the same data after reopening")
+	}
+}
+
+func TestServer_Clone(t *testing.T) {
+	server := NewServer()
+	server.CreateTrie("dict")
+	server.InsertKey("dict", "a", "1")
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	clone := func(name string, body string) int {
+		resp, err := http.Post(ts.URL+"/api/trie/"+name+"/clone", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := clone("dict", `{}`); code != 400 {
+		t.Errorf("expected 400 without as, got %d", code)
+	}
+	if code := clone("missing", `{"as":"copy"}`); code != 404 {
+		t.Errorf("expected 404 for a missing trie, got %d", code)
+	}
+	if code := clone("dict", `{"as":"copy"}`); code != 200 {
+		t.Errorf("expected 200, got %d", code)
+	}
+	if code := clone("dict", `{"as":"copy"}`); code != 409 {
+		t.Errorf("expected 409 for an existing trie, got %d", code)
+	}
+	if value, err := server.GetKey("copy", "a"); err != nil || value != "1" {
+		t.Errorf("expected the clone to have the keys, got %v %v", value, err)
+	}
+}
@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DiffEntry的类型
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+)
+
+// 合并时两个trie中value不同的key的处理方式
+const (
+	MergeKeepSource = "keep-source"
+	MergeKeepTarget = "keep-target"
+	MergeError      = "error"
+)
+
+// DiffEntry is a key that differs between two tries. Value is the value in
+// the second trie and Old the value in the first one.
+type DiffEntry struct {
+	Op    string      `json:"op"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value,omitempty"`
+	Old   interface{} `json:"old,omitempty"`
+}
+
+// ConflictError is returned by a merge with MergeError when a key has
+// different values in the two tries, nothing was merged.
+type ConflictError struct {
+	Key string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("key `%s` differs in both tries", e.Key)
+}
+
+// MergeResult counts the keys a merge added, overwrote and left unchanged
+// because of a conflict.
+type MergeResult struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+}
+
+// Diff calls fn in lexicographic order for every key added, removed or
+// changed from trie from to trie to until fn returns false. It compares the
+// versions of the tries when it starts, and skips the nodes the tries share
+// after a Clone.
+func Diff(from *Trie, to *Trie, fn func(entry DiffEntry) bool) {
+	diffNode(make([]byte, 0), from.Root(), to.Root(), Millisecond(time.Now()), fn)
+}
+
+func diffNode(key []byte, a *Node, b *Node, now int64, fn func(entry DiffEntry) bool) bool {
+	if a == b {
+		return true
+	}
+
+	inA := a != nil && a.alive(now)
+	inB := b != nil && b.alive(now)
+	switch {
+	case inA && !inB:
+		if !fn(DiffEntry{Op: DiffRemoved, Key: string(key), Old: a.Value}) {
+			return false
+		}
+	case !inA && inB:
+		if !fn(DiffEntry{Op: DiffAdded, Key: string(key), Value: b.Value}) {
+			return false
+		}
+	case inA && inB && ValueString(a.Value) != ValueString(b.Value):
+		if !fn(DiffEntry{Op: DiffChanged, Key: string(key), Value: b.Value, Old: a.Value}) {
+			return false
+		}
+	}
+
+	var ords []int
+	children := func(node *Node) map[uint8]*Node {
+		if node == nil {
+			return nil
+		}
+		return node.Children
+	}
+	for ord := range children(a) {
+		ords = append(ords, int(ord))
+	}
+	for ord := range children(b) {
+		if _, ok := children(a)[ord]; !ok {
+			ords = append(ords, int(ord))
+		}
+	}
+	sort.Ints(ords)
+
+	for _, ord := range ords {
+		path := make([]byte, len(key)+1)
+		copy(path, key)
+		path[len(key)] = uint8(ord)
+		if !diffNode(path, children(a)[uint8(ord)], children(b)[uint8(ord)], now, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// DiffTries is Diff on two tries of the engine, it does not see the writes
+// of a transaction partially.
+func (engine *Engine) DiffTries(from string, to string, fn func(entry DiffEntry) bool) error {
+	var a, b *Node
+	engine.View(func() {
+		if trie := engine.GetTrie(from); trie != nil {
+			a = trie.Root()
+		}
+		if trie := engine.GetTrie(to); trie != nil {
+			b = trie.Root()
+		}
+	})
+	if a == nil || b == nil {
+		return ErrTrieNotFound
+	}
+	// 只在取root时持有锁，之后比较的是这两个版本
+	diffNode(make([]byte, 0), a, b, Millisecond(time.Now()), fn)
+	return nil
+}
+
+// MergeTrie copies the keys of trie source missing in trie target to target,
+// policy decides what happens to the keys with different values. Keys only
+// in target are kept. The merge is applied and logged like a transaction.
+func (engine *Engine) MergeTrie(source string, target string, policy string) (MergeResult, error) {
+	var result MergeResult
+	switch policy {
+	case MergeKeepSource, MergeKeepTarget, MergeError:
+	default:
+		return result, fmt.Errorf("unknown merge policy `%s`", policy)
+	}
+
+	engine.txMutex.Lock()
+	defer engine.txMutex.Unlock()
+
+	src, dst := engine.GetTrie(source), engine.GetTrie(target)
+	if src == nil || dst == nil {
+		return result, ErrTrieNotFound
+	}
+
+	var keys []string
+	var conflict error
+	Diff(dst, src, func(entry DiffEntry) bool {
+		switch entry.Op {
+		case DiffAdded:
+			keys = append(keys, entry.Key)
+		case DiffChanged:
+			if policy == MergeError {
+				conflict = &ConflictError{Key: entry.Key}
+				return false
+			}
+			if policy == MergeKeepTarget {
+				result.Skipped++
+				return true
+			}
+			keys = append(keys, entry.Key)
+		}
+		return true
+	})
+	if conflict != nil {
+		return MergeResult{}, conflict
+	}
+	if len(keys) == 0 {
+		return result, nil
+	}
+
+	// 按每个key实际写入的大小腾出空间，空间不够时什么都不合并
+	inserts := make([]insertion, 0, len(keys))
+	for _, key := range keys {
+		if ret, value := src.Find([]byte(key)); ret {
+			inserts = append(inserts, insertion{key: []byte(key), value: value})
+		}
+	}
+	if err := engine.reserve(map[string][]insertion{target: inserts}, engine.Feed); err != nil {
+		return MergeResult{}, err
+	}
+
+	cmds := make([][]byte, 0, len(keys)+2)
+	cmds = append(cmds, ConvertMulti())
+	for _, key := range keys {
+		ret, value, _, expire := src.FindExpire([]byte(key))
+		if !ret {
+			// 比较之后刚刚过期
+			continue
+		}
+		exists, _ := dst.Find([]byte(key))
+		version := dst.InsertExpire([]byte(key), value, 0, expire)
+		cmds = append(cmds, ConvertInsertExpire(target, key, ValueString(value), version, expire))
+		if exists {
+			result.Updated++
+		} else {
+			result.Added++
+		}
+	}
+	cmds = append(cmds, ConvertExec())
+
+	engine.feedMutex.Lock()
+	engine.feedBlock(cmds)
+	engine.syncAlways()
+	engine.feedMutex.Unlock()
+	return result, nil
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func diffEntries(from *Trie, to *Trie) []DiffEntry {
+	var entries []DiffEntry
+	Diff(from, to, func(entry DiffEntry) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	return entries
+}
+
+func TestTrie_Diff(t *testing.T) {
+	a := NewTrie()
+	a.Insert([]byte("ab"), "1")
+	a.Insert([]byte("abc"), "2")
+	a.Insert([]byte("b"), nil)
+	b := a.Clone()
+	b.Remove([]byte("ab"))
+	b.Insert([]byte("abc"), "3")
+	b.Insert([]byte("a"), nil)
+	b.Insert([]byte("c"), "4")
+
+	expected := []DiffEntry{
+		{Op: DiffAdded, Key: "a"},
+		{Op: DiffRemoved, Key: "ab", Old: "1"},
+		{Op: DiffChanged, Key: "abc", Value: "3", Old: "2"},
+		{Op: DiffAdded, Key: "c", Value: "4"},
+	}
+	if entries := diffEntries(a, b); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected diff %v", entries)
+	}
+	if entries := diffEntries(a, a.Clone()); len(entries) != 0 {
+		t.Errorf("expected no diff with a clone, got %v", entries)
+	}
+
+	// 不同来源的trie逐个节点比较
+	c := NewTrie()
+	c.Insert([]byte("b"), nil)
+	c.Insert([]byte("abc"), "2")
+	c.Insert([]byte("ab"), "1")
+	if entries := diffEntries(a, c); len(entries) != 0 {
+		t.Errorf("expected no diff with the same keys, got %v", entries)
+	}
+}
+
+func TestEngine_Merge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	options := DefaultOptions(dir)
+	options.Fsync = FsyncAlways
+	engine, err := Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	engine.CreateTrie("staging")
+	engine.CreateTrie("production")
+	engine.InsertKey("staging", "a", "1")
+	engine.InsertKey("staging", "b", "2")
+	engine.InsertKey("production", "b", "old")
+	engine.InsertKey("production", "c", "3")
+
+	if _, err = engine.MergeTrie("staging", "production", "random"); err == nil {
+		t.Error("expected an unknown policy to fail")
+	}
+	if _, err = engine.MergeTrie("staging", "production", MergeError); err == nil || err.(*ConflictError).Key != "b" {
+		t.Errorf("expected a conflict on b, got %v", err)
+	}
+	if exists, _ := engine.GetTrie("production").Find([]byte("a")); exists {
+		t.Error("expected a failed merge to change nothing")
+	}
+
+	result, err := engine.MergeTrie("staging", "production", MergeKeepTarget)
+	if err != nil || result != (MergeResult{Added: 1, Skipped: 1}) {
+		t.Errorf("unexpected keep-target merge %+v %v", result, err)
+	}
+	result, err = engine.MergeTrie("staging", "production", MergeKeepSource)
+	if err != nil || result != (MergeResult{Updated: 1}) {
+		t.Errorf("unexpected keep-source merge %+v %v", result, err)
+	}
+	engine.Close()
+
+	engine, err = Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer engine.Close()
+	expected := map[string]interface{}{"a": "1", "b": "2", "c": "3"}
+	for key, value := range expected {
+		if v, err := engine.GetKey("production", key); err != nil || v != value {
+			t.Errorf("expected %s=%v after replay, got %v %v", key, value, v, err)
+		}
+	}
+}
+
+func TestServer_DiffMerge(t *testing.T) {
+	server := NewServer()
+	server.CreateTrie("staging")
+	server.CreateTrie("production")
+	server.InsertKey("staging", "a", "1")
+	server.InsertKey("staging", "b", "2")
+	server.InsertKey("production", "b", "old")
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/diff?from=production&to=staging")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var entries []DiffEntry
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var entry DiffEntry
+		json.Unmarshal(scanner.Bytes(), &entry)
+		entries = append(entries, entry)
+	}
+	resp.Body.Close()
+	if len(entries) != 2 || entries[0].Key != "a" || entries[1].Op != DiffChanged {
+		t.Errorf("unexpected diff %v", entries)
+	}
+
+	resp, _ = http.Get(ts.URL + "/api/diff?from=production&to=missing")
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("expected 404 for a missing trie, got %d", resp.StatusCode)
+	}
+
+	merge := func(body string) int {
+		resp, err := http.Post(ts.URL+"/api/merge", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := merge(`{"source":"staging","target":"production"}`); code != 409 {
+		t.Errorf("expected 409 for a conflict, got %d", code)
+	}
+	if code := merge(`{"source":"staging","target":"missing","policy":"keep-source"}`); code != 404 {
+		t.Errorf("expected 404 for a missing trie, got %d", code)
+	}
+	if code := merge(`{"source":"staging","target":"production","policy":"keep-source"}`); code != 200 {
+		t.Errorf("expected 200, got %d", code)
+	}
+	if value, _ := server.GetKey("production", "b"); value != "2" {
+		t.Errorf("expected the source value, got %v", value)
+	}
+}
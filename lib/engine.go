@@ -0,0 +1,666 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Engine holds the tries and their AOF, it can be used in process without
+// the Server:
+//
+//	engine, err := lib.Open(lib.DefaultOptions("./data"))
+//	if err != nil {
+//		...
+//	}
+//	defer engine.Close()
+//	engine.CreateTrie("dict")
+//	err = engine.InsertKey("dict", "北京", nil)
+//	keys, err := engine.ForwardMatch("dict", "北京大学")
+type Engine struct {
+	DB  map[string]*Trie
+	AOF *AofWriter
+	// 保护DB，查找trie持有读锁，创建和删除trie持有写锁
+	Mutex sync.RWMutex
+	// 每条写命令记录到AOF之后调用，Server用它把命令发送给replica
+	OnFeed func(cmd []byte)
+
+	// 持有读锁的写入在执行和记录期间都持有它，AOF和复制流中命令的顺序和执行的顺序一致，
+	// 一批命令也是连续的
+	feedMutex sync.Mutex
+	// 事务持有写锁，其他读写持有读锁，读请求不会看到执行了一半的事务
+	txMutex sync.RWMutex
+
+	// 所有trie加起来的内存限制，每个trie的限制在它的配置项中
+	Limits Limits
+
+	expireOnce sync.Once
+	expireStop chan struct{}
+	evicted    int64
+
+	loadDuration time.Duration
+}
+
+var (
+	ErrTrieNotFound = errors.New("trie not found")
+	ErrTrieExists   = errors.New("trie already exists")
+	ErrKeyNotFound  = errors.New("key not found")
+)
+
+// Options of the AOF of an engine.
+type Options struct {
+	// AOF的目录和段文件名的前缀，都为空时数据只保存在内存中
+	Dir      string
+	FileName string
+	// FsyncNo, FsyncAlways or FsyncEverySec
+	Fsync         int
+	LoadTruncated bool
+	// 段的大小和时间上限，0表示不限制
+	SegmentSize      int64
+	SegmentAge       time.Duration
+	SnapshotSegments int
+	ArchiveDir       string
+	Retention        int
+	// 在后台删除过期的key，replica不需要开启
+	ActiveExpire bool
+	// 内存和节点数量的上限，0表示不限制，超过时按Eviction处理
+	MaxMemory int64
+	MaxNodes  int64
+	Eviction  string
+}
+
+// DefaultOptions keeps the AOF in dir and fsyncs it every second.
+func DefaultOptions(dir string) Options {
+	return Options{
+		Dir:              dir,
+		FileName:         "aof.log",
+		Fsync:            FsyncEverySec,
+		LoadTruncated:    true,
+		SegmentSize:      64 * 1024 * 1024,
+		SegmentAge:       time.Hour,
+		SnapshotSegments: 8,
+		ActiveExpire:     true,
+	}
+}
+
+// NewEngine returns an engine that keeps its data in memory only.
+func NewEngine() *Engine {
+	return &Engine{DB: make(map[string]*Trie)}
+}
+
+// Open loads the AOF described by options and keeps writing to it.
+func Open(options Options) (*Engine, error) {
+	engine := NewEngine()
+	if err := engine.Load(options); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// Load loads the AOF described by options into an empty engine and keeps
+// writing to it. Nothing else may use the engine until it returns, Server
+// answers 503 meanwhile.
+func (engine *Engine) Load(options Options) error {
+	limits := Limits{MaxMemory: options.MaxMemory, MaxNodes: options.MaxNodes, Eviction: options.Eviction}
+	if err := limits.Check(); err != nil {
+		return err
+	}
+	engine.Limits = limits
+	if options.Dir == "" && options.FileName == "" {
+		if options.ActiveExpire {
+			engine.StartExpiration()
+		}
+		return nil
+	}
+	if options.FileName == "" {
+		options.FileName = "aof.log"
+	}
+
+	aof, err := NewAOF(options.Dir, options.FileName)
+	if err != nil {
+		return err
+	}
+	aof.Fsync = options.Fsync
+	aof.LoadTruncated = options.LoadTruncated
+	aof.SegmentSize = options.SegmentSize
+	aof.SegmentAge = options.SegmentAge
+	aof.SnapshotSegments = options.SnapshotSegments
+	aof.ArchiveDir = options.ArchiveDir
+	aof.Retention = options.Retention
+	aof.Capture = engine.Capture
+
+	start := time.Now()
+	if err = aof.Load(engine); err != nil {
+		aof.Close()
+		return err
+	}
+	engine.loadDuration = time.Since(start)
+	engine.AOF = aof
+	aof.Cron()
+	if options.ActiveExpire {
+		engine.StartExpiration()
+	}
+	return nil
+}
+
+// LoadDuration is how long Load took to read the AOF.
+func (engine *Engine) LoadDuration() time.Duration {
+	return engine.loadDuration
+}
+
+// Close stops the expiration and flushes and closes the AOF.
+func (engine *Engine) Close() error {
+	if engine.expireStop != nil {
+		close(engine.expireStop)
+		engine.expireStop = nil
+	}
+	if engine.AOF == nil {
+		return nil
+	}
+	return engine.AOF.Close()
+}
+
+// Feed appends a write command to the AOF if it is enabled.
+func (engine *Engine) Feed(cmd []byte) {
+	engine.feedMutex.Lock()
+	engine.feed(cmd)
+	engine.syncAlways()
+	engine.feedMutex.Unlock()
+}
+
+func (engine *Engine) feed(cmd []byte) {
+	if engine.AOF != nil {
+		engine.AOF.Feed(cmd)
+	}
+	if engine.OnFeed != nil {
+		engine.OnFeed(cmd)
+	}
+}
+
+func (engine *Engine) syncAlways() {
+	if engine.AOF != nil && engine.AOF.Fsync == FsyncAlways {
+		engine.AOF.Flush()
+		engine.AOF.Sync()
+	}
+}
+
+// Snapshot compacts the AOF into a snapshot of the current data.
+func (engine *Engine) Snapshot() error {
+	if engine.AOF == nil {
+		return errors.New("aof is disabled")
+	}
+	return engine.AOF.Snapshot()
+}
+
+// Tries returns the names of all tries in lexicographic order.
+func (engine *Engine) Tries() []string {
+	engine.Mutex.RLock()
+	names := make([]string, 0, len(engine.DB))
+	for name := range engine.DB {
+		names = append(names, name)
+	}
+	engine.Mutex.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// CreateTrie creates an empty trie and logs it, it returns false if the trie
+// already exists.
+func (engine *Engine) CreateTrie(name string) bool {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+
+	engine.feedMutex.Lock()
+	defer engine.feedMutex.Unlock()
+	if !engine.createTrie(name) {
+		return false
+	}
+	engine.feed(ConvertCreate(name))
+	engine.syncAlways()
+	return true
+}
+
+func (engine *Engine) createTrie(name string) bool {
+	engine.Mutex.Lock()
+	defer engine.Mutex.Unlock()
+
+	if _, ok := engine.DB[name]; ok {
+		return false
+	}
+	engine.DB[name] = NewTrie()
+	return true
+}
+
+// DropTrie removes a trie and logs it, it returns false if the trie does not exist.
+func (engine *Engine) DropTrie(name string) bool {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+
+	engine.feedMutex.Lock()
+	defer engine.feedMutex.Unlock()
+	if !engine.dropTrie(name) {
+		return false
+	}
+	engine.feed(ConvertDrop(name))
+	engine.syncAlways()
+	return true
+}
+
+func (engine *Engine) dropTrie(name string) bool {
+	engine.Mutex.Lock()
+	defer engine.Mutex.Unlock()
+
+	if _, ok := engine.DB[name]; !ok {
+		return false
+	}
+	delete(engine.DB, name)
+	return true
+}
+
+// ClearTrie removes every key of a trie and keeps its config.
+func (engine *Engine) ClearTrie(name string) bool {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+
+	engine.feedMutex.Lock()
+	defer engine.feedMutex.Unlock()
+	if !engine.clearTrie(name) {
+		return false
+	}
+	engine.feed(ConvertClear(name))
+	engine.syncAlways()
+	return true
+}
+
+func (engine *Engine) clearTrie(name string) bool {
+	trie := engine.GetTrie(name)
+	if trie == nil {
+		return false
+	}
+	trie.Clear()
+	return true
+}
+
+// CloneTrie creates trie as with the keys and settings trie name has now and
+// logs it. The clone shares the nodes with name, so it takes constant time.
+func (engine *Engine) CloneTrie(name string, as string) error {
+	// 和事务一样持有写锁，克隆之前的写入都已经记录在CLONE之前
+	engine.txMutex.Lock()
+	defer engine.txMutex.Unlock()
+
+	if err := engine.cloneTrie(name, as); err != nil {
+		return err
+	}
+	engine.Feed(ConvertClone(name, as))
+	return nil
+}
+
+func (engine *Engine) cloneTrie(name string, as string) error {
+	engine.Mutex.Lock()
+	defer engine.Mutex.Unlock()
+
+	source, ok := engine.DB[name]
+	if !ok {
+		return ErrTrieNotFound
+	}
+	if _, ok := engine.DB[as]; ok {
+		return ErrTrieExists
+	}
+	engine.DB[as] = source.Clone()
+	return nil
+}
+
+// RenameTrie gives trie name the new name to and logs it, readers see the
+// trie under either name but never both.
+func (engine *Engine) RenameTrie(name string, to string) error {
+	engine.txMutex.Lock()
+	defer engine.txMutex.Unlock()
+
+	if err := engine.renameTrie(name, to); err != nil {
+		return err
+	}
+	engine.Feed(ConvertRename(name, to))
+	return nil
+}
+
+func (engine *Engine) renameTrie(name string, to string) error {
+	engine.Mutex.Lock()
+	defer engine.Mutex.Unlock()
+
+	trie, ok := engine.DB[name]
+	if !ok {
+		return ErrTrieNotFound
+	}
+	if _, ok := engine.DB[to]; ok {
+		return ErrTrieExists
+	}
+	delete(engine.DB, name)
+	engine.DB[to] = trie
+	return nil
+}
+
+// SwapTrie exchanges the tries named name and other and logs it. A trie is
+// rebuilt under a temporary name and then swapped in, readers see either
+// the old or the new trie, never a partially loaded one.
+func (engine *Engine) SwapTrie(name string, other string) error {
+	engine.txMutex.Lock()
+	defer engine.txMutex.Unlock()
+
+	if err := engine.swapTrie(name, other); err != nil {
+		return err
+	}
+	engine.Feed(ConvertSwap(name, other))
+	return nil
+}
+
+func (engine *Engine) swapTrie(name string, other string) error {
+	engine.Mutex.Lock()
+	defer engine.Mutex.Unlock()
+
+	a, ok := engine.DB[name]
+	if !ok {
+		return ErrTrieNotFound
+	}
+	b, ok := engine.DB[other]
+	if !ok {
+		return ErrTrieNotFound
+	}
+	engine.DB[name], engine.DB[other] = b, a
+	return nil
+}
+
+// ConfigTrie sets a config of a trie, an empty value removes it.
+func (engine *Engine) ConfigTrie(name string, key string, value string) bool {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+
+	engine.feedMutex.Lock()
+	defer engine.feedMutex.Unlock()
+	if !engine.configTrie(name, key, value) {
+		return false
+	}
+	engine.feed(ConvertConfig(name, key, value))
+	engine.syncAlways()
+	return true
+}
+
+func (engine *Engine) configTrie(name string, key string, value string) bool {
+	trie := engine.GetTrie(name)
+	if trie == nil {
+		return false
+	}
+	trie.SetConfig(key, value)
+	return true
+}
+
+// RestoreTrie copies trie name as it was at target into the new trie as.
+func (engine *Engine) RestoreTrie(name string, as string, target RestoreTarget) error {
+	if engine.AOF == nil {
+		return errors.New("aof is disabled")
+	}
+
+	restored, err := engine.AOF.Restore(target)
+	if err != nil {
+		return err
+	}
+
+	source := restored.GetTrie(name)
+	if source == nil {
+		return ErrTrieNotFound
+	}
+	if !engine.CreateTrie(as) {
+		return ErrTrieExists
+	}
+
+	trie := engine.GetTrie(as)
+	for key, value := range source.ConfigMap() {
+		engine.ConfigTrie(as, key, value)
+	}
+	source.Range(func(key []byte, node *Node) bool {
+		trie.InsertExpire(key, node.Value, node.Version, node.ExpireAt)
+		engine.Feed(ConvertInsertExpire(as, string(key), ValueString(node.Value), node.Version, node.ExpireAt))
+		return true
+	})
+
+	return nil
+}
+
+// ReplaceDB swaps in all tries at once, used when a replica loads the
+// snapshot of its primary.
+func (engine *Engine) ReplaceDB(db map[string]*Trie) {
+	engine.Mutex.Lock()
+	engine.DB = db
+	engine.Mutex.Unlock()
+}
+
+func (engine *Engine) GetTrie(name string) *Trie {
+	engine.Mutex.RLock()
+	trie, ok := engine.DB[name]
+	engine.Mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+	return trie
+}
+
+// Insert inserts a key without logging it, the trie is created if needed.
+func (engine *Engine) Insert(name string, key []byte, value interface{}) {
+	engine.insert(name, key, value, 0, 0)
+}
+
+func (engine *Engine) insert(name string, key []byte, value interface{}, version int64, expireAt int64) {
+	trie := engine.GetTrie(name)
+	if trie == nil {
+		engine.Mutex.Lock()
+		if trie = engine.DB[name]; trie == nil {
+			trie = NewTrie()
+			engine.DB[name] = trie
+		}
+		engine.Mutex.Unlock()
+	}
+	trie.InsertExpire(key, value, version, expireAt)
+}
+
+// Remove removes a key without logging it.
+func (engine *Engine) Remove(name string, key []byte) {
+	if trie := engine.GetTrie(name); trie != nil {
+		trie.Remove(key)
+	}
+}
+
+// InsertKey inserts a key into an existing trie and logs it.
+func (engine *Engine) InsertKey(name string, key string, value interface{}) error {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+
+	trie := engine.GetTrie(name)
+	if trie == nil {
+		return ErrTrieNotFound
+	}
+
+	engine.feedMutex.Lock()
+	defer engine.feedMutex.Unlock()
+	defer engine.syncAlways()
+	if err := engine.reserveKey(name, []byte(key), value, engine.feed); err != nil {
+		return err
+	}
+
+	version := trie.InsertVersion([]byte(key), value, 0)
+	engine.feed(ConvertInsertVersion(name, key, ValueString(value), version))
+	return nil
+}
+
+// RemoveKey removes a key and logs it, it returns false if the key did not exist.
+func (engine *Engine) RemoveKey(name string, key string) bool {
+	return engine.removeKey(name, key) == nil
+}
+
+// removeKey is RemoveKey returning ErrTrieNotFound or ErrKeyNotFound.
+func (engine *Engine) removeKey(name string, key string) error {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+
+	trie := engine.GetTrie(name)
+	if trie == nil {
+		return ErrTrieNotFound
+	}
+
+	engine.feedMutex.Lock()
+	defer engine.feedMutex.Unlock()
+	ret, _ := trie.Find([]byte(key))
+	trie.Remove([]byte(key))
+	engine.feed(ConvertRemove(name, key))
+	engine.syncAlways()
+	if !ret {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+func (engine *Engine) GetKey(name string, key string) (interface{}, error) {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+
+	trie := engine.GetTrie(name)
+	if trie == nil {
+		return nil, ErrTrieNotFound
+	}
+
+	ret, value := trie.Find([]byte(key))
+	if !ret {
+		return nil, ErrKeyNotFound
+	}
+	return value, nil
+}
+
+// Apply executes a command read back from the AOF without logging it again.
+func (engine *Engine) Apply(args [][]byte) error {
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+
+	op := strings.ToUpper(string(args[0]))
+	switch {
+	case op == "INSERT" && len(args) >= 4 && len(args) <= 6:
+		var value interface{}
+		// HTTP写入的key没有value，AOF中记录为空字符串
+		if len(args[3]) > 0 {
+			value = string(args[3])
+		}
+		var version, expireAt int64
+		var err error
+		if len(args) >= 5 {
+			if version, err = strconv.ParseInt(string(args[4]), 10, 64); err != nil || version <= 0 {
+				return fmt.Errorf("bad version %q of INSERT", args[4])
+			}
+		}
+		if len(args) == 6 {
+			if expireAt, err = strconv.ParseInt(string(args[5]), 10, 64); err != nil || expireAt <= 0 {
+				return fmt.Errorf("bad expire time %q of INSERT", args[5])
+			}
+			// 重放时已经过期的key直接删除
+			if expireAt <= Millisecond(time.Now()) {
+				engine.Remove(string(args[1]), args[2])
+				return nil
+			}
+		}
+		engine.insert(string(args[1]), args[2], value, version, expireAt)
+	case op == "REMOVE" && len(args) == 3:
+		engine.Remove(string(args[1]), args[2])
+	case op == "CREATE" && len(args) == 2:
+		engine.createTrie(string(args[1]))
+	case op == "DROP" && len(args) == 2:
+		engine.dropTrie(string(args[1]))
+	case op == "CLEAR" && len(args) == 2:
+		engine.clearTrie(string(args[1]))
+	case op == "CLONE" && len(args) == 3:
+		if err := engine.cloneTrie(string(args[1]), string(args[2])); err != nil {
+			return fmt.Errorf("clone %s as %s: %s", args[1], args[2], err.Error())
+		}
+	case op == "RENAME" && len(args) == 3:
+		if err := engine.renameTrie(string(args[1]), string(args[2])); err != nil {
+			return fmt.Errorf("rename %s to %s: %s", args[1], args[2], err.Error())
+		}
+	case op == "SWAP" && len(args) == 3:
+		if err := engine.swapTrie(string(args[1]), string(args[2])); err != nil {
+			return fmt.Errorf("swap %s and %s: %s", args[1], args[2], err.Error())
+		}
+	case op == "SNAPSHOT" && len(args) == 1:
+		// 快照结束标记，没有数据
+	case op == "CONFIG" && len(args) == 4:
+		if !engine.configTrie(string(args[1]), string(args[2]), string(args[3])) {
+			return fmt.Errorf("config of unknown trie %s", args[1])
+		}
+	default:
+		return fmt.Errorf("unknown command %s with %d arguments", op, len(args))
+	}
+
+	return nil
+}
+
+// view runs fn on a trie like View.
+func (engine *Engine) view(name string, fn func(trie *Trie)) error {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+
+	trie := engine.GetTrie(name)
+	if trie == nil {
+		return ErrTrieNotFound
+	}
+	fn(trie)
+	return nil
+}
+
+// PrefixSearch returns up to limit keys starting with prefix, shorter keys first.
+func (engine *Engine) PrefixSearch(name string, prefix string, limit int) ([]string, error) {
+	var keys []string
+	err := engine.view(name, func(trie *Trie) {
+		keys = trie.PrefixSearch(prefix, limit)
+	})
+	return keys, err
+}
+
+// ForwardMatch returns the keys that are prefixes of text.
+func (engine *Engine) ForwardMatch(name string, text string) ([]string, error) {
+	var keys []string
+	err := engine.view(name, func(trie *Trie) {
+		keys = trie.ForwardMatch(text)
+	})
+	return keys, err
+}
+
+// Match finds every key occurring in text.
+func (engine *Engine) Match(name string, text string) ([]Hit, error) {
+	var hits []Hit
+	err := engine.view(name, func(trie *Trie) {
+		hits = trie.MatchAll(text)
+	})
+	return hits, err
+}
+
+// Segment splits text into keys with forward maximum matching.
+func (engine *Engine) Segment(name string, text string) ([]string, error) {
+	var keys []string
+	err := engine.view(name, func(trie *Trie) {
+		keys = trie.Segment(text)
+	})
+	return keys, err
+}
+
+// ListKeys returns up to limit keys greater than after in lexicographic
+// order, the next page starts after the last key returned.
+func (engine *Engine) ListKeys(name string, after string, limit int) ([]string, error) {
+	keys := make([]string, 0)
+	err := engine.view(name, func(trie *Trie) {
+		trie.RangeAfter([]byte(after), func(key []byte, node *Node) bool {
+			keys = append(keys, string(key))
+			return len(keys) < limit
+		})
+	})
+	return keys, err
+}
@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "engine")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	options := DefaultOptions(dir)
+	options.Fsync = FsyncAlways
+	engine, err := Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err = engine.InsertKey("dict", "北京", nil); err != ErrTrieNotFound {
+		t.Errorf("expected trie not found, got %v", err)
+	}
+	if _, err = engine.ForwardMatch("dict", "北京"); err != ErrTrieNotFound {
+		t.Errorf("expected trie not found, got %v", err)
+	}
+
+	engine.CreateTrie("dict")
+	engine.CreateTrie("empty")
+	engine.ConfigTrie("dict", "owner", "search")
+	for _, key := range []string{"北京", "北京大学", "大学", "学生"} {
+		if err = engine.InsertKey("dict", key, nil); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	engine.InsertKey("dict", "清华", "1")
+	engine.RemoveKey("dict", "大学")
+	if err = engine.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	engine, err = Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer engine.Close()
+
+	if tries := engine.Tries(); !reflect.DeepEqual(tries, []string{"dict", "empty"}) {
+		t.Errorf("unexpected tries %v", tries)
+	}
+	if value, err := engine.GetKey("dict", "清华"); err != nil || value != "1" {
+		t.Errorf("unexpected value %v %v", value, err)
+	}
+	if _, err = engine.GetKey("dict", "大学"); err != ErrKeyNotFound {
+		t.Errorf("expected key not found, got %v", err)
+	}
+	if value, _ := engine.GetTrie("dict").GetConfig("owner"); value != "search" {
+		t.Errorf("config of dict lost")
+	}
+
+	keys, err := engine.ForwardMatch("dict", "北京大学生")
+	if err != nil || !reflect.DeepEqual(keys, []string{"北京", "北京大学"}) {
+		t.Errorf("unexpected forward match %v %v", keys, err)
+	}
+	keys, err = engine.Segment("dict", "北京大学生")
+	if err != nil || !reflect.DeepEqual(keys, []string{"北京大学", "生"}) {
+		t.Errorf("unexpected segments %v %v", keys, err)
+	}
+}
+
+func TestEngine_Memory(t *testing.T) {
+	engine, err := Open(Options{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer engine.Close()
+
+	engine.CreateTrie("dict")
+	engine.InsertKey("dict", "abc", nil)
+	if keys, _ := engine.PrefixSearch("dict", "a", 10); !reflect.DeepEqual(keys, []string{"abc"}) {
+		t.Errorf("unexpected prefix search %v", keys)
+	}
+	if err = engine.Snapshot(); err == nil {
+		t.Error("expected snapshot to fail without aof")
+	}
+}
@@ -0,0 +1,309 @@
+package lib
+
+import (
+	"context"
+	"github.com/open-ds/sm/smpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// 流式返回PrefixSearch结果时每条消息最多包含的key数量，limit为0时返回的数量和HTTP接口相同
+const (
+	grpcSearchBatch = 256
+	grpcSearchLimit = 10
+)
+
+// GrpcServer serves the SM service defined in smpb/sm.proto.
+type GrpcServer struct {
+	smpb.UnimplementedSMServer
+	server *Server
+	Listen string
+
+	grpc     *grpc.Server
+	listener net.Listener
+}
+
+func NewGrpcServer(server *Server, listen string) *GrpcServer {
+	return &GrpcServer{server: server, Listen: listen}
+}
+
+func (gs *GrpcServer) Start() error {
+	listener, err := net.Listen("tcp", gs.Listen)
+	if err != nil {
+		return err
+	}
+	gs.listener = listener
+	gs.grpc = grpc.NewServer(grpc.UnaryInterceptor(grpcUnary), grpc.StreamInterceptor(grpcStream))
+	smpb.RegisterSMServer(gs.grpc, gs)
+
+	slog.Info("gRPC listen", "addr", listener.Addr().String())
+	go func() {
+		if err := gs.grpc.Serve(listener); err != nil {
+			slog.Error("gRPC serve", "err", err)
+		}
+	}()
+	return nil
+}
+
+func (gs *GrpcServer) Addr() string {
+	if gs.listener == nil {
+		return ""
+	}
+	return gs.listener.Addr().String()
+}
+
+func (gs *GrpcServer) Close() {
+	if gs.grpc != nil {
+		gs.grpc.Stop()
+	}
+}
+
+// grpcRequestID returns ctx with the ID of the call, the x-request-id
+// metadata sent by the client if it is valid or a new ID, like RequestID.
+func grpcRequestID(ctx context.Context) (context.Context, string) {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(RequestIDHeader); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	return context.WithValue(ctx, requestIDKey, id), id
+}
+
+// logGrpcError logs the errors of the server with the request ID, errors
+// caused by the request are only returned to the client.
+func logGrpcError(ctx context.Context, method string, err error) {
+	switch status.Code(err) {
+	case codes.Unknown, codes.Internal, codes.DataLoss:
+		Logger(ctx).Error("gRPC request failed", "method", method, "err", err)
+	}
+}
+
+func grpcUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, id := grpcRequestID(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, id))
+	resp, err := handler(ctx, req)
+	logGrpcError(ctx, info.FullMethod, err)
+	return resp, err
+}
+
+// requestStream is a stream whose context carries the request ID.
+type requestStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, id := grpcRequestID(ss.Context())
+	ss.SetHeader(metadata.Pairs(RequestIDHeader, id))
+	err := handler(srv, &requestStream{ServerStream: ss, ctx: ctx})
+	logGrpcError(ctx, info.FullMethod, err)
+	return err
+}
+
+func (gs *GrpcServer) writable() error {
+	if gs.server.IsReplica() {
+		return status.Errorf(codes.FailedPrecondition, "%s, write to the primary %s", ErrReadOnly.Error(), gs.server.Replication.ReplicaOf)
+	}
+	return nil
+}
+
+func (gs *GrpcServer) trie(name string) (*Trie, error) {
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	trie := gs.server.GetTrie(name)
+	if trie == nil {
+		return nil, status.Errorf(codes.NotFound, "trie `%s` not found", name)
+	}
+	return trie, nil
+}
+
+func (gs *GrpcServer) CreateTrie(ctx context.Context, req *smpb.CreateTrieRequest) (*smpb.CreateTrieResponse, error) {
+	if err := gs.writable(); err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+
+	return &smpb.CreateTrieResponse{Created: gs.server.CreateTrie(req.Name)}, nil
+}
+
+func (gs *GrpcServer) DropTrie(ctx context.Context, req *smpb.DropTrieRequest) (*smpb.DropTrieResponse, error) {
+	if err := gs.writable(); err != nil {
+		return nil, err
+	}
+
+	if !gs.server.DropTrie(req.Name) {
+		return nil, status.Errorf(codes.NotFound, "trie `%s` not found", req.Name)
+	}
+	return &smpb.DropTrieResponse{}, nil
+}
+
+func (gs *GrpcServer) Insert(ctx context.Context, req *smpb.InsertRequest) (*smpb.InsertResponse, error) {
+	if err := gs.writable(); err != nil {
+		return nil, err
+	}
+	if _, err := gs.trie(req.Name); err != nil {
+		return nil, err
+	}
+
+	for _, kv := range req.Keys {
+		var value interface{}
+		if kv.Value != nil && *kv.Value != "" {
+			value = *kv.Value
+		}
+		switch err := gs.server.InsertKey(req.Name, kv.Key, value); err {
+		case nil:
+		case ErrOutOfMemory:
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		case ErrTrieNotFound:
+			return nil, status.Error(codes.NotFound, err.Error())
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return &smpb.InsertResponse{}, nil
+}
+
+func (gs *GrpcServer) Remove(ctx context.Context, req *smpb.RemoveRequest) (*smpb.RemoveResponse, error) {
+	if err := gs.writable(); err != nil {
+		return nil, err
+	}
+
+	var removed int64
+	for _, key := range req.Keys {
+		if gs.server.RemoveKey(req.Name, key) {
+			removed++
+		}
+	}
+	return &smpb.RemoveResponse{Removed: removed}, nil
+}
+
+func (gs *GrpcServer) Get(ctx context.Context, req *smpb.GetRequest) (*smpb.GetResponse, error) {
+	trie, err := gs.trie(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &smpb.GetResponse{Results: make([]*smpb.GetResult, 0, len(req.Keys))}
+	gs.server.View(func() {
+		for _, key := range req.Keys {
+			result := &smpb.GetResult{Key: key}
+			ret, value := trie.Find([]byte(key))
+			if ret {
+				result.Found = true
+				if value != nil {
+					s := ValueString(value)
+					result.Value = &s
+				}
+			}
+			resp.Results = append(resp.Results, result)
+		}
+	})
+	return resp, nil
+}
+
+func (gs *GrpcServer) PrefixSearch(req *smpb.PrefixSearchRequest, stream smpb.SM_PrefixSearchServer) error {
+	trie, err := gs.trie(req.Name)
+	if err != nil {
+		return err
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = grpcSearchLimit
+	}
+
+	// 只在读锁内定位prefix的节点，节点不会再改变，之后边遍历边发送，客户端接收慢时不会阻塞事务
+	var it *Iterator
+	gs.server.View(func() {
+		it = trie.SeekAfter([]byte(req.Prefix))
+	})
+
+	now := Millisecond(time.Now())
+	kvs := make([]*smpb.KeyValue, 0, grpcSearchBatch)
+	for sent := int64(0); it.HasNext() && sent < limit; {
+		key, node, _ := it.Next()
+		if !node.alive(now) {
+			continue
+		}
+
+		kv := &smpb.KeyValue{Key: string(key)}
+		if node.Value != nil {
+			s := ValueString(node.Value)
+			kv.Value = &s
+		}
+		kvs = append(kvs, kv)
+		sent++
+		if len(kvs) < grpcSearchBatch && sent < limit {
+			continue
+		}
+
+		if err = stream.Context().Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		if err = stream.Send(&smpb.PrefixSearchResponse{Keys: kvs}); err != nil {
+			return err
+		}
+		kvs = make([]*smpb.KeyValue, 0, grpcSearchBatch)
+	}
+	if len(kvs) > 0 {
+		return stream.Send(&smpb.PrefixSearchResponse{Keys: kvs})
+	}
+	return nil
+}
+
+func (gs *GrpcServer) ForwardMatch(ctx context.Context, req *smpb.ForwardMatchRequest) (*smpb.ForwardMatchResponse, error) {
+	trie, err := gs.trie(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	gs.server.View(func() {
+		keys = trie.ForwardMatch(req.Text)
+	})
+	return &smpb.ForwardMatchResponse{Keys: keys}, nil
+}
+
+func (gs *GrpcServer) Match(ctx context.Context, req *smpb.MatchRequest) (*smpb.MatchResponse, error) {
+	trie, err := gs.trie(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var hits []Hit
+	gs.server.View(func() {
+		hits = trie.MatchAll(req.Text)
+	})
+	resp := &smpb.MatchResponse{Hits: make([]*smpb.Hit, 0, len(hits))}
+	for _, hit := range hits {
+		resp.Hits = append(resp.Hits, &smpb.Hit{Key: hit.Key, Start: int64(hit.Start), End: int64(hit.End)})
+	}
+	return resp, nil
+}
+
+func (gs *GrpcServer) Segment(ctx context.Context, req *smpb.SegmentRequest) (*smpb.SegmentResponse, error) {
+	trie, err := gs.trie(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	gs.server.View(func() {
+		segments = trie.Segment(req.Text)
+	})
+	return &smpb.SegmentResponse{Segments: segments}, nil
+}
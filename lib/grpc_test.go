@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"context"
+	"github.com/open-ds/sm/smpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestGrpcServer(t *testing.T) {
+	server := NewServer()
+	server.GRPC = NewGrpcServer(server, "127.0.0.1:0")
+	if err := server.GRPC.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.GRPC.Close()
+
+	conn, err := grpc.NewClient(server.GRPC.Addr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	client := smpb.NewSMClient(conn)
+	ctx := context.Background()
+
+	_, err = client.Insert(ctx, &smpb.InsertRequest{Name: "dict", Keys: []*smpb.KeyValue{{Key: "abc"}}})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	created, err := client.CreateTrie(ctx, &smpb.CreateTrieRequest{Name: "dict"})
+	if err != nil || !created.Created {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	one := "1"
+	keys := []*smpb.KeyValue{{Key: "北京"}, {Key: "北京大学", Value: &one}, {Key: "大学"}, {Key: "学生"}}
+	for i := 0; i < 600; i++ {
+		keys = append(keys, &smpb.KeyValue{Key: "key" + strconv.Itoa(i)})
+	}
+	if _, err = client.Insert(ctx, &smpb.InsertRequest{Name: "dict", Keys: keys}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	got, err := client.Get(ctx, &smpb.GetRequest{Name: "dict", Keys: []string{"北京大学", "北京", "清华"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r := got.Results; len(r) != 3 || !r[0].Found || r[0].GetValue() != "1" || !r[1].Found || r[1].Value != nil || r[2].Found {
+		t.Errorf("unexpected get results %v", got.Results)
+	}
+
+	// 600个key分成多条消息返回
+	stream, err := client.PrefixSearch(ctx, &smpb.PrefixSearchRequest{Name: "dict", Prefix: "key", Limit: 1000})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	messages, found := 0, 0
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		messages++
+		found += len(resp.Keys)
+	}
+	if found != 600 || messages < 2 {
+		t.Errorf("expected 600 keys in several messages, got %d in %d", found, messages)
+	}
+
+	// limit为0时和HTTP接口一样返回10个
+	stream, err = client.PrefixSearch(ctx, &smpb.PrefixSearchRequest{Name: "dict", Prefix: "key"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	found = 0
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		found += len(resp.Keys)
+	}
+	if found != 10 {
+		t.Errorf("expected the default limit of 10 keys, got %d", found)
+	}
+
+	forward, err := client.ForwardMatch(ctx, &smpb.ForwardMatchRequest{Name: "dict", Text: "北京大学生"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(forward.Keys, []string{"北京", "北京大学"}) {
+		t.Errorf("unexpected forward match %v", forward.Keys)
+	}
+
+	match, err := client.Match(ctx, &smpb.MatchRequest{Name: "dict", Text: "北京大学生"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var hits []string
+	for _, hit := range match.Hits {
+		hits = append(hits, hit.Key+":"+strconv.Itoa(int(hit.Start)))
+	}
+	if !reflect.DeepEqual(hits, []string{"北京:0", "北京大学:0", "大学:6", "学生:9"}) {
+		t.Errorf("unexpected match %v", hits)
+	}
+
+	segment, err := client.Segment(ctx, &smpb.SegmentRequest{Name: "dict", Text: "北京大学生活"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(segment.Segments, []string{"北京大学", "生", "活"}) {
+		t.Errorf("unexpected segments %v", segment.Segments)
+	}
+
+	removed, err := client.Remove(ctx, &smpb.RemoveRequest{Name: "dict", Keys: []string{"北京", "清华"}})
+	if err != nil || removed.Removed != 1 {
+		t.Errorf("expected 1 key removed, got %v %v", removed, err)
+	}
+
+	if _, err = client.DropTrie(ctx, &smpb.DropTrieRequest{Name: "dict"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if server.GetTrie("dict") != nil {
+		t.Error("trie not dropped")
+	}
+}
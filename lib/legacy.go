@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+)
+
+// legacyReader reads the AOF written before records were framed: RESP arrays
+// without sequence numbers and checksums. The last argument of a record is
+// not always followed by \r\n, the next record may start right after it.
+type legacyReader struct {
+	reader *bufio.Reader
+	Offset int64
+}
+
+func newLegacyReader(r io.Reader) *legacyReader {
+	return &legacyReader{reader: bufio.NewReader(r)}
+}
+
+// number parses a `<prefix><number>\r\n` line.
+func (r *legacyReader) number(prefix byte, max int64) (int64, error) {
+	line, err := r.reader.ReadSlice('\n')
+	r.Offset += int64(len(line))
+	if err == io.EOF {
+		return 0, ErrAofTruncated
+	}
+	if err != nil {
+		return 0, ErrAofCorrupt
+	}
+	if len(line) < 4 || line[0] != prefix || line[len(line)-2] != '\r' {
+		return 0, ErrAofCorrupt
+	}
+	n, err := strconv.ParseInt(string(line[1:len(line)-2]), 10, 64)
+	if err != nil || n < 0 || n > max {
+		return 0, ErrAofCorrupt
+	}
+	return n, nil
+}
+
+// Next returns the arguments of the next record, or io.EOF at the end of file.
+func (r *legacyReader) Next() ([][]byte, error) {
+	if _, err := r.reader.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+
+	argc, err := r.number('*', maxRecordArgs)
+	if err != nil {
+		return nil, err
+	}
+	args := make([][]byte, 0, min(argc, 16))
+	for i := int64(0); i < argc; i++ {
+		argLen, err := r.number('$', maxRecordArgLen)
+		if err != nil {
+			return nil, err
+		}
+		arg, err := readBulk(r.reader, argLen)
+		r.Offset += int64(len(arg))
+		if err != nil {
+			return nil, ErrAofTruncated
+		}
+		if crlf, _ := r.reader.Peek(2); string(crlf) == "\r\n" {
+			r.reader.Discard(2)
+			r.Offset += 2
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// isLegacyAOF reports whether the first record of filename is in the format
+// written before records were framed.
+func isLegacyAOF(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	if _, err = NewAofReader(file).NextRecord(); err == nil || err == io.EOF {
+		return false, nil
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	_, err = newLegacyReader(file).Next()
+	return err == nil, nil
+}
+
+// convertLegacyAOF writes the records of the legacy AOF src to dst as framed
+// records without sequence numbers, like the records of a snapshot.
+func convertLegacyAOF(src string, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := newLegacyReader(file)
+	return writeFileAtomic(dst, func(w io.Writer) error {
+		for {
+			offset := reader.Offset
+			args, err := reader.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return &AofError{File: src, Offset: offset, Err: err}
+			}
+			if _, err = w.Write(EncodeRecord(args...)); err != nil {
+				return err
+			}
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// 日志的输出格式
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// RequestIDHeader carries the ID of a request, a valid ID sent by the client
+// is kept, otherwise the server generates one.
+const RequestIDHeader = "X-Request-ID"
+
+// 客户端传入的请求ID的长度上限
+const maxRequestIDLength = 128
+
+type contextKey int
+
+const requestIDKey contextKey = 0
+
+// NewLogger creates a logger writing the records at level or above to w,
+// level is debug, info, warn or error and format text or json. Empty values
+// mean info and text.
+func NewLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("unknown log level `%s`", level)
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "", LogFormatText:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format `%s`", format)
+	}
+}
+
+// RequestID sets the ID of the request in its context and in the response
+// header, Logger adds it to every record logged for the request.
+func (server *Server) RequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// validRequestID accepts printable ASCII without spaces, so an ID cannot
+// break the lines of the text log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// RequestIDFrom returns the ID set by RequestID, empty outside a request.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Logger returns the default logger with the request ID of ctx if it has one.
+func Logger(ctx context.Context) *slog.Logger {
+	if id := RequestIDFrom(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// serverError answers 500 and logs err with the request ID, so the error can
+// be found from the X-Request-ID of the response.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	Logger(r.Context()).Error("http request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+	http.Error(w, err.Error(), 500)
+}
+
+// fatal logs err at the error level and exits, used when the server cannot
+// start.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
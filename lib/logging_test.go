@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, "warn", LogFormatJSON)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "trie", "dict")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, `"trie":"dict"`) {
+		t.Errorf("unexpected log %q", out)
+	}
+
+	if _, err = NewLogger(&buf, "verbose", ""); err == nil {
+		t.Error("expected an unknown level to fail")
+	}
+	if _, err = NewLogger(&buf, "", "xml"); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
+
+func TestServer_RequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := NewLogger(&buf, "info", LogFormatText)
+	old := slog.Default()
+	slog.SetDefault(logger)
+	defer func() {
+		// SetDefault把log包也指向了logger，恢复时需要单独还原
+		slog.SetDefault(old)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	server := NewServer()
+	server.Config.Log.Access = true
+	server.CreateTrie("dict")
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	get := func(id string) string {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/trie/dict", nil)
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		return resp.Header.Get(RequestIDHeader)
+	}
+
+	if id := get(""); len(id) != 16 {
+		t.Errorf("expected a generated request ID, got %q", id)
+	}
+	if id := get("abc-123"); id != "abc-123" {
+		t.Errorf("expected the request ID of the client, got %q", id)
+	}
+	if id := get("a b"); id == "a b" || id == "" {
+		t.Errorf("expected an invalid request ID to be replaced, got %q", id)
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "request_id=abc-123") || !strings.Contains(out, `route=/api/trie/{name}`) || !strings.Contains(out, "status=200") {
+		t.Errorf("unexpected access log %q", out)
+	}
+	// AOF和创建trie不记录命令内容
+	if strings.Contains(out, "CREATE") {
+		t.Errorf("expected no command in the log %q", out)
+	}
+}
+
+func TestServer_RequestIDErrorLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := NewLogger(&buf, "info", LogFormatText)
+	old := slog.Default()
+	slog.SetDefault(logger)
+	defer func() {
+		slog.SetDefault(old)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	server := NewServer()
+	handler := server.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverError(w, r, errors.New("disk full"))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/trie/dict", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 500 {
+		t.Errorf("expected 500, got %d", rec.Code)
+	}
+	if out := buf.String(); !strings.Contains(out, "level=ERROR") || !strings.Contains(out, "request_id=abc-123") || !strings.Contains(out, `err="disk full"`) {
+		t.Errorf("expected the error with the request ID, got %q", out)
+	}
+
+	// gRPC的请求ID来自x-request-id，只记录服务端的错误
+	buf.Reset()
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(RequestIDHeader, "grpc-1"))
+	info := &grpc.UnaryServerInfo{FullMethod: "/smpb.SM/Insert"}
+	grpcUnary(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		if id := RequestIDFrom(ctx); id != "grpc-1" {
+			t.Errorf("expected the request ID of the client, got %q", id)
+		}
+		return nil, status.Error(codes.Internal, "disk full")
+	})
+	grpcUnary(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "trie not found")
+	})
+	if out := buf.String(); !strings.Contains(out, "request_id=grpc-1") || !strings.Contains(out, "method=/smpb.SM/Insert") || strings.Contains(out, "trie not found") {
+		t.Errorf("unexpected gRPC error log %q", out)
+	}
+}
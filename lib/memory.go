@@ -0,0 +1,305 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 估算的每个节点占用的字节数，包括节点本身和它的子节点map
+const NodeSize = 160
+
+// 淘汰时每个trie抽样的key数量，每次写入最多淘汰的key数量
+const (
+	evictSamples  = 5
+	evictMaxPerOp = 1024
+)
+
+// Eviction policies, reject refuses writes over the limit and the others
+// remove keys until the usage is under the limit again.
+const (
+	EvictReject = "reject"
+	EvictLRU    = "lru"
+	EvictLFU    = "lfu"
+	// 只淘汰设置了过期时间的key，最先过期的优先
+	EvictTTL = "ttl"
+)
+
+// trie配置项中的内存限制
+const (
+	ConfigMaxMemory = "max-memory"
+	ConfigMaxNodes  = "max-nodes"
+	ConfigEviction  = "eviction"
+)
+
+var ErrOutOfMemory = errors.New("memory limit reached")
+
+// Limits caps the memory of the engine or of a trie, 0 means no limit.
+type Limits struct {
+	MaxMemory int64
+	MaxNodes  int64
+	// 为空时等同于reject
+	Eviction string
+}
+
+func (limits Limits) enabled() bool {
+	return limits.MaxMemory > 0 || limits.MaxNodes > 0
+}
+
+// exceeded reports whether the usage after a write would be over the limits.
+func (limits Limits) exceeded(memory int64, nodes int64) bool {
+	return (limits.MaxMemory > 0 && memory > limits.MaxMemory) ||
+		(limits.MaxNodes > 0 && nodes > limits.MaxNodes)
+}
+
+// Check validates the limits like CheckLimit does for the settings of a trie.
+func (limits Limits) Check() error {
+	if err := CheckLimit(ConfigMaxMemory, strconv.FormatInt(limits.MaxMemory, 10)); err != nil {
+		return err
+	}
+	if err := CheckLimit(ConfigMaxNodes, strconv.FormatInt(limits.MaxNodes, 10)); err != nil {
+		return err
+	}
+	return CheckLimit(ConfigEviction, limits.Eviction)
+}
+
+func valueSize(value interface{}) int64 {
+	if value == nil {
+		return 0
+	}
+	return int64(len(ValueString(value)))
+}
+
+// CheckLimit validates a memory setting of a trie, other settings are ignored.
+func CheckLimit(key string, value string) error {
+	switch key {
+	case ConfigMaxMemory, ConfigMaxNodes:
+		if value == "" {
+			return nil
+		}
+		if n, err := strconv.ParseInt(value, 10, 64); err != nil || n < 0 {
+			return fmt.Errorf("%s must be a non negative integer", key)
+		}
+	case ConfigEviction:
+		switch value {
+		case "", EvictReject, EvictLRU, EvictLFU, EvictTTL:
+		default:
+			return fmt.Errorf("unknown eviction policy `%s`", value)
+		}
+	}
+	return nil
+}
+
+// Memory is the approximate number of bytes used by the trie.
+func (trie *Trie) Memory() int64 {
+	return int64(atomic.LoadInt32(&trie.NumberNode))*NodeSize + atomic.LoadInt64(&trie.ValueBytes)
+}
+
+// Limits reads the memory limits from the settings of the trie.
+func (trie *Trie) Limits() Limits {
+	var limits Limits
+	if value, ok := trie.GetConfig(ConfigMaxMemory); ok {
+		limits.MaxMemory, _ = strconv.ParseInt(value, 10, 64)
+	}
+	if value, ok := trie.GetConfig(ConfigMaxNodes); ok {
+		limits.MaxNodes, _ = strconv.ParseInt(value, 10, 64)
+	}
+	limits.Eviction, _ = trie.GetConfig(ConfigEviction)
+	return limits
+}
+
+// RandomKey walks from the root to a random key, it returns nil if the trie
+// has no key. Keys are not picked uniformly, shorter keys are more likely.
+func (trie *Trie) RandomKey(rnd *rand.Rand) ([]byte, *Node) {
+	key := make([]byte, 0)
+	node := trie.Root()
+	for {
+		n := len(node.Children)
+		if node.IsKey && (n == 0 || rnd.Intn(n+1) == 0) {
+			return key, node
+		}
+		if n == 0 {
+			return nil, nil
+		}
+
+		i := rnd.Intn(n)
+		var next *Node
+		for ord, child := range node.Children {
+			if i == 0 {
+				key = append(key, ord)
+				next = child
+				break
+			}
+			i--
+		}
+		if next == nil {
+			return nil, nil
+		}
+		node = next
+	}
+}
+
+// Memory is the approximate number of bytes used by all tries.
+func (engine *Engine) Memory() (memory int64, nodes int64) {
+	for _, name := range engine.Tries() {
+		if trie := engine.GetTrie(name); trie != nil {
+			memory += trie.Memory()
+			nodes += int64(atomic.LoadInt32(&trie.NumberNode))
+		}
+	}
+	return memory, nodes
+}
+
+// Evicted returns how many keys were removed to stay under the limits.
+func (engine *Engine) Evicted() int64 {
+	return atomic.LoadInt64(&engine.evicted)
+}
+
+// insertion is a key a write is about to insert and its value.
+type insertion struct {
+	key   []byte
+	value interface{}
+}
+
+// growth is what inserting keys adds to the memory and the nodes of trie, a
+// new node shared by several keys is counted once.
+func growth(trie *Trie, keys []insertion) (memory int64, nodes int64) {
+	created := make(map[string]struct{})
+	for _, insert := range keys {
+		_, node, depth := trie.Walk(insert.key)
+		for i := depth; i < len(insert.key); i++ {
+			created[string(insert.key[:i+1])] = struct{}{}
+		}
+		memory += valueSize(insert.value)
+		if depth == len(insert.key) && node.IsKey {
+			memory -= valueSize(node.Value)
+		}
+	}
+	nodes = int64(len(created))
+	return memory + nodes*NodeSize, nodes
+}
+
+// reserveKey is reserve for a write of one key.
+func (engine *Engine) reserveKey(name string, key []byte, value interface{}, feed func(cmd []byte)) error {
+	return engine.reserve(map[string][]insertion{name: {{key: key, value: value}}}, feed)
+}
+
+// reserve is called before a write inserting keys into the tries, it evicts
+// keys while a trie or the engine would go over its limit after the write and
+// returns ErrOutOfMemory if it still would. The caller holds txMutex and
+// feed logs the REMOVE of the evicted keys.
+func (engine *Engine) reserve(keys map[string][]insertion, feed func(cmd []byte)) error {
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// 淘汰可能删除写入的key要用到的节点，每次都重新计算
+	for _, name := range names {
+		trie, inserts := engine.GetTrie(name), keys[name]
+		if trie == nil {
+			continue
+		}
+		if limits := trie.Limits(); limits.enabled() {
+			usage := func() (int64, int64) {
+				memory, nodes := growth(trie, inserts)
+				return trie.Memory() + memory, int64(atomic.LoadInt32(&trie.NumberNode)) + nodes
+			}
+			if err := engine.evict(limits, usage, map[string]*Trie{name: trie}, feed); err != nil {
+				return err
+			}
+		}
+	}
+
+	if engine.Limits.enabled() {
+		tries := make(map[string]*Trie)
+		for _, name := range engine.Tries() {
+			if trie := engine.GetTrie(name); trie != nil {
+				tries[name] = trie
+			}
+		}
+		usage := func() (int64, int64) {
+			memory, nodes := engine.Memory()
+			for name, inserts := range keys {
+				if trie := tries[name]; trie != nil {
+					m, n := growth(trie, inserts)
+					memory, nodes = memory+m, nodes+n
+				}
+			}
+			return memory, nodes
+		}
+		return engine.evict(engine.Limits, usage, tries, feed)
+	}
+	return nil
+}
+
+type evictCandidate struct {
+	name string
+	trie *Trie
+	key  []byte
+	// 越小越先淘汰
+	score int64
+}
+
+func (engine *Engine) evict(limits Limits, usage func() (int64, int64), tries map[string]*Trie, feed func(cmd []byte)) error {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; ; i++ {
+		if memory, nodes := usage(); !limits.exceeded(memory, nodes) {
+			return nil
+		}
+		if limits.Eviction == "" || limits.Eviction == EvictReject || i >= evictMaxPerOp {
+			return ErrOutOfMemory
+		}
+
+		now := Millisecond(time.Now())
+		var best *evictCandidate
+		for name, trie := range tries {
+			for _, candidate := range sampleCandidates(limits.Eviction, trie, rnd, now) {
+				if best == nil || candidate.score < best.score {
+					candidate.name = name
+					best = candidate
+				}
+			}
+		}
+		if best == nil {
+			return ErrOutOfMemory
+		}
+
+		best.trie.Remove(best.key)
+		feed(ConvertRemove(best.name, string(best.key)))
+		atomic.AddInt64(&engine.evicted, 1)
+	}
+}
+
+func sampleCandidates(policy string, trie *Trie, rnd *rand.Rand, now int64) []*evictCandidate {
+	candidates := make([]*evictCandidate, 0, evictSamples)
+	if policy == EvictTTL {
+		for key, expireAt := range trie.SampleExpires(evictSamples) {
+			candidates = append(candidates, &evictCandidate{trie: trie, key: []byte(key), score: expireAt})
+		}
+		return candidates
+	}
+
+	for i := 0; i < evictSamples; i++ {
+		key, node := trie.RandomKey(rnd)
+		if node == nil {
+			break
+		}
+		candidate := &evictCandidate{trie: trie, key: key, score: atomic.LoadInt64(&node.Access)}
+		if policy == EvictLFU {
+			// 每空闲一分钟读写次数减半，很久以前频繁访问的key也可以被淘汰
+			idle := (now - candidate.score) / int64(time.Minute/time.Millisecond)
+			if idle > 32 {
+				idle = 32
+			}
+			candidate.score = int64(atomic.LoadUint32(&node.Hits)) >> uint(idle)
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates
+}
@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrie_Memory(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert([]byte("ab"), nil)
+	trie.Insert([]byte("abcd"), "xyz")
+	if trie.NumberNode != 4 || trie.ValueBytes != 3 || trie.Memory() != 4*NodeSize+3 {
+		t.Errorf("unexpected usage %d nodes %d bytes", trie.NumberNode, trie.ValueBytes)
+	}
+
+	// 删除key之后释放不再需要的节点
+	trie.Remove([]byte("abcd"))
+	if trie.NumberNode != 2 || trie.ValueBytes != 0 {
+		t.Errorf("expected 2 nodes after remove, got %d nodes %d bytes", trie.NumberNode, trie.ValueBytes)
+	}
+	trie.Remove([]byte("ab"))
+	if trie.NumberNode != 0 || len(trie.Root().Children) != 0 {
+		t.Errorf("expected an empty trie, got %d nodes", trie.NumberNode)
+	}
+}
+
+func TestEngine_MemoryReject(t *testing.T) {
+	engine := NewEngine()
+	engine.CreateTrie("dict")
+	engine.ConfigTrie("dict", ConfigMaxNodes, "5")
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = engine.InsertKey("dict", strconv.Itoa(i), nil)
+	}
+	if err != ErrOutOfMemory || engine.GetTrie("dict").NumberNode != 5 {
+		t.Errorf("expected the trie to stop at 5 nodes, got %d %v", engine.GetTrie("dict").NumberNode, err)
+	}
+
+	// 不需要新节点的写入不受节点数量限制，删除之后可以写入新的key
+	if err = engine.InsertKey("dict", "0", "1"); err != nil {
+		t.Errorf("expected a write without new nodes to succeed, got %v", err)
+	}
+	if err = engine.InsertKey("dict", "01", nil); err != ErrOutOfMemory {
+		t.Errorf("expected write over the limit to fail, got %v", err)
+	}
+	engine.RemoveKey("dict", "0")
+	if err = engine.InsertKey("dict", "a", "1"); err != nil {
+		t.Errorf("expected write under the limit to succeed, got %v", err)
+	}
+
+	// 按写入之后的大小检查，一次写入不会超过上限
+	engine.CreateTrie("bytes")
+	engine.ConfigTrie("bytes", ConfigMaxMemory, strconv.Itoa(2*NodeSize+10))
+	if err = engine.InsertKey("bytes", "a", strings.Repeat("x", 10)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = engine.InsertKey("bytes", "b", "y"); err != ErrOutOfMemory {
+		t.Errorf("expected a write going over the limit to fail, got %v", err)
+	}
+	if err = engine.InsertKey("bytes", "a", strings.Repeat("x", NodeSize+11)); err != ErrOutOfMemory {
+		t.Errorf("expected a larger value over the limit to fail, got %v", err)
+	}
+	if memory := engine.GetTrie("bytes").Memory(); memory > 2*NodeSize+10 {
+		t.Errorf("expected the trie to stay under the limit, got %d", memory)
+	}
+	engine.DropTrie("bytes")
+
+	engine.Limits = Limits{MaxNodes: 6}
+	engine.CreateTrie("other")
+	engine.InsertKey("other", "a", nil)
+	results := engine.Batch([]BatchOp{{Op: BatchInsert, Name: "other", Key: "b"}})
+	if results[0].Status != BatchRejected {
+		t.Errorf("expected the engine limit to reject the batch, got %v", results)
+	}
+}
+
+func TestEngine_Evict(t *testing.T) {
+	engine := NewEngine()
+	engine.CreateTrie("dict")
+	engine.ConfigTrie("dict", ConfigMaxNodes, "20")
+	engine.ConfigTrie("dict", ConfigEviction, EvictLRU)
+	var removed int
+	engine.OnFeed = func(cmd []byte) {
+		if strings.Contains(string(cmd), "REMOVE") {
+			removed++
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := engine.InsertKey("dict", "key"+strconv.Itoa(i), nil); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	trie := engine.GetTrie("dict")
+	if trie.NumberNode > 20 || engine.Evicted() == 0 || int64(removed) != engine.Evicted() {
+		t.Errorf("unexpected %d nodes, %d evicted, %d logged", trie.NumberNode, engine.Evicted(), removed)
+	}
+
+	// ttl只淘汰设置了过期时间的key，最先过期的优先
+	engine.CreateTrie("ttl")
+	engine.ConfigTrie("ttl", ConfigMaxNodes, "3")
+	engine.ConfigTrie("ttl", ConfigEviction, EvictTTL)
+	engine.InsertKey("ttl", "a", nil)
+	engine.InsertKeyTTL("ttl", "b", nil, time.Hour)
+	engine.InsertKeyTTL("ttl", "c", nil, time.Minute)
+	if err := engine.InsertKey("ttl", "d", nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := engine.GetKey("ttl", "c"); err != ErrKeyNotFound {
+		t.Error("expected the key expiring first to be evicted")
+	}
+	engine.InsertKey("ttl", "e", nil)
+	if err := engine.InsertKey("ttl", "f", nil); err != ErrOutOfMemory {
+		t.Errorf("expected no key left to evict, got %v", err)
+	}
+}
+
+func TestEngine_MemoryLimitsCheck(t *testing.T) {
+	if err := (Limits{MaxMemory: 100, Eviction: EvictLRU}).Check(); err != nil {
+		t.Errorf("expected valid limits, got %v", err)
+	}
+	if err := (Limits{Eviction: "random"}).Check(); err == nil {
+		t.Error("expected an unknown policy to fail")
+	}
+	if err := (Limits{MaxNodes: -1}).Check(); err == nil {
+		t.Error("expected a negative limit to fail")
+	}
+
+	// 没有AOF时也设置内存限制
+	engine := NewEngine()
+	if err := engine.Load(Options{MaxNodes: 1}); err != nil {
+		t.Fatal(err.Error())
+	}
+	engine.CreateTrie("dict")
+	engine.InsertKey("dict", "a", nil)
+	if err := engine.InsertKey("dict", "b", nil); err != ErrOutOfMemory {
+		t.Errorf("expected the engine limit without AOF, got %v", err)
+	}
+	if err := NewEngine().Load(Options{Eviction: "random"}); err == nil {
+		t.Error("expected Load to reject an unknown policy")
+	}
+}
+
+func TestEngine_MergeMemory(t *testing.T) {
+	engine := NewEngine()
+	engine.CreateTrie("src")
+	engine.CreateTrie("dst")
+	for _, key := range []string{"ab", "ac", "ad"} {
+		engine.InsertKey("src", key, nil)
+	}
+	// 合并需要4个新节点，a只算一次
+	engine.ConfigTrie("dst", ConfigMaxNodes, "3")
+	if _, err := engine.MergeTrie("src", "dst", MergeKeepSource); err != ErrOutOfMemory {
+		t.Errorf("expected the merge over the limit to fail, got %v", err)
+	}
+	if engine.GetTrie("dst").NumberKey != 0 {
+		t.Error("expected nothing merged")
+	}
+	engine.ConfigTrie("dst", ConfigMaxNodes, "4")
+	if _, err := engine.MergeTrie("src", "dst", MergeKeepSource); err != nil {
+		t.Errorf("expected the merge to fit, got %v", err)
+	}
+}
+
+func TestServer_MemoryLimit(t *testing.T) {
+	server := NewServer()
+	server.CreateTrie("dict")
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	request := func(method string, path string, body string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := request(http.MethodPut, "/api/trie/dict", `{"eviction":"random"}`); code != 400 {
+		t.Errorf("expected 400 for an unknown policy, got %d", code)
+	}
+	if code := request(http.MethodPut, "/api/trie/dict", `{"max-nodes":"1"}`); code != 200 {
+		t.Fatalf("expected config to succeed, got %d", code)
+	}
+	request(http.MethodPut, "/api/trie/dict/a", `{"value":"1"}`)
+	if code := request(http.MethodPut, "/api/trie/dict/b", `{"value":"1"}`); code != http.StatusInsufficientStorage {
+		t.Errorf("expected 507 over the limit, got %d", code)
+	}
+}
@@ -0,0 +1,358 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 直方图的上界，单位为秒
+var (
+	httpBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	aofBuckets  = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+)
+
+// Histogram counts observations in buckets like a Prometheus histogram.
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// snapshot returns the cumulative bucket counts, the count and the sum.
+func (h *Histogram) snapshot() ([]uint64, uint64, float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+	return counts, h.count, h.sum
+}
+
+type httpSeries struct {
+	route  string
+	method string
+	code   string
+}
+
+// httpMetrics counts the requests and their latency per route, method and
+// status code.
+type httpMetrics struct {
+	mutex     sync.Mutex
+	requests  map[httpSeries]uint64
+	durations map[httpSeries]*Histogram
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{requests: make(map[httpSeries]uint64), durations: make(map[httpSeries]*Histogram)}
+}
+
+func (m *httpMetrics) observe(series httpSeries, elapsed time.Duration) {
+	m.mutex.Lock()
+	m.requests[series]++
+	h, ok := m.durations[series]
+	if !ok {
+		h = NewHistogram(httpBuckets)
+		m.durations[series] = h
+	}
+	m.mutex.Unlock()
+	h.Observe(elapsed.Seconds())
+}
+
+type httpSample struct {
+	httpSeries
+	requests uint64
+	duration *Histogram
+}
+
+// samples returns every series ordered by route, method and code.
+func (m *httpMetrics) samples() []httpSample {
+	m.mutex.Lock()
+	samples := make([]httpSample, 0, len(m.requests))
+	for series, requests := range m.requests {
+		samples = append(samples, httpSample{httpSeries: series, requests: requests, duration: m.durations[series]})
+	}
+	m.mutex.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool {
+		a, b := samples[i], samples[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	return samples
+}
+
+// responseRecorder remembers the status code and the size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(buf []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(buf)
+	rec.size += int64(n)
+	return n, err
+}
+
+// Flush lets streaming handlers like HandleDiff flush through the recorder.
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Instrument records the count and the latency of every request matched by
+// the router, labeled with the route template instead of the path so the
+// names of tries and keys do not create new series. With log.access it also
+// writes an access log record.
+func (server *Server) Instrument(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		handler.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		elapsed := time.Since(start)
+		series := httpSeries{route: route, method: r.Method, code: strconv.Itoa(rec.status)}
+		server.metrics.observe(series, elapsed)
+
+		if server.Config.Log.Access {
+			Logger(r.Context()).Info("http request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"route", route,
+				"status", rec.status,
+				"duration", elapsed,
+				"bytes_in", r.ContentLength,
+				"bytes_out", rec.size,
+				"remote", r.RemoteAddr)
+		}
+	})
+}
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (mw *metricsWriter) family(name string, kind string, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value, labels are pairs of names and values.
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprintf(mw.w, "%s%s %s\n", name, formatLabels(labels), formatValue(value))
+}
+
+func (mw *metricsWriter) metric(name string, kind string, help string, value float64) {
+	mw.family(name, kind, help)
+	mw.sample(name, value)
+}
+
+func (mw *metricsWriter) histogram(name string, h *Histogram, labels ...string) {
+	counts, count, sum := h.snapshot()
+	for i, bound := range h.buckets {
+		mw.sample(name+"_bucket", float64(counts[i]), append(labels, "le", formatValue(bound))...)
+	}
+	mw.sample(name+"_bucket", float64(count), append(labels, "le", "+Inf")...)
+	mw.sample(name+"_sum", sum, labels...)
+	mw.sample(name+"_count", float64(count), labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// HandleMetrics exposes the metrics of the server for Prometheus. While the
+// AOF is loading only sm_loading and the Go runtime are reported.
+func (server *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := &metricsWriter{w: w}
+
+	loading := 0.0
+	if server.Loading() {
+		loading = 1
+	}
+	mw.metric("sm_loading", "gauge", "Whether the server is loading its AOF.", loading)
+	writeRuntimeMetrics(mw)
+	if loading == 1 {
+		return
+	}
+
+	server.writeHTTPMetrics(mw)
+	server.writeTrieMetrics(mw)
+	mw.metric("sm_load_duration_seconds", "gauge", "Time spent loading the AOF at startup.", server.LoadDuration().Seconds())
+	if server.AOF != nil {
+		server.AOF.writeMetrics(mw)
+	}
+	if server.Replication != nil {
+		writeReplicationMetrics(mw, server.Replication.Info())
+	}
+}
+
+func (server *Server) writeHTTPMetrics(mw *metricsWriter) {
+	samples := server.metrics.samples()
+
+	mw.family("sm_http_requests_total", "counter", "HTTP requests by route, method and status code.")
+	for _, s := range samples {
+		mw.sample("sm_http_requests_total", float64(s.requests), "route", s.route, "method", s.method, "code", s.code)
+	}
+	mw.family("sm_http_request_duration_seconds", "histogram", "Latency of HTTP requests by route, method and status code.")
+	for _, s := range samples {
+		mw.histogram("sm_http_request_duration_seconds", s.duration, "route", s.route, "method", s.method, "code", s.code)
+	}
+}
+
+func (server *Server) writeTrieMetrics(mw *metricsWriter) {
+	tries := make(map[string]*Trie)
+	names := server.Tries()
+	for _, name := range names {
+		if trie := server.GetTrie(name); trie != nil {
+			tries[name] = trie
+		}
+	}
+
+	mw.family("sm_trie_keys", "gauge", "Number of keys of a trie.")
+	for _, name := range names {
+		if trie, ok := tries[name]; ok {
+			mw.sample("sm_trie_keys", float64(atomic.LoadInt32(&trie.NumberKey)), "trie", name)
+		}
+	}
+	mw.family("sm_trie_nodes", "gauge", "Number of nodes of a trie.")
+	for _, name := range names {
+		if trie, ok := tries[name]; ok {
+			mw.sample("sm_trie_nodes", float64(atomic.LoadInt32(&trie.NumberNode)), "trie", name)
+		}
+	}
+	mw.family("sm_trie_memory_bytes", "gauge", "Approximate memory used by a trie.")
+	for _, name := range names {
+		if trie, ok := tries[name]; ok {
+			mw.sample("sm_trie_memory_bytes", float64(trie.Memory()), "trie", name)
+		}
+	}
+	mw.metric("sm_evicted_keys_total", "counter", "Keys removed to stay under the memory limits.", float64(server.Evicted()))
+}
+
+func (aof *AofWriter) writeMetrics(mw *metricsWriter) {
+	aof.Mutex.RLock()
+	buffered, seq := len(aof.Buffer), aof.Seq
+	aof.Mutex.RUnlock()
+
+	mw.metric("sm_aof_buffer_bytes", "gauge", "Bytes fed to the AOF but not written yet.", float64(buffered))
+	mw.metric("sm_aof_seq", "counter", "Sequence number of the last AOF record.", float64(seq))
+	mw.family("sm_aof_flush_duration_seconds", "histogram", "Latency of writing the AOF buffer to the segment.")
+	mw.histogram("sm_aof_flush_duration_seconds", aof.flushLatency)
+	mw.family("sm_aof_fsync_duration_seconds", "histogram", "Latency of fsyncing the AOF segment.")
+	mw.histogram("sm_aof_fsync_duration_seconds", aof.syncLatency)
+	mw.metric("sm_aof_flush_errors_total", "counter", "Failed writes of the AOF buffer.", float64(atomic.LoadInt64(&aof.flushErrors)))
+	mw.metric("sm_aof_fsync_errors_total", "counter", "Failed fsyncs of the AOF segment.", float64(atomic.LoadInt64(&aof.syncErrors)))
+}
+
+func writeReplicationMetrics(mw *metricsWriter, info *ReplicationInfo) {
+	mw.metric("sm_replication_offset", "counter", "Replication offset of this server.", float64(info.Offset))
+	if info.Role != "primary" {
+		linkUp := 0.0
+		if info.LinkUp {
+			linkUp = 1
+		}
+		mw.metric("sm_replication_link_up", "gauge", "Whether the replica is connected to its primary.", linkUp)
+		// replica不知道primary当前的offset，延迟看primary上的sm_replication_replica_lag_bytes
+		if info.PrimaryOffset >= 0 {
+			mw.metric("sm_replication_primary_offset", "counter", "Offset of the primary stream applied by this replica.", float64(info.PrimaryOffset))
+		}
+		return
+	}
+
+	mw.metric("sm_replication_replicas", "gauge", "Number of connected replicas.", float64(len(info.Replicas)))
+	mw.family("sm_replication_replica_lag_bytes", "gauge", "Bytes not acknowledged by a replica.")
+	for _, replica := range info.Replicas {
+		mw.sample("sm_replication_replica_lag_bytes", float64(replica.LagBytes), "replica", replica.Addr)
+	}
+	mw.family("sm_replication_replica_lag_seconds", "gauge", "Age of the oldest write not acknowledged by a replica.")
+	for _, replica := range info.Replicas {
+		mw.sample("sm_replication_replica_lag_seconds", replica.LagSeconds, "replica", replica.Addr)
+	}
+}
+
+func writeRuntimeMetrics(mw *metricsWriter) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	mw.family("go_info", "gauge", "Version of Go the server was built with.")
+	mw.sample("go_info", 1, "version", runtime.Version())
+	mw.metric("go_goroutines", "gauge", "Number of goroutines.", float64(runtime.NumGoroutine()))
+	mw.metric("go_memstats_alloc_bytes", "gauge", "Bytes of allocated heap objects.", float64(stats.Alloc))
+	mw.metric("go_memstats_heap_inuse_bytes", "gauge", "Bytes in in-use heap spans.", float64(stats.HeapInuse))
+	mw.metric("go_memstats_heap_objects", "gauge", "Number of allocated heap objects.", float64(stats.HeapObjects))
+	mw.metric("go_memstats_sys_bytes", "gauge", "Bytes obtained from the system.", float64(stats.Sys))
+	mw.metric("go_gc_cycles_total", "counter", "Number of completed GC cycles.", float64(stats.NumGC))
+	mw.metric("go_gc_pause_seconds_total", "counter", "Total time the GC stopped the world.", float64(stats.PauseTotalNs)/1e9)
+}
@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	mw := &metricsWriter{w: &buf}
+	mw.histogram("latency", h, "route", `/a"b`)
+	expected := `latency_bucket{route="/a\"b",le="0.1"} 1
+latency_bucket{route="/a\"b",le="1"} 2
+latency_bucket{route="/a\"b",le="+Inf"} 3
+latency_sum{route="/a\"b"} 5.55
+latency_count{route="/a\"b"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected histogram\n%s", buf.String())
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	server := NewServer()
+	options := DefaultOptions(dir)
+	options.ActiveExpire = false
+	if err = server.Load(options); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Close()
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	scrape := func() string {
+		resp, err := http.Get(ts.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	server.loading = 1
+	if body := scrape(); !strings.Contains(body, "sm_loading 1") || strings.Contains(body, "sm_trie_keys") {
+		t.Errorf("expected only the loading state while loading\n%s", body)
+	}
+	server.loading = 0
+
+	server.CreateTrie("dict")
+	server.InsertKey("dict", "a", nil)
+	server.AOF.Flush()
+	http.Get(ts.URL + "/api/trie/dict")
+	http.Get(ts.URL + "/api/trie/missing")
+
+	body := scrape()
+	for _, line := range []string{
+		`sm_http_requests_total{route="/api/trie/{name}",method="GET",code="200"} 1`,
+		`sm_http_requests_total{route="/api/trie/{name}",method="GET",code="404"} 1`,
+		`sm_trie_keys{trie="dict"} 1`,
+		`sm_trie_nodes{trie="dict"} 1`,
+		`sm_aof_flush_duration_seconds_count`,
+		`sm_aof_fsync_errors_total 0`,
+		`# TYPE sm_http_request_duration_seconds histogram`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected %s in\n%s", line, body)
+		}
+	}
+}
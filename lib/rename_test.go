@@ -0,0 +1,197 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEngine_RenameSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swap")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	options := DefaultOptions(dir)
+	options.Fsync = FsyncAlways
+	engine, err := Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	engine.CreateTrie("dict")
+	engine.InsertKey("dict", "old", nil)
+	engine.CreateTrie("tmp")
+	engine.InsertKey("tmp", "new", nil)
+
+	if err = engine.RenameTrie("missing", "other"); err != ErrTrieNotFound {
+		t.Errorf("expected ErrTrieNotFound, got %v", err)
+	}
+	if err = engine.RenameTrie("tmp", "dict"); err != ErrTrieExists {
+		t.Errorf("expected ErrTrieExists, got %v", err)
+	}
+	if err = engine.SwapTrie("dict", "missing"); err != ErrTrieNotFound {
+		t.Errorf("expected ErrTrieNotFound, got %v", err)
+	}
+	if err = engine.SwapTrie("dict", "tmp"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = engine.RenameTrie("tmp", "dict_old"); err != nil {
+		t.Fatal(err.Error())
+	}
+	engine.Close()
+
+	engine, err = Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer engine.Close()
+	if names := strings.Join(engine.Tries(), ","); names != "dict,dict_old" {
+		t.Errorf("unexpected tries %s after replay", names)
+	}
+	if _, err := engine.GetKey("dict", "new"); err != nil {
+		t.Errorf("expected the swapped trie after replay, got %v", err)
+	}
+	if _, err := engine.GetKey("dict_old", "old"); err != nil {
+		t.Errorf("expected the renamed trie after replay, got %v", err)
+	}
+}
+
+// 和 -race 一起运行，读请求只能看到完整的旧trie或新trie
+func TestEngine_SwapReaders(t *testing.T) {
+	engine := NewEngine()
+	load := func(name string, value string) {
+		engine.CreateTrie(name)
+		for i := 0; i < 100; i++ {
+			engine.InsertKey(name, "key"+strconv.Itoa(i), value)
+		}
+	}
+	load("dict", "0")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			values := make(map[interface{}]int)
+			engine.view("dict", func(trie *Trie) {
+				trie.Range(func(key []byte, node *Node) bool {
+					values[node.Value]++
+					return true
+				})
+			})
+			if len(values) != 1 {
+				t.Errorf("expected one version of the trie, got %v", values)
+				return
+			}
+		}
+	}()
+
+	for i := 1; i <= 20; i++ {
+		load("tmp", strconv.Itoa(i))
+		engine.SwapTrie("dict", "tmp")
+		engine.DropTrie("tmp")
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// 快照和RENAME、SWAP并发时，重新打开后的数据和关闭前一样
+func TestEngine_SnapshotRenameSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swap")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	options := DefaultOptions(dir)
+	engine, err := Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	engine.CreateTrie("a")
+	engine.CreateTrie("c")
+	engine.InsertKey("c", "c", nil)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			engine.InsertKey("a", strconv.Itoa(i), nil)
+			engine.RenameTrie("a", "b")
+			engine.SwapTrie("b", "c")
+			engine.RenameTrie("b", "a")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err = engine.Snapshot(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	wg.Wait()
+
+	var live bytes.Buffer
+	engine.Rewrite(&live)
+	engine.Close()
+
+	engine, err = Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer engine.Close()
+	var loaded bytes.Buffer
+	engine.Rewrite(&loaded)
+	if live.String() != loaded.String() {
+		t.Errorf("expected the same data after reopening, got\n%s\nwant\n%s", loaded.String(), live.String())
+	}
+}
+
+func TestServer_RenameSwap(t *testing.T) {
+	server := NewServer()
+	server.CreateTrie("dict")
+	server.CreateTrie("tmp")
+	server.InsertKey("tmp", "a", nil)
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	post := func(path string, body string) int {
+		resp, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post("/api/trie/dict/swap", `{}`); code != 400 {
+		t.Errorf("expected 400 without with, got %d", code)
+	}
+	if code := post("/api/trie/dict/swap", `{"with":"missing"}`); code != 404 {
+		t.Errorf("expected 404 for a missing trie, got %d", code)
+	}
+	if code := post("/api/trie/dict/swap", `{"with":"tmp"}`); code != 200 {
+		t.Errorf("expected 200, got %d", code)
+	}
+	if _, err := server.GetKey("dict", "a"); err != nil {
+		t.Errorf("expected the swapped trie, got %v", err)
+	}
+	if code := post("/api/trie/tmp/rename", `{"to":"dict"}`); code != 409 {
+		t.Errorf("expected 409 for an existing trie, got %d", code)
+	}
+	if code := post("/api/trie/tmp/rename", `{"to":"old"}`); code != 200 || server.GetTrie("tmp") != nil {
+		t.Errorf("expected 200 and the old name gone, got %d", code)
+	}
+}
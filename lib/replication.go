@@ -0,0 +1,725 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 复制协议使用和AOF相同的记录格式，replica连接primary之后:
+//
+//	replica -> primary  PSYNC <replid> <offset>
+//	primary -> replica  FULLRESYNC <replid> <offset>
+//	primary -> replica  快照中的记录，以SNAPSHOT结束
+//	primary -> replica  之后的每一条写命令
+//	replica -> primary  REPLCONF ACK <offset>
+//
+// offset是primary发出的命令流的字节数。replica重连时带上上次的replid和已经执行到的offset，
+// 如果replid相同并且offset之后的命令还在backlog中，primary回复CONTINUE <replid>，
+// 然后从offset继续发送，不再发送快照。第一次连接时replid为?，offset为-1。
+// replica执行命令之后(最多每秒一次)回复ACK，primary用它计算延迟和实现WAIT。
+
+const (
+	// replica断开后重连的间隔
+	replicationRetry = time.Second
+	// replica没有新命令时发送ACK的间隔
+	replicationAckInterval = time.Second
+	// replica来不及接收时缓存的命令上限，超过后断开这个replica
+	replicaBufferLimit = 64 * 1024 * 1024
+	// 默认的backlog大小
+	defaultBacklogSize = 1024 * 1024
+)
+
+var ErrReadOnly = errors.New("readonly replica")
+
+type Replication struct {
+	server *Server
+	// primary监听replica连接的地址
+	Listen string
+	// 不为空时作为这个地址的replica运行
+	ReplicaOf string
+	// 保留最近多少字节的命令用于部分重同步
+	BacklogSize int
+
+	// 这个节点的命令流的ID和offset，每次启动生成新的ID
+	ID     string
+	Offset int64
+
+	// replica正在复制的primary的命令流和已经执行到的offset
+	PrimaryID     string
+	PrimaryOffset int64
+
+	mutex    sync.Mutex
+	replicas map[*replica]struct{}
+	backlog  *backlog
+	listener net.Listener
+	conn     net.Conn
+	linkUp   bool
+	closed   bool
+	// replica确认了新的offset时通知WAIT
+	acked *sync.Cond
+	// 最近一次全量同步的时间，primary上是发送的时间，replica上是加载完成的时间
+	lastFullSync time.Time
+	// replica上连接断开的时间
+	linkDownSince time.Time
+}
+
+// replica is a connected replica seen from the primary.
+type replica struct {
+	conn   net.Conn
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	buffer []byte
+	closed bool
+
+	// 以下字段由Replication.mutex保护
+	connected time.Time
+	// replica确认执行到的offset，全量同步完成之前是-1
+	ack     int64
+	ackTime time.Time
+	// replica从这个时间开始落后于primary
+	behindSince time.Time
+}
+
+func NewReplication(server *Server, listen string, replicaOf string) *Replication {
+	r := &Replication{
+		server:        server,
+		Listen:        listen,
+		ReplicaOf:     replicaOf,
+		BacklogSize:   defaultBacklogSize,
+		ID:            newReplicationID(),
+		PrimaryOffset: -1,
+		replicas:      make(map[*replica]struct{}),
+		linkDownSince: time.Now(),
+	}
+	r.acked = sync.NewCond(&r.mutex)
+	return r
+}
+
+func newReplicationID() string {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (r *Replication) IsReplica() bool {
+	return r.ReplicaOf != ""
+}
+
+// Start listens for replicas and, on a replica, starts following the primary.
+func (r *Replication) Start() error {
+	if r.Listen != "" {
+		listener, err := net.Listen("tcp", r.Listen)
+		if err != nil {
+			return err
+		}
+		r.mutex.Lock()
+		r.backlog = newBacklog(r.BacklogSize, r.Offset)
+		r.mutex.Unlock()
+		r.listener = listener
+		slog.Info("replication listen", "addr", listener.Addr().String())
+		go r.accept()
+	}
+
+	if r.IsReplica() {
+		go r.follow()
+	}
+	return nil
+}
+
+// Addr returns the address replicas connect to.
+func (r *Replication) Addr() string {
+	if r.listener == nil {
+		return ""
+	}
+	return r.listener.Addr().String()
+}
+
+func (r *Replication) Close() {
+	r.mutex.Lock()
+	r.closed = true
+	r.acked.Broadcast()
+	replicas := r.replicas
+	r.replicas = make(map[*replica]struct{})
+	conn := r.conn
+	r.mutex.Unlock()
+
+	if r.listener != nil {
+		r.listener.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	for replica := range replicas {
+		replica.close()
+	}
+}
+
+// Feed sends a write command to every connected replica and keeps it in the
+// backlog.
+func (r *Replication) Feed(cmd []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	for replica := range r.replicas {
+		if replica.ack == r.Offset {
+			replica.behindSince = now
+		}
+	}
+
+	r.Offset += int64(len(cmd))
+	if r.backlog != nil {
+		r.backlog.write(cmd)
+	}
+	for replica := range r.replicas {
+		if !replica.feed(cmd) {
+			slog.Warn("replication replica can't keep up, disconnect", "replica", replica.conn.RemoteAddr().String())
+			delete(r.replicas, replica)
+			replica.close()
+		}
+	}
+}
+
+func (r *Replication) accept() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			r.mutex.Lock()
+			closed := r.closed
+			r.mutex.Unlock()
+			if !closed {
+				slog.Error("replication accept", "err", err)
+			}
+			return
+		}
+		go r.serveReplica(conn)
+	}
+}
+
+func (r *Replication) serveReplica(conn net.Conn) {
+	defer conn.Close()
+	addr := conn.RemoteAddr().String()
+
+	reader := NewAofReader(conn)
+	args, err := reader.Next()
+	if err != nil || len(args) == 0 {
+		slog.Warn("replication bad handshake", "replica", addr)
+		return
+	}
+	id, offset := "?", int64(-1)
+	switch strings.ToUpper(string(args[0])) {
+	case "SYNC":
+	case "PSYNC":
+		if len(args) != 3 {
+			slog.Warn("replication bad handshake", "replica", addr)
+			return
+		}
+		id = string(args[1])
+		if offset, err = strconv.ParseInt(string(args[2]), 10, 64); err != nil {
+			slog.Warn("replication bad handshake", "replica", addr)
+			return
+		}
+	default:
+		slog.Warn("replication bad handshake", "replica", addr)
+		return
+	}
+
+	// 注册和冻结快照的数据在同一个暂停写入的区间里，快照之后的写命令缓存在replica中，
+	// 快照发送完之后再发送，每条命令只出现在其中一边
+	replica := &replica{conn: conn, connected: time.Now(), ack: -1}
+	replica.cond = sync.NewCond(&replica.mutex)
+
+	var reply []byte
+	full := true
+	write, err := r.server.Capture(func() error {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.closed {
+			return errors.New("replication closed")
+		}
+		if id == r.ID && r.backlog != nil {
+			if buf, ok := r.backlog.since(offset); ok {
+				full = false
+				replica.buffer = buf
+				replica.ack = offset
+				replica.ackTime = time.Now()
+				if offset < r.Offset {
+					replica.behindSince = replica.ackTime
+				}
+				reply = EncodeRecord([]byte("CONTINUE"), []byte(r.ID))
+			}
+		}
+		if full {
+			reply = EncodeRecord([]byte("FULLRESYNC"), []byte(r.ID), []byte(strconv.FormatInt(r.Offset, 10)))
+			r.lastFullSync = time.Now()
+			replica.behindSince = r.lastFullSync
+		}
+		r.replicas[replica] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		r.mutex.Lock()
+		delete(r.replicas, replica)
+		r.mutex.Unlock()
+		replica.close()
+	}()
+
+	writer := bufio.NewWriter(conn)
+	if _, err = writer.Write(reply); err != nil {
+		return
+	}
+	if full {
+		slog.Info("replication full sync to replica", "replica", addr)
+		if err = write(writer); err != nil {
+			return
+		}
+		if _, err = writer.Write(ConvertSnapshot()); err != nil {
+			return
+		}
+	} else {
+		slog.Info("replication partial sync to replica", "replica", addr, "offset", offset)
+	}
+	if err = writer.Flush(); err != nil {
+		return
+	}
+
+	// replica只发送ACK，读到错误说明连接已经断开
+	go func() {
+		defer replica.close()
+		for {
+			args, err := reader.Next()
+			if err != nil {
+				return
+			}
+			if len(args) != 3 || strings.ToUpper(string(args[0])) != "REPLCONF" || strings.ToUpper(string(args[1])) != "ACK" {
+				slog.Warn("replication unexpected command", "replica", addr, "args", len(args))
+				return
+			}
+			offset, err := strconv.ParseInt(string(args[2]), 10, 64)
+			if err != nil {
+				slog.Warn("replication bad ack", "replica", addr, "offset", string(args[2]))
+				return
+			}
+			r.ack(replica, offset)
+		}
+	}()
+
+	for {
+		buf, ok := replica.wait()
+		if !ok {
+			slog.Info("replication replica disconnected", "replica", addr)
+			return
+		}
+		if _, err = conn.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+// ack records the offset a replica has applied.
+func (r *Replication) ack(replica *replica, offset int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	replica.ackTime = time.Now()
+	if offset > replica.ack {
+		replica.ack = offset
+		r.acked.Broadcast()
+	}
+	if replica.ack >= r.Offset {
+		replica.behindSince = time.Time{}
+	}
+}
+
+// Wait blocks until n replicas acknowledged every command sent so far or the
+// timeout expires, it returns the number of replicas that did.
+func (r *Replication) Wait(n int, timeout time.Duration) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	offset := r.Offset
+	expired := false
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			r.mutex.Lock()
+			expired = true
+			r.acked.Broadcast()
+			r.mutex.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	for {
+		acked := 0
+		for replica := range r.replicas {
+			if replica.ack >= offset {
+				acked++
+			}
+		}
+		if acked >= n || expired || r.closed {
+			return acked
+		}
+		r.acked.Wait()
+	}
+}
+
+// feed buffers cmd, it returns false if the buffer is over its limit.
+func (replica *replica) feed(cmd []byte) bool {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+
+	if len(replica.buffer)+len(cmd) > replicaBufferLimit {
+		return false
+	}
+	replica.buffer = append(replica.buffer, cmd...)
+	replica.cond.Signal()
+	return true
+}
+
+// wait blocks until there are buffered commands and takes them.
+func (replica *replica) wait() ([]byte, bool) {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+
+	for len(replica.buffer) == 0 && !replica.closed {
+		replica.cond.Wait()
+	}
+	if replica.closed {
+		return nil, false
+	}
+
+	buf := replica.buffer
+	replica.buffer = nil
+	return buf, true
+}
+
+func (replica *replica) close() {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+
+	if !replica.closed {
+		replica.closed = true
+		replica.conn.Close()
+		replica.cond.Broadcast()
+	}
+}
+
+// LinkUp reports whether a replica is connected to its primary and in sync.
+func (r *Replication) LinkUp() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.linkUp
+}
+
+func (r *Replication) follow() {
+	for {
+		err := r.sync()
+
+		r.mutex.Lock()
+		if r.linkUp {
+			r.linkDownSince = time.Now()
+		}
+		r.linkUp = false
+		r.conn = nil
+		closed := r.closed
+		r.mutex.Unlock()
+
+		if closed {
+			return
+		}
+		if err != nil {
+			slog.Warn("replication link down", "primary", r.ReplicaOf, "err", err)
+		}
+		time.Sleep(replicationRetry)
+	}
+}
+
+// sync connects to the primary, resumes from the last offset or loads its
+// snapshot, and applies the command stream until the connection breaks.
+func (r *Replication) sync() error {
+	conn, err := net.DialTimeout("tcp", r.ReplicaOf, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.conn = conn
+	id, offset := r.PrimaryID, r.PrimaryOffset
+	r.mutex.Unlock()
+
+	if id == "" {
+		id, offset = "?", -1
+	}
+	if _, err = conn.Write(EncodeRecord([]byte("PSYNC"), []byte(id), []byte(strconv.FormatInt(offset, 10)))); err != nil {
+		return err
+	}
+
+	reader := NewAofReader(conn)
+	args, err := reader.Next()
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(args) == 3 && strings.ToUpper(string(args[0])) == "FULLRESYNC":
+		if offset, err = strconv.ParseInt(string(args[2]), 10, 64); err != nil {
+			return fmt.Errorf("unexpected reply %q to PSYNC", args)
+		}
+		if err = r.fullSync(reader); err != nil {
+			return err
+		}
+	case len(args) == 2 && strings.ToUpper(string(args[0])) == "CONTINUE":
+		slog.Info("replication partial sync from primary", "primary", r.ReplicaOf, "offset", offset)
+	default:
+		return fmt.Errorf("unexpected reply %q to PSYNC", args)
+	}
+
+	r.mutex.Lock()
+	r.PrimaryID = string(args[1])
+	r.PrimaryOffset = offset
+	r.linkUp = true
+	r.mutex.Unlock()
+
+	acks := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go r.sendAcks(conn, acks, done)
+
+	replayer := NewReplayer(r.server.Engine)
+	replayer.Feed = true
+	start := reader.Offset
+	for {
+		args, err = reader.Next()
+		if err != nil {
+			return err
+		}
+		if err = replayer.Apply(args); err != nil {
+			return err
+		}
+		// 事务执行之后才更新偏移量，断线后从MULTI开始重新同步
+		if replayer.Pending() {
+			continue
+		}
+
+		r.mutex.Lock()
+		r.PrimaryOffset += reader.Offset - start
+		r.mutex.Unlock()
+		start = reader.Offset
+
+		select {
+		case acks <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sendAcks reports the applied offset to the primary after new commands
+// were applied and once a second, until done is closed.
+func (r *Replication) sendAcks(conn net.Conn, acks chan struct{}, done chan struct{}) {
+	ticker := time.NewTicker(replicationAckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-acks:
+		case <-ticker.C:
+		}
+
+		r.mutex.Lock()
+		offset := r.PrimaryOffset
+		r.mutex.Unlock()
+
+		if _, err := conn.Write(EncodeRecord([]byte("REPLCONF"), []byte("ACK"), []byte(strconv.FormatInt(offset, 10)))); err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// fullSync loads the snapshot sent by the primary.
+func (r *Replication) fullSync(reader *AofReader) error {
+	// 快照先加载到新的DB中，加载完成后整体替换，读请求不会看到一半的数据
+	slog.Info("replication full sync from primary", "primary", r.ReplicaOf)
+	start := time.Now()
+	loading := NewEngine()
+	replayer := NewReplayer(loading)
+	for {
+		args, err := reader.Next()
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 && strings.ToUpper(string(args[0])) == "SNAPSHOT" {
+			break
+		}
+		if err = replayer.Apply(args); err != nil {
+			return err
+		}
+	}
+	r.server.ReplaceDB(loading.DB)
+	r.mutex.Lock()
+	r.lastFullSync = time.Now()
+	r.mutex.Unlock()
+	slog.Info("replication full sync done", "duration", time.Since(start), "tries", len(loading.DB))
+
+	// 本地AOF中的旧数据已经失效，用新数据生成快照覆盖
+	if r.server.AOF != nil {
+		if err := r.server.AOF.Snapshot(); err != nil {
+			slog.Error("AOF snapshot after full sync", "err", err)
+		}
+	}
+	return nil
+}
+
+// backlog keeps the last bytes of the command stream in a ring buffer.
+type backlog struct {
+	buf []byte
+	// 命令流中第一个和最后一个字节之后的offset
+	start int64
+	end   int64
+}
+
+func newBacklog(size int, offset int64) *backlog {
+	if size <= 0 {
+		size = defaultBacklogSize
+	}
+	return &backlog{buf: make([]byte, size), start: offset, end: offset}
+}
+
+func (b *backlog) write(p []byte) {
+	size := int64(len(b.buf))
+	if int64(len(p)) > size {
+		b.end += int64(len(p)) - size
+		p = p[int64(len(p))-size:]
+	}
+	for len(p) > 0 {
+		n := copy(b.buf[b.end%size:], p)
+		p = p[n:]
+		b.end += int64(n)
+	}
+	if b.end-b.start > size {
+		b.start = b.end - size
+	}
+}
+
+// since returns a copy of the stream after offset, or false if it was
+// overwritten already.
+func (b *backlog) since(offset int64) ([]byte, bool) {
+	if offset < b.start || offset > b.end {
+		return nil, false
+	}
+
+	size := int64(len(b.buf))
+	buf := make([]byte, 0, b.end-offset)
+	for offset < b.end {
+		i := offset % size
+		j := size
+		if b.end-offset < size-i {
+			j = i + b.end - offset
+		}
+		buf = append(buf, b.buf[i:j]...)
+		offset += j - i
+	}
+	return buf, true
+}
+
+type ReplicaInfo struct {
+	Addr      string    `json:"addr"`
+	Connected time.Time `json:"connected"`
+	// 确认的offset，全量同步完成之前是-1
+	Ack     int64     `json:"ack_offset"`
+	AckTime time.Time `json:"ack_time"`
+	// 还没有确认的字节数和最早一条没有确认的命令的时间
+	LagBytes   int64   `json:"lag_bytes"`
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+type ReplicationInfo struct {
+	Role         string     `json:"role"`
+	ID           string     `json:"replid"`
+	Offset       int64      `json:"offset"`
+	LastFullSync *time.Time `json:"last_full_sync"`
+
+	// primary
+	Replicas     []ReplicaInfo `json:"replicas,omitempty"`
+	BacklogSize  int           `json:"backlog_size,omitempty"`
+	BacklogStart int64         `json:"backlog_start,omitempty"`
+
+	// replica
+	Primary       string  `json:"primary,omitempty"`
+	LinkUp        bool    `json:"link_up,omitempty"`
+	LinkDown      float64 `json:"link_down_seconds,omitempty"`
+	PrimaryID     string  `json:"primary_replid,omitempty"`
+	PrimaryOffset int64   `json:"primary_offset,omitempty"`
+}
+
+// Info reports the role, the replicas and their lag.
+func (r *Replication) Info() *ReplicationInfo {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	info := &ReplicationInfo{Role: "primary", ID: r.ID, Offset: r.Offset}
+	if !r.lastFullSync.IsZero() {
+		lastFullSync := r.lastFullSync
+		info.LastFullSync = &lastFullSync
+	}
+
+	if r.backlog != nil {
+		info.BacklogSize = len(r.backlog.buf)
+		info.BacklogStart = r.backlog.start
+	}
+	info.Replicas = make([]ReplicaInfo, 0, len(r.replicas))
+	for replica := range r.replicas {
+		ri := ReplicaInfo{
+			Addr:      replica.conn.RemoteAddr().String(),
+			Connected: replica.connected,
+			Ack:       replica.ack,
+			AckTime:   replica.ackTime,
+			LagBytes:  r.Offset - replica.ack,
+		}
+		if replica.ack < 0 {
+			ri.LagBytes = r.Offset
+		}
+		if !replica.behindSince.IsZero() {
+			ri.LagSeconds = now.Sub(replica.behindSince).Seconds()
+		}
+		info.Replicas = append(info.Replicas, ri)
+	}
+	sort.Slice(info.Replicas, func(i, j int) bool {
+		return info.Replicas[i].Addr < info.Replicas[j].Addr
+	})
+
+	if r.IsReplica() {
+		info.Role = "replica"
+		info.Primary = r.ReplicaOf
+		info.LinkUp = r.linkUp
+		if !r.linkUp {
+			info.LinkDown = now.Sub(r.linkDownSince).Seconds()
+		}
+		info.PrimaryID = r.PrimaryID
+		info.PrimaryOffset = r.PrimaryOffset
+	}
+	return info
+}
@@ -0,0 +1,330 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls fn until it returns true or a few seconds passed.
+func waitFor(t *testing.T, what string, fn func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasKey(server *Server, name string, key string, value interface{}) bool {
+	trie := server.GetTrie(name)
+	if trie == nil {
+		return false
+	}
+	ret, v := trie.Find([]byte(key))
+	return ret && v == value
+}
+
+func TestReplication_Sync(t *testing.T) {
+	primary := NewServer()
+	primary.Replication = NewReplication(primary, "127.0.0.1:0", "")
+	if err := primary.Replication.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer primary.Replication.Close()
+
+	primary.CreateTrie("test")
+	primary.Insert("test", []byte("abc"), "1")
+	primary.CreateTrie("empty")
+
+	replica := NewServer()
+	replica.Insert("stale", []byte("abc"), "1")
+	replica.Replication = NewReplication(replica, "", primary.Replication.Addr())
+	if err := replica.Replication.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer replica.Replication.Close()
+
+	waitFor(t, "full sync", replica.Replication.LinkUp)
+	if !hasKey(replica, "test", "abc", "1") || replica.GetTrie("empty") == nil {
+		t.Fatal("snapshot not loaded")
+	}
+	if replica.GetTrie("stale") != nil {
+		t.Error("stale trie survived full sync")
+	}
+
+	primary.Insert("test", []byte("abd"), "2")
+	primary.Feed(ConvertInsert("test", "abd", "2"))
+	primary.Remove("test", []byte("abc"))
+	primary.Feed(ConvertRemove("test", "abc"))
+
+	waitFor(t, "command stream", func() bool {
+		return hasKey(replica, "test", "abd", "2") && !hasKey(replica, "test", "abc", "1")
+	})
+
+	if _, err := primary.Transaction([]BatchOp{
+		{Op: BatchInsert, Name: "test", Key: "tx1"},
+		{Op: BatchInsert, Name: "empty", Key: "tx2"},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	waitFor(t, "transaction", func() bool {
+		return hasKey(replica, "test", "tx1", nil) && hasKey(replica, "empty", "tx2", nil)
+	})
+
+	// replica断开后重新同步
+	disconnect(replica)
+	primary.Insert("test", []byte("abe"), "3")
+	primary.Feed(ConvertInsert("test", "abe", "3"))
+
+	waitFor(t, "resync", func() bool {
+		return hasKey(replica, "test", "abe", "3")
+	})
+}
+
+// 全量同步和CLONE、DROP并发时，replica不会重复执行快照里已经有的命令
+func TestReplication_FullSyncConcurrentWrites(t *testing.T) {
+	primary := NewServer()
+	primary.Replication = NewReplication(primary, "127.0.0.1:0", "")
+	if err := primary.Replication.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer primary.Replication.Close()
+	primary.CreateTrie("dict")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			primary.InsertKey("dict", strconv.Itoa(i), nil)
+			primary.CloneTrie("dict", "copy")
+			primary.DropTrie("copy")
+		}
+	}()
+
+	replica := NewServer()
+	replica.Replication = NewReplication(replica, "", primary.Replication.Addr())
+	down := replica.Replication.linkDownSince
+	if err := replica.Replication.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer replica.Replication.Close()
+
+	waitFor(t, "full sync", replica.Replication.LinkUp)
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	var want bytes.Buffer
+	primary.Rewrite(&want)
+	waitFor(t, "command stream", func() bool {
+		var got bytes.Buffer
+		replica.Rewrite(&got)
+		return got.String() == want.String()
+	})
+	replica.Replication.mutex.Lock()
+	defer replica.Replication.mutex.Unlock()
+	if replica.Replication.linkDownSince != down {
+		t.Error("expected the link to stay up")
+	}
+}
+
+// disconnect drops the link of a replica, it reconnects after a second.
+func disconnect(replica *Server) {
+	replica.Replication.mutex.Lock()
+	replica.Replication.conn.Close()
+	replica.Replication.mutex.Unlock()
+}
+
+func TestReplication_PartialResync(t *testing.T) {
+	primary := NewServer()
+	primary.Replication = NewReplication(primary, "127.0.0.1:0", "")
+	primary.Replication.BacklogSize = 128
+	if err := primary.Replication.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer primary.Replication.Close()
+
+	primary.Insert("test", []byte("abc"), "1")
+
+	replica := NewServer()
+	replica.Replication = NewReplication(replica, "", primary.Replication.Addr())
+	if err := replica.Replication.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer replica.Replication.Close()
+	waitFor(t, "full sync", replica.Replication.LinkUp)
+
+	// 只存在于replica上的key，全量同步后会消失
+	replica.Insert("local", []byte("abc"), "1")
+
+	disconnect(replica)
+	primary.Insert("test", []byte("abd"), "2")
+	primary.Feed(ConvertInsert("test", "abd", "2"))
+
+	waitFor(t, "partial sync", func() bool {
+		return hasKey(replica, "test", "abd", "2")
+	})
+	if replica.GetTrie("local") == nil {
+		t.Fatal("expected partial resync, got a full sync")
+	}
+	if offset, primaryOffset := replica.Replication.Info().PrimaryOffset, primary.Replication.Info().Offset; offset != primaryOffset {
+		t.Errorf("expected offset %d, got %d", primaryOffset, offset)
+	}
+
+	// 断开期间的命令超过了backlog，只能全量同步
+	disconnect(replica)
+	for _, key := range []string{"b", "bc", "bcd", "bcde"} {
+		primary.Insert("test", []byte(key), key)
+		primary.Feed(ConvertInsert("test", key, key))
+	}
+
+	waitFor(t, "full sync", func() bool {
+		return hasKey(replica, "test", "bcde", "bcde")
+	})
+	if replica.GetTrie("local") != nil {
+		t.Error("expected a full sync once the backlog was overwritten")
+	}
+}
+
+func TestReplication_InfoWait(t *testing.T) {
+	primary := NewServer()
+	primary.Replication = NewReplication(primary, "127.0.0.1:0", "")
+	if err := primary.Replication.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer primary.Replication.Close()
+
+	if acked := primary.Replication.Wait(1, 50*time.Millisecond); acked != 0 {
+		t.Fatalf("expected no replica to ack, got %d", acked)
+	}
+
+	replica := NewServer()
+	replica.Replication = NewReplication(replica, "", primary.Replication.Addr())
+	if err := replica.Replication.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer replica.Replication.Close()
+	waitFor(t, "full sync", replica.Replication.LinkUp)
+
+	primary.Insert("test", []byte("abc"), "1")
+	primary.Feed(ConvertInsert("test", "abc", "1"))
+	if acked := primary.Replication.Wait(1, 5*time.Second); acked != 1 {
+		t.Fatalf("expected 1 replica to ack, got %d", acked)
+	}
+	if !hasKey(replica, "test", "abc", "1") {
+		t.Error("write not applied after the replica acked it")
+	}
+
+	info := primary.Replication.Info()
+	if info.Role != "primary" || len(info.Replicas) != 1 || info.LastFullSync == nil {
+		t.Fatalf("unexpected primary info %+v", info)
+	}
+	if ri := info.Replicas[0]; ri.Ack != info.Offset || ri.LagBytes != 0 || ri.LagSeconds != 0 {
+		t.Errorf("unexpected replica info %+v", ri)
+	}
+
+	info = replica.Replication.Info()
+	if info.Role != "replica" || !info.LinkUp || info.PrimaryOffset != primary.Replication.Info().Offset {
+		t.Errorf("unexpected replica info %+v", info)
+	}
+
+	var metrics bytes.Buffer
+	info = primary.Replication.Info()
+	writeReplicationMetrics(&metricsWriter{w: &metrics}, info)
+	if line := "sm_replication_replica_lag_bytes{replica=\"" + info.Replicas[0].Addr + "\"} 0\n"; !strings.Contains(metrics.String(), line) {
+		t.Errorf("expected %q in\n%s", line, metrics.String())
+	}
+	metrics.Reset()
+	writeReplicationMetrics(&metricsWriter{w: &metrics}, replica.Replication.Info())
+	if line := "sm_replication_primary_offset " + strconv.FormatInt(primary.Replication.Info().Offset, 10) + "\n"; !strings.Contains(metrics.String(), line) {
+		t.Errorf("expected %q in\n%s", line, metrics.String())
+	}
+	if strings.Contains(metrics.String(), "sm_replication_lag_bytes") {
+		t.Errorf("unexpected replica lag in\n%s", metrics.String())
+	}
+	// 全量同步之前没有primary的offset
+	metrics.Reset()
+	writeReplicationMetrics(&metricsWriter{w: &metrics}, &ReplicationInfo{Role: "replica", PrimaryOffset: -1})
+	if strings.Contains(metrics.String(), "sm_replication_primary_offset") {
+		t.Errorf("unexpected primary offset before the first sync\n%s", metrics.String())
+	}
+
+	ts := httptest.NewServer(primary.Router())
+	defer ts.Close()
+	resp, err := http.Post(ts.URL+"/api/replication/wait", "application/json", strings.NewReader(`{"replicas":1,"timeout":5000}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	var waitResponse struct {
+		Replicas int `json:"replicas"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&waitResponse); err != nil {
+		t.Fatal(err.Error())
+	}
+	if waitResponse.Replicas != 1 {
+		t.Errorf("expected 1 replica to ack, got %d", waitResponse.Replicas)
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	b := newBacklog(8, 100)
+	b.write([]byte("abcde"))
+	if buf, ok := b.since(102); !ok || string(buf) != "cde" {
+		t.Errorf("unexpected backlog %q", buf)
+	}
+
+	b.write([]byte("fghij"))
+	if _, ok := b.since(101); ok {
+		t.Error("expected offset 101 to be overwritten")
+	}
+	if buf, ok := b.since(102); !ok || string(buf) != "cdefghij" {
+		t.Errorf("unexpected backlog %q", buf)
+	}
+	if buf, ok := b.since(110); !ok || len(buf) != 0 {
+		t.Errorf("unexpected backlog %q", buf)
+	}
+	if _, ok := b.since(111); ok {
+		t.Error("expected offset past the end to be rejected")
+	}
+
+	b.write([]byte("0123456789"))
+	if buf, ok := b.since(112); !ok || string(buf) != "23456789" {
+		t.Errorf("unexpected backlog %q", buf)
+	}
+}
+
+func TestReplication_ReadOnly(t *testing.T) {
+	replica := NewServer()
+	replica.Replication = NewReplication(replica, "", "127.0.0.1:1")
+
+	ts := httptest.NewServer(replica.Router())
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/api/trie", "application/json", strings.NewReader(`{"name":"test"}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 403 {
+		t.Errorf("expected write on replica to be rejected, got %d", resp.StatusCode)
+	}
+	if replica.GetTrie("test") != nil {
+		t.Error("trie created on replica")
+	}
+}
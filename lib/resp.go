@@ -0,0 +1,561 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// RESP监听器兼容Redis协议，可以直接使用Redis客户端和redis-benchmark:
+//
+//	TCREATE name               创建trie，返回1，已存在时返回0
+//	TDROP name                 删除trie，返回1，不存在时返回0
+//	TINSERT name key [value]   插入key
+//	TGET name key              返回key的value，key不存在时返回nil
+//	TDEL name key [key ...]    删除key，返回删除的数量
+//	TPREFIX name prefix [limit] 返回以prefix开头的key，默认最多10个
+//	TMATCH name text           返回text的前缀中所有的key
+//	MULTI / EXEC / DISCARD     MULTI之后的TINSERT和TDEL在EXEC时作为一个事务执行
+//	PING [message]
+//	INFO
+//
+// 和AOF不同，客户端发送的命令没有校验和。也支持telnet使用的inline命令。
+// inline命令受读缓冲区大小限制，每个参数最多respMaxBulkSize字节。
+
+const (
+	respMaxArgs     = 1024 * 1024
+	respMaxBulkSize = 64 * 1024 * 1024
+)
+
+var ErrRespProtocol = errors.New("protocol error")
+
+// RespReader reads the commands sent by Redis clients.
+type RespReader struct {
+	reader *bufio.Reader
+}
+
+func NewRespReader(r io.Reader) *RespReader {
+	return &RespReader{reader: bufio.NewReader(r)}
+}
+
+// Buffered reports whether more pipelined commands can be read without blocking.
+func (r *RespReader) Buffered() bool {
+	return r.reader.Buffered() > 0
+}
+
+func (r *RespReader) readLine() ([]byte, error) {
+	line, err := r.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, ErrRespProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+func (r *RespReader) readHeader(prefix byte, max int64) (int64, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 2 || line[0] != prefix {
+		return 0, ErrRespProtocol
+	}
+	n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || n < 0 || n > max {
+		return 0, ErrRespProtocol
+	}
+	return n, nil
+}
+
+// ReadCommand reads the next command, it returns an empty command for an
+// empty inline line.
+func (r *RespReader) ReadCommand() ([][]byte, error) {
+	first, err := r.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] != '*' {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Fields(line), nil
+	}
+
+	argc, err := r.readHeader('*', respMaxArgs)
+	if err != nil {
+		return nil, err
+	}
+	// 参数个数和长度来自客户端，按实际收到的数据分配内存
+	args := make([][]byte, 0, min(argc, 16))
+	for i := int64(0); i < argc; i++ {
+		size, err := r.readHeader('$', respMaxBulkSize)
+		if err != nil {
+			return nil, err
+		}
+		arg, err := readBulk(r.reader, size+2)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return nil, ErrRespProtocol
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// RespWriter writes replies, the caller flushes the underlying writer.
+type RespWriter struct {
+	*bufio.Writer
+}
+
+func (w RespWriter) Simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w RespWriter) Error(s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func (w RespWriter) Int(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w RespWriter) Bulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w RespWriter) Nil() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w RespWriter) Array(values []string) {
+	w.WriteString("*" + strconv.Itoa(len(values)) + "\r\n")
+	for _, value := range values {
+		w.Bulk(value)
+	}
+}
+
+type RespServer struct {
+	server *Server
+	Listen string
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+func NewRespServer(server *Server, listen string) *RespServer {
+	return &RespServer{
+		server: server,
+		Listen: listen,
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+func (rs *RespServer) Start() error {
+	listener, err := net.Listen("tcp", rs.Listen)
+	if err != nil {
+		return err
+	}
+	rs.listener = listener
+	slog.Info("RESP listen", "addr", listener.Addr().String())
+	go rs.accept()
+	return nil
+}
+
+func (rs *RespServer) Addr() string {
+	if rs.listener == nil {
+		return ""
+	}
+	return rs.listener.Addr().String()
+}
+
+func (rs *RespServer) Close() {
+	rs.mutex.Lock()
+	rs.closed = true
+	conns := rs.conns
+	rs.conns = make(map[net.Conn]struct{})
+	rs.mutex.Unlock()
+
+	if rs.listener != nil {
+		rs.listener.Close()
+	}
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
+func (rs *RespServer) accept() {
+	for {
+		conn, err := rs.listener.Accept()
+		if err != nil {
+			rs.mutex.Lock()
+			closed := rs.closed
+			rs.mutex.Unlock()
+			if !closed {
+				slog.Error("RESP accept", "err", err)
+			}
+			return
+		}
+
+		rs.mutex.Lock()
+		if rs.closed {
+			rs.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		rs.conns[conn] = struct{}{}
+		rs.mutex.Unlock()
+
+		go rs.serve(conn)
+	}
+}
+
+func (rs *RespServer) serve(conn net.Conn) {
+	defer func() {
+		rs.mutex.Lock()
+		delete(rs.conns, conn)
+		rs.mutex.Unlock()
+		conn.Close()
+	}()
+
+	// RESP没有请求头，同一个连接的日志用一个ID关联
+	ctx := context.WithValue(context.Background(), requestIDKey, newRequestID())
+	reader := NewRespReader(conn)
+	writer := RespWriter{bufio.NewWriter(conn)}
+	tx := &RespTx{}
+	for {
+		args, err := reader.ReadCommand()
+		if err == ErrRespProtocol {
+			Logger(ctx).Warn("RESP protocol error", "remote", conn.RemoteAddr().String(), "err", err)
+			writer.Error("ERR " + err.Error())
+			writer.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := false
+		if !tx.Exec(rs.server, writer, args) {
+			quit = rs.server.ExecResp(writer, args)
+		}
+		// 流水线中的命令全部执行完之后再一起发送回复
+		if quit || !reader.Buffered() {
+			if err = writer.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+func respArity(w RespWriter, cmd string, args [][]byte, min int, max int) bool {
+	if len(args) < min || (max > 0 && len(args) > max) {
+		w.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+		return false
+	}
+	return true
+}
+
+// ExecResp executes a RESP command and writes the reply, it returns true if
+// the client asked to close the connection.
+func (server *Server) ExecResp(w RespWriter, args [][]byte) bool {
+	cmd := strings.ToUpper(string(args[0]))
+
+	switch cmd {
+	case "TCREATE", "TDROP", "TINSERT", "TDEL":
+		if server.IsReplica() {
+			w.Error("READONLY You can't write against a read only replica.")
+			return false
+		}
+	}
+
+	switch cmd {
+	case "PING":
+		if !respArity(w, cmd, args, 1, 2) {
+			break
+		}
+		if len(args) == 2 {
+			w.Bulk(string(args[1]))
+		} else {
+			w.Simple("PONG")
+		}
+	case "QUIT":
+		w.Simple("OK")
+		return true
+	case "COMMAND":
+		// redis-cli连接时会查询命令列表
+		w.Array(nil)
+	case "INFO":
+		w.Bulk(server.InfoString())
+	case "TCREATE":
+		if !respArity(w, cmd, args, 2, 2) {
+			break
+		}
+		name := string(args[1])
+		if server.CreateTrie(name) {
+			w.Int(1)
+		} else {
+			w.Int(0)
+		}
+	case "TDROP":
+		if !respArity(w, cmd, args, 2, 2) {
+			break
+		}
+		name := string(args[1])
+		if server.DropTrie(name) {
+			w.Int(1)
+		} else {
+			w.Int(0)
+		}
+	case "TINSERT":
+		if !respArity(w, cmd, args, 3, 4) {
+			break
+		}
+		var value interface{}
+		if len(args) == 4 && len(args[3]) > 0 {
+			value = string(args[3])
+		}
+		if err := server.InsertKey(string(args[1]), string(args[2]), value); err == ErrOutOfMemory {
+			w.Error("OOM " + err.Error())
+			break
+		} else if err != nil {
+			w.Error("ERR " + err.Error())
+			break
+		}
+		w.Simple("OK")
+	case "TDEL":
+		if !respArity(w, cmd, args, 3, 0) {
+			break
+		}
+		var removed int64
+		for _, key := range args[2:] {
+			if server.RemoveKey(string(args[1]), string(key)) {
+				removed++
+			}
+		}
+		w.Int(removed)
+	case "TGET":
+		if !respArity(w, cmd, args, 3, 3) {
+			break
+		}
+		value, err := server.GetKey(string(args[1]), string(args[2]))
+		switch err {
+		case nil:
+			w.Bulk(ValueString(value))
+		case ErrKeyNotFound:
+			w.Nil()
+		default:
+			w.Error("ERR " + err.Error())
+		}
+	case "TPREFIX":
+		if !respArity(w, cmd, args, 3, 4) {
+			break
+		}
+		limit := 10
+		if len(args) == 4 {
+			n, err := strconv.Atoi(string(args[3]))
+			if err != nil || n <= 0 {
+				w.Error("ERR limit is not a positive integer")
+				break
+			}
+			limit = n
+		}
+		keys, err := server.PrefixSearch(string(args[1]), string(args[2]), limit)
+		if err != nil {
+			w.Error("ERR " + err.Error())
+			break
+		}
+		w.Array(keys)
+	case "TMATCH":
+		if !respArity(w, cmd, args, 3, 3) {
+			break
+		}
+		keys, err := server.ForwardMatch(string(args[1]), string(args[2]))
+		if err != nil {
+			w.Error("ERR " + err.Error())
+			break
+		}
+		w.Array(keys)
+	default:
+		w.Error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	return false
+}
+
+// RespTx is the MULTI state of a connection.
+type RespTx struct {
+	active bool
+	// 排队时出错，EXEC会放弃整个事务
+	dirty bool
+	ops   []BatchOp
+	// 每条排队的命令和它对应的操作数量，EXEC按命令回复
+	queued []respQueued
+}
+
+type respQueued struct {
+	cmd string
+	ops int
+}
+
+// Exec handles MULTI, EXEC, DISCARD and the commands queued between them,
+// it returns false for a command that should be executed directly.
+func (tx *RespTx) Exec(server *Server, w RespWriter, args [][]byte) bool {
+	cmd := strings.ToUpper(string(args[0]))
+
+	switch cmd {
+	case "MULTI":
+		if tx.active {
+			w.Error("ERR MULTI calls can not be nested")
+			return true
+		}
+		*tx = RespTx{active: true}
+		w.Simple("OK")
+		return true
+	case "DISCARD":
+		if !tx.active {
+			w.Error("ERR DISCARD without MULTI")
+			return true
+		}
+		*tx = RespTx{}
+		w.Simple("OK")
+		return true
+	case "EXEC":
+		if !tx.active {
+			w.Error("ERR EXEC without MULTI")
+			return true
+		}
+		tx.exec(server, w)
+		*tx = RespTx{}
+		return true
+	}
+
+	if !tx.active {
+		return false
+	}
+
+	switch cmd {
+	case "TINSERT":
+		if !respArity(w, cmd, args, 3, 4) {
+			tx.dirty = true
+			return true
+		}
+		op := BatchOp{Op: BatchInsert, Name: string(args[1]), Key: string(args[2])}
+		if len(args) == 4 {
+			value := string(args[3])
+			op.Value = &value
+		}
+		tx.ops = append(tx.ops, op)
+		tx.queued = append(tx.queued, respQueued{cmd: cmd, ops: 1})
+	case "TDEL":
+		if !respArity(w, cmd, args, 3, 0) {
+			tx.dirty = true
+			return true
+		}
+		for _, key := range args[2:] {
+			tx.ops = append(tx.ops, BatchOp{Op: BatchRemove, Name: string(args[1]), Key: string(key)})
+		}
+		tx.queued = append(tx.queued, respQueued{cmd: cmd, ops: len(args) - 2})
+	case "QUIT":
+		return false
+	default:
+		w.Error(fmt.Sprintf("ERR command '%s' can not be used in MULTI", strings.ToLower(cmd)))
+		tx.dirty = true
+		return true
+	}
+	w.Simple("QUEUED")
+	return true
+}
+
+func (tx *RespTx) exec(server *Server, w RespWriter) {
+	if tx.dirty {
+		w.Error("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+	if server.IsReplica() {
+		w.Error("READONLY You can't write against a read only replica.")
+		return
+	}
+
+	results, err := server.Transaction(tx.ops)
+	if err != nil {
+		w.Error("EXECABORT " + err.Error())
+		return
+	}
+
+	w.WriteString("*" + strconv.Itoa(len(tx.queued)) + "\r\n")
+	for _, queued := range tx.queued {
+		if queued.cmd == "TINSERT" {
+			w.Simple("OK")
+			results = results[1:]
+			continue
+		}
+		var removed int64
+		for _, result := range results[:queued.ops] {
+			if result.Status == BatchRemoved {
+				removed++
+			}
+		}
+		results = results[queued.ops:]
+		w.Int(removed)
+	}
+}
+
+// InfoString formats the state of the server like the INFO command of Redis.
+func (server *Server) InfoString() string {
+	var b strings.Builder
+
+	b.WriteString("# Replication\r\n")
+	if server.Replication == nil {
+		b.WriteString("role:primary\r\n")
+	} else {
+		info := server.Replication.Info()
+		fmt.Fprintf(&b, "role:%s\r\n", info.Role)
+		if info.Role == "replica" {
+			fmt.Fprintf(&b, "primary:%s\r\n", info.Primary)
+			fmt.Fprintf(&b, "primary_link_up:%t\r\n", info.LinkUp)
+			fmt.Fprintf(&b, "primary_offset:%d\r\n", info.PrimaryOffset)
+		}
+		fmt.Fprintf(&b, "connected_replicas:%d\r\n", len(info.Replicas))
+		for i, replica := range info.Replicas {
+			fmt.Fprintf(&b, "replica%d:addr=%s,offset=%d,lag=%d\r\n", i, replica.Addr, replica.Ack, replica.LagBytes)
+		}
+		fmt.Fprintf(&b, "replid:%s\r\n", info.ID)
+		fmt.Fprintf(&b, "offset:%d\r\n", info.Offset)
+	}
+
+	server.Mutex.RLock()
+	names := make([]string, 0, len(server.DB))
+	tries := make(map[string]*Trie, len(server.DB))
+	for name, trie := range server.DB {
+		names = append(names, name)
+		tries[name] = trie
+	}
+	server.Mutex.RUnlock()
+	sort.Strings(names)
+
+	b.WriteString("\r\n# Keyspace\r\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s:keys=%d,nodes=%d\r\n", name, atomic.LoadInt32(&tries[name].NumberKey), atomic.LoadInt32(&tries[name].NumberNode))
+	}
+	return b.String()
+}
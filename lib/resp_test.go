@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func respCommand(args ...string) string {
+	cmd := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		cmd += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	return cmd
+}
+
+// 客户端声明的长度不能导致预先分配内存
+func TestRespReader_BulkSize(t *testing.T) {
+	reader := NewRespReader(strings.NewReader("*2\r\n$4\r\nPING\r\n$" + strconv.Itoa(respMaxBulkSize+1) + "\r\n"))
+	if _, err := reader.ReadCommand(); err != ErrRespProtocol {
+		t.Errorf("expected a protocol error for a bulk over the limit, got %v", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	reader = NewRespReader(strings.NewReader("*1048576\r\n$" + strconv.Itoa(respMaxBulkSize) + "\r\nabc"))
+	_, err := reader.ReadCommand()
+	runtime.ReadMemStats(&after)
+	if err != io.EOF {
+		t.Errorf("expected io.EOF for a truncated bulk, got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4*1024*1024 {
+		t.Errorf("allocated %d bytes for a truncated command", allocated)
+	}
+}
+
+func TestRespServer_Pipeline(t *testing.T) {
+	server := NewServer()
+	server.RESP = NewRespServer(server, "127.0.0.1:0")
+	if err := server.RESP.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.RESP.Close()
+
+	conn, err := net.Dial("tcp", server.RESP.Addr())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	// 一次发送所有命令，最后一条是inline命令
+	request := respCommand("PING") +
+		respCommand("TINSERT", "test", "abc") +
+		respCommand("TCREATE", "test") +
+		respCommand("TCREATE", "test") +
+		respCommand("TINSERT", "test", "abc", "1") +
+		respCommand("TINSERT", "test", "abcd") +
+		respCommand("TINSERT", "test", "b", "2") +
+		respCommand("TGET", "test", "abc") +
+		respCommand("TGET", "test", "abcd") +
+		respCommand("TGET", "test", "x") +
+		respCommand("TPREFIX", "test", "ab") +
+		respCommand("TMATCH", "test", "abcde") +
+		respCommand("TDEL", "test", "abc", "x") +
+		respCommand("TGET", "test") +
+		"PING hello\r\n"
+	expected := "+PONG\r\n" +
+		"-ERR trie not found\r\n" +
+		":1\r\n" +
+		":0\r\n" +
+		"+OK\r\n" +
+		"+OK\r\n" +
+		"+OK\r\n" +
+		"$1\r\n1\r\n" +
+		"$0\r\n\r\n" +
+		"$-1\r\n" +
+		"*2\r\n$3\r\nabc\r\n$4\r\nabcd\r\n" +
+		"*2\r\n$3\r\nabc\r\n$4\r\nabcd\r\n" +
+		":1\r\n" +
+		"-ERR wrong number of arguments for 'tget' command\r\n" +
+		"$5\r\nhello\r\n"
+
+	if _, err = conn.Write([]byte(request)); err != nil {
+		t.Fatal(err.Error())
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, len(expected))
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("%s, got %q", err.Error(), reply)
+	}
+	if string(reply) != expected {
+		t.Errorf("expected %q, got %q", expected, reply)
+	}
+
+	if ret, _ := server.GetTrie("test").Find([]byte("abc")); ret {
+		t.Error("key abc not removed")
+	}
+}
+
+func TestRespServer_ReadOnly(t *testing.T) {
+	replica := NewServer()
+	replica.Replication = NewReplication(replica, "", "127.0.0.1:1")
+	replica.CreateTrie("test")
+
+	var buf strings.Builder
+	writer := RespWriter{bufio.NewWriter(&buf)}
+	replica.ExecResp(writer, [][]byte{[]byte("TINSERT"), []byte("test"), []byte("abc")})
+	writer.Flush()
+
+	if !strings.HasPrefix(buf.String(), "-READONLY") {
+		t.Errorf("expected write on replica to be rejected, got %q", buf.String())
+	}
+	if ret, _ := replica.GetTrie("test").Find([]byte("abc")); ret {
+		t.Error("key inserted on replica")
+	}
+}
+
+func TestRespServer_Multi(t *testing.T) {
+	server := NewServer()
+	server.CreateTrie("test")
+	server.InsertKey("test", "old", nil)
+
+	var buf strings.Builder
+	writer := RespWriter{bufio.NewWriter(&buf)}
+	tx := &RespTx{}
+	exec := func(args ...string) {
+		cmd := make([][]byte, len(args))
+		for i, arg := range args {
+			cmd[i] = []byte(arg)
+		}
+		if !tx.Exec(server, writer, cmd) {
+			server.ExecResp(writer, cmd)
+		}
+	}
+
+	exec("MULTI")
+	exec("TINSERT", "test", "abc", "1")
+	exec("TDEL", "test", "old", "nothing")
+	if ret, _ := server.GetTrie("test").Find([]byte("abc")); ret {
+		t.Error("queued command executed before EXEC")
+	}
+	exec("EXEC")
+	exec("MULTI")
+	exec("TGET", "test", "abc")
+	exec("EXEC")
+	exec("MULTI")
+	exec("TINSERT", "nothing", "abc")
+	exec("EXEC")
+	exec("DISCARD")
+	writer.Flush()
+
+	expected := "+OK\r\n+QUEUED\r\n+QUEUED\r\n" +
+		"*2\r\n+OK\r\n:1\r\n" +
+		"+OK\r\n-ERR command 'tget' can not be used in MULTI\r\n" +
+		"-EXECABORT Transaction discarded because of previous errors.\r\n" +
+		"+OK\r\n+QUEUED\r\n-EXECABORT op 0: trie not found\r\n" +
+		"-ERR DISCARD without MULTI\r\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+	if value, _ := server.GetKey("test", "abc"); value != "1" {
+		t.Error("transaction not applied")
+	}
+}
@@ -0,0 +1,211 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RestoreTarget is the point in time a restore stops at. A zero Seq or Time
+// means no limit on that side.
+type RestoreTarget struct {
+	Seq  int64
+	Time time.Time
+}
+
+// covers reports whether a record written at seq and ms happened before the target.
+func (target RestoreTarget) covers(seq int64, ms int64) bool {
+	if target.Seq > 0 && seq > target.Seq {
+		return false
+	}
+	if !target.Time.IsZero() && ms > Millisecond(target.Time) {
+		return false
+	}
+	return true
+}
+
+func (target RestoreTarget) String() string {
+	switch {
+	case target.Seq > 0 && !target.Time.IsZero():
+		return fmt.Sprintf("seq %d and %s", target.Seq, target.Time.Format(time.RFC3339))
+	case target.Seq > 0:
+		return fmt.Sprintf("seq %d", target.Seq)
+	case !target.Time.IsZero():
+		return target.Time.Format(time.RFC3339)
+	default:
+		return "latest"
+	}
+}
+
+var restoreTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+}
+
+// ParseRestoreTime parses a time in RFC3339 or `2006-01-02 15:04[:05]` in the
+// local time zone. A bare `15:04[:05]` means that time today.
+func ParseRestoreTime(value string, now time.Time) (time.Time, error) {
+	for _, layout := range restoreTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			year, month, day := now.Date()
+			return time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), 0, now.Location()), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("bad time %q", value)
+}
+
+type restoreSegment struct {
+	*Segment
+	dir string
+}
+
+// Restore rebuilds the data as it was at target from the segments listed in
+// the manifests named prefix in dirs, usually the AOF directory and its
+// archive. It starts from the newest snapshot finished before the target, or
+// from the first segment if it is still around, and replays the following
+// incremental segments up to the target.
+func Restore(prefix string, dirs []string, target RestoreTarget) (*Engine, error) {
+	segments, err := collectSegments(prefix, dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	var bases []restoreSegment
+	var incrs []restoreSegment
+	for _, segment := range segments {
+		if segment.Type == SegmentBase {
+			bases = append(bases, segment)
+		} else {
+			incrs = append(incrs, segment)
+		}
+	}
+
+	var start *restoreSegment
+	for i := len(bases) - 1; i >= 0; i-- {
+		ok, err := snapshotBefore(bases[i], target)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			start = &bases[i]
+			break
+		}
+	}
+
+	if start == nil && (len(incrs) == 0 || incrs[0].Seq != 1) {
+		return nil, fmt.Errorf("no snapshot finished before %s and the first segment is gone", target)
+	}
+
+	engine := NewEngine()
+	// 目标之后才结束的事务不会执行
+	replayer := NewReplayer(engine)
+	apply := func(segment *Segment, offset int64, record *Record) error {
+		return replayer.Apply(record.Args)
+	}
+
+	seq := int64(1)
+	if start != nil {
+		if err = scanSegment(start.dir, start.Segment, apply); err != nil {
+			return nil, err
+		}
+		seq = start.Seq
+	}
+
+	reached := errors.New("target reached")
+	for _, segment := range incrs {
+		if segment.Seq < seq {
+			continue
+		}
+		if segment.Seq != seq {
+			return nil, fmt.Errorf("segment %s is missing", SegmentName(prefix, seq, SegmentIncr))
+		}
+		seq++
+
+		err = scanSegment(segment.dir, segment.Segment, func(segment *Segment, offset int64, record *Record) error {
+			// 没有序列号的记录来自分段之前的单文件AOF，一定早于目标时间
+			if record.Seq > 0 && !target.covers(record.Seq, record.Time) {
+				return reached
+			}
+			return replayer.Apply(record.Args)
+		})
+		if aofErr, ok := err.(*AofError); ok && aofErr.Err == reached {
+			break
+		}
+		// 正在写入的段末尾可能有写了一半的记录
+		if aofErr, ok := err.(*AofError); ok && aofErr.Err == ErrAofTruncated && !segment.Closed {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return engine, nil
+}
+
+// collectSegments merges the manifests of dirs in replay order, a segment
+// listed in several manifests is read from the first dir.
+func collectSegments(prefix string, dirs []string) ([]restoreSegment, error) {
+	seen := make(map[string]bool)
+	var segments []restoreSegment
+
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		manifest, err := ReadManifest(filepath.Join(dir, prefix+".manifest"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, segment := range manifest.Segments {
+			if !seen[segment.Name] {
+				seen[segment.Name] = true
+				segments = append(segments, restoreSegment{Segment: segment, dir: dir})
+			}
+		}
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool {
+		a, b := segments[i], segments[j]
+		if a.Seq != b.Seq {
+			return a.Seq < b.Seq
+		}
+		return a.Type == SegmentBase && b.Type != SegmentBase
+	})
+	return segments, nil
+}
+
+// snapshotBefore reports whether a snapshot finished before target, according
+// to its closing SNAPSHOT record.
+func snapshotBefore(base restoreSegment, target RestoreTarget) (bool, error) {
+	var marker *Record
+	err := scanSegment(base.dir, base.Segment, func(segment *Segment, offset int64, record *Record) error {
+		marker = record
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if marker == nil || len(marker.Args) != 1 || string(marker.Args[0]) != "SNAPSHOT" {
+		return false, fmt.Errorf("snapshot %s has no end marker", base.Name)
+	}
+	return target.covers(marker.Seq, marker.Time), nil
+}
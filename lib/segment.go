@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AOF由多个编号递增的段组成:
+//
+//	<filename>.<seq>.base  快照，包含编号小于seq的所有段的数据
+//	<filename>.<seq>.incr  增量段，最后一个增量段是当前正在写入的段
+//
+// manifest文件按回放顺序列出所有段，已关闭的段记录大小和CRC32。
+
+const (
+	SegmentBase = "base"
+	SegmentIncr = "incr"
+)
+
+var ErrSegmentChecksum = errors.New("segment size or checksum does not match the manifest")
+
+type Segment struct {
+	Type     string `json:"type"`
+	Seq      int64  `json:"seq"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"`
+	Closed   bool   `json:"closed"`
+}
+
+func SegmentName(prefix string, seq int64, typ string) string {
+	return fmt.Sprintf("%s.%d.%s", prefix, seq, typ)
+}
+
+// String formats the segment as a manifest line.
+func (segment *Segment) String() string {
+	if !segment.Closed {
+		return fmt.Sprintf("%s %d %s", segment.Type, segment.Seq, segment.Name)
+	}
+	return fmt.Sprintf("%s %d %s %d %08x", segment.Type, segment.Seq, segment.Name, segment.Size, segment.Checksum)
+}
+
+func parseSegment(line string) (*Segment, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 && len(fields) != 5 {
+		return nil, fmt.Errorf("bad manifest line %q", line)
+	}
+
+	segment := &Segment{Type: fields[0], Name: fields[2]}
+	if segment.Type != SegmentBase && segment.Type != SegmentIncr {
+		return nil, fmt.Errorf("bad segment type in manifest line %q", line)
+	}
+	if strings.ContainsAny(segment.Name, `/\`) {
+		return nil, fmt.Errorf("bad segment name in manifest line %q", line)
+	}
+
+	var err error
+	if segment.Seq, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("bad manifest line %q", line)
+	}
+
+	if len(fields) == 5 {
+		segment.Closed = true
+		if segment.Size, err = strconv.ParseInt(fields[3], 10, 64); err != nil {
+			return nil, fmt.Errorf("bad manifest line %q", line)
+		}
+		sum, err := strconv.ParseUint(fields[4], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad manifest line %q", line)
+		}
+		segment.Checksum = uint32(sum)
+	}
+
+	return segment, nil
+}
+
+type Manifest struct {
+	Segments []*Segment
+}
+
+func ReadManifest(filename string) (*Manifest, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := &Manifest{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		segment, err := parseSegment(line)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Segments = append(manifest.Segments, segment)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	manifest.Sort()
+	return manifest, nil
+}
+
+// Sort puts the segments in replay order, a base segment before the
+// incremental segment with the same number.
+func (manifest *Manifest) Sort() {
+	sort.SliceStable(manifest.Segments, func(i, j int) bool {
+		a, b := manifest.Segments[i], manifest.Segments[j]
+		if a.Seq != b.Seq {
+			return a.Seq < b.Seq
+		}
+		return a.Type == SegmentBase && b.Type != SegmentBase
+	})
+}
+
+// Last returns the segment being written.
+func (manifest *Manifest) Last() *Segment {
+	if len(manifest.Segments) == 0 {
+		return nil
+	}
+	return manifest.Segments[len(manifest.Segments)-1]
+}
+
+// WriteFile replaces filename atomically.
+func (manifest *Manifest) WriteFile(filename string) error {
+	lines := make([]string, 0, len(manifest.Segments))
+	for _, segment := range manifest.Segments {
+		lines = append(lines, segment.String())
+	}
+
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+		return err
+	})
+}
+
+// Scan reads the records of every segment in replay order. Closed segments
+// are checked against the size and checksum in the manifest.
+func (manifest *Manifest) Scan(dir string, fn func(segment *Segment, offset int64, record *Record) error) error {
+	for _, segment := range manifest.Segments {
+		if err := scanSegment(dir, segment, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanSegment(dir string, segment *Segment, fn func(segment *Segment, offset int64, record *Record) error) error {
+	file, err := os.Open(filepath.Join(dir, segment.Name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := crc32.NewIEEE()
+	reader := NewAofReader(io.TeeReader(file, hash))
+	for {
+		offset := reader.Offset
+		record, err := reader.NextRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err.(*AofError).File = segment.Name
+			return err
+		}
+		if err = fn(segment, offset, record); err != nil {
+			return &AofError{File: segment.Name, Offset: offset, Err: err}
+		}
+	}
+
+	if segment.Closed && (reader.Offset != segment.Size || hash.Sum32() != segment.Checksum) {
+		return &AofError{File: segment.Name, Offset: reader.Offset, Err: ErrSegmentChecksum}
+	}
+	return nil
+}
+
+// checksumFile returns the size and CRC32 of a file.
+func checksumFile(filename string) (int64, uint32, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(hash, file)
+	return size, hash.Sum32(), err
+}
+
+// writeFileAtomic writes a temporary file with fn, syncs it and renames it
+// to filename.
+func writeFileAtomic(filename string, fn func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	if err = fn(writer); err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// 有些文件系统不支持对目录fsync，忽略错误
+	file.Sync()
+	return nil
+}
+
+// moveFile renames a file, copying it when the rename crosses filesystems.
+func moveFile(from string, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+
+	err := writeFileAtomic(to, func(w io.Writer) error {
+		file, err := os.Open(from)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(w, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
@@ -6,28 +6,73 @@ import (
 	"github.com/gorilla/mux"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
+// Server serves an Engine over HTTP, RESP and gRPC and replicates it.
 type Server struct {
-	DB     map[string]*Trie
-	AOF    *AofWriter
+	*Engine
 	Config struct {
 		Addr string `yaml:"addr"`
 		AOF  struct {
-			Fsync    int    `yaml:"fsync"`
-			FileName string `yaml:"filename"`
+			Fsync         int    `yaml:"fsync"`
+			FileName      string `yaml:"filename"`
+			Dir           string `yaml:"dir"`
+			LoadTruncated bool   `yaml:"load-truncated"`
+			// 段的大小(字节)和时间(秒)上限
+			SegmentSize      int64  `yaml:"segment-size"`
+			SegmentAge       int    `yaml:"segment-age"`
+			SnapshotSegments int    `yaml:"snapshot-segments"`
+			ArchiveDir       string `yaml:"archive-dir"`
+			Retention        int    `yaml:"retention"`
+		}
+		Debug       bool
+		Replication struct {
+			Listen    string `yaml:"listen"`
+			ReplicaOf string `yaml:"replicaof"`
+			// 部分重同步使用的backlog大小(字节)
+			BacklogSize int `yaml:"backlog-size"`
+		}
+		// Redis协议的监听地址
+		RESP struct {
+			Listen string `yaml:"listen"`
+		}
+		GRPC struct {
+			Listen string `yaml:"listen"`
+		}
+		Log struct {
+			// debug、info、warn或error，默认info
+			Level string `yaml:"level"`
+			// text或json，默认text
+			Format string `yaml:"format"`
+			// 每个HTTP请求记录一条访问日志
+			Access bool `yaml:"access"`
+		}
+		// 所有trie的内存上限，每个trie的上限在它的配置项中
+		Memory struct {
+			MaxMemory int64  `yaml:"max-memory"`
+			MaxNodes  int64  `yaml:"max-nodes"`
+			Eviction  string `yaml:"eviction"`
 		}
-		Debug bool
 	}
-	WG    sync.WaitGroup
-	Mutex sync.Mutex
+	Replication *Replication
+	RESP        *RespServer
+	GRPC        *GrpcServer
+	WG          sync.WaitGroup
+
+	// 启动时加载AOF期间为1
+	loading int32
+	metrics *httpMetrics
 }
 
 type SearchRequest struct {
@@ -37,38 +82,43 @@ type SearchRequest struct {
 	Limit  int      `json:"limit"`
 }
 
-func (server *Server) CreateTrie(name string) {
-	fmt.Println(name)
-	server.Mutex.Lock()
-	server.DB[name] = NewTrie()
-	server.Mutex.Unlock()
+// feedReplicas sends the write commands of the engine to the replicas.
+func (server *Server) feedReplicas(cmd []byte) {
+	if server.Replication != nil {
+		server.Replication.Feed(cmd)
+	}
 }
 
-func (server *Server) GetTrie(name string) *Trie {
-	server.Mutex.Lock()
-	trie, ok := server.DB[name]
-	server.Mutex.Unlock()
-	if !ok {
-		return nil
-	}
-	return trie
+func (server *Server) IsReplica() bool {
+	return server.Replication != nil && server.Replication.IsReplica()
 }
 
-func (server *Server) Insert(name string, key []byte, value interface{}) {
-	trie, ok := server.DB[name]
-	if !ok {
-		trie = NewTrie()
-		server.DB[name] = trie
-	}
-	trie.Insert(key, value)
+// Loading reports whether the server is still loading its AOF.
+func (server *Server) Loading() bool {
+	return atomic.LoadInt32(&server.loading) == 1
 }
 
-func (server *Server) Remove(name string, key []byte) {
-	trie, ok := server.DB[name]
-	if !ok {
-		return
+// Ready answers 503 to every request but /metrics until the AOF is loaded.
+func (server *Server) Ready(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.Loading() && r.URL.Path != "/metrics" {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server is loading", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Writable rejects writes on a replica.
+func (server *Server) Writable(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.IsReplica() {
+			http.Error(w, fmt.Sprintf("%s, write to the primary %s", ErrReadOnly.Error(), server.Replication.ReplicaOf), 403)
+			return
+		}
+		handler(w, r)
 	}
-	trie.Remove(key)
 }
 
 func (server *Server) HandleSearch(w http.ResponseWriter, r *http.Request) {
@@ -98,30 +148,28 @@ func (server *Server) HandleSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for _, key := range searchRequest.Key {
-		searchResponse[key] = make([]string, 0)
+	server.View(func() {
+		for _, key := range searchRequest.Key {
+			searchResponse[key] = make([]string, 0)
 
-		switch searchRequest.Option {
-		case "forward":
-			flags := trie.SeekBefore([]byte(key))
-			for _, idx := range flags {
-				searchResponse[key] = append(searchResponse[key], string(key[0:idx]))
-			}
-		case "backward":
-			it := trie.SeekAfter([]byte(key))
-			count := 0
-			for it.HasNext() && count < searchRequest.Limit {
-				k, node, _ := it.Next()
-				if node.IsKey {
-					searchResponse[key] = append(searchResponse[key], string(k))
+			switch searchRequest.Option {
+			case "forward":
+				searchResponse[key] = trie.ForwardMatch(key)
+			case "backward":
+				searchResponse[key] = trie.PrefixSearch(key, searchRequest.Limit)
+			case "match":
+				for _, hit := range trie.MatchAll(key) {
+					searchResponse[key] = append(searchResponse[key], hit.Key)
 				}
+			case "segment":
+				searchResponse[key] = trie.Segment(key)
 			}
-		}
 
-	}
+		}
+	})
 
 	if err := json.NewEncoder(w).Encode(searchResponse); err != nil {
-		http.Error(w, err.Error(), 500)
+		serverError(w, r, err)
 	}
 
 }
@@ -137,70 +185,295 @@ func (server *Server) HandleKeyInsert(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	name := params["name"]
 
-	trie := server.GetTrie(name)
-
-	if trie == nil {
+	if server.GetTrie(name) == nil {
 		http.Error(w, "no trie found", 400)
 		return
 	}
 
 	for _, key := range postData {
-		server.Insert(name, []byte(key), nil)
-		server.AOF.Feed(ConvertInsert(name, string(key), ""))
+		switch err := server.InsertKey(name, key, nil); err {
+		case nil:
+		case ErrOutOfMemory:
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		default:
+			serverError(w, r, err)
+			return
+		}
 	}
 
 	if err := json.NewEncoder(w).Encode(make(map[string]interface{})); err != nil {
-		http.Error(w, err.Error(), 500)
+		serverError(w, r, err)
 		return
 	}
 }
 
+// HandleKeyRemove removes a key. With If-Match or the if_version and
+// if_value query parameters the key is only removed if they match.
 func (server *Server) HandleKeyRemove(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	name := params["name"]
 	key := params["key"]
 
-	server.Remove(name, []byte(key))
-	server.AOF.Feed(ConvertRemove(name, key))
+	cond, err := parseCondition(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	switch err = server.DeleteKey(name, key, cond); err {
+	case nil:
+	case ErrKeyNotFound:
+		// 不带条件时删除不存在的key也成功，条件写入时是条件不满足
+		if cond != (Condition{}) {
+			http.Error(w, ErrConditionFailed.Error(), 412)
+			return
+		}
+	case ErrConditionFailed:
+		http.Error(w, err.Error(), 412)
+		return
+	default:
+		http.Error(w, err.Error(), 404)
+		return
+	}
 
 	if err := json.NewEncoder(w).Encode(make(map[string]interface{})); err != nil {
-		http.Error(w, err.Error(), 500)
+		serverError(w, r, err)
+		return
+	}
+}
+
+type KeySetRequest struct {
+	Value     *string `json:"value"`
+	IfAbsent  bool    `json:"if_absent"`
+	IfVersion int64   `json:"if_version"`
+	IfValue   *string `json:"if_value"`
+	// key在多少秒之后过期，0表示不过期
+	TTL int64 `json:"ttl"`
+}
+
+// HandleKeySet inserts or replaces one key. The conditions come from the
+// body, If-Match (a version or *) and If-None-Match: *.
+func (server *Server) HandleKeySet(w http.ResponseWriter, r *http.Request) {
+	var setRequest KeySetRequest
+
+	params := mux.Vars(r)
+	name := params["name"]
+	key := params["key"]
+
+	if err := json.NewDecoder(r.Body).Decode(&setRequest); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if setRequest.TTL < 0 {
+		http.Error(w, "ttl must not be negative", 400)
+		return
+	}
+
+	cond, err := parseCondition(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	cond.IfAbsent = cond.IfAbsent || setRequest.IfAbsent
+	if setRequest.IfVersion > 0 {
+		cond.IfVersion = setRequest.IfVersion
+	}
+	if setRequest.IfValue != nil {
+		cond.IfValue = setRequest.IfValue
+	}
+
+	var value interface{}
+	if setRequest.Value != nil && *setRequest.Value != "" {
+		value = *setRequest.Value
+	}
+
+	ttl := time.Duration(setRequest.TTL) * time.Second
+	version, err := server.SetKey(name, key, value, ttl, cond)
+	switch err {
+	case nil:
+	case ErrConditionFailed:
+		if version > 0 {
+			w.Header().Set("ETag", etag(version))
+		}
+		http.Error(w, err.Error(), 412)
+		return
+	case ErrOutOfMemory:
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	default:
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	w.Header().Set("ETag", etag(version))
+	if err := json.NewEncoder(w).Encode(&KeyGetResponse{Key: key, Value: value, Version: version, TTL: setRequest.TTL}); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
+
+// etag formats the version of a key as a strong entity tag.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseCondition reads If-Match, If-None-Match: * and the if_version,
+// if_value and if_absent query parameters.
+func parseCondition(r *http.Request) (Condition, error) {
+	var cond Condition
+
+	if match := strings.TrimSpace(r.Header.Get("If-Match")); match == "*" {
+		cond.IfExists = true
+	} else if match != "" {
+		version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(match, "W/"), `"`), 10, 64)
+		if err != nil || version <= 0 {
+			return cond, fmt.Errorf("bad If-Match %s, only one version is supported", match)
+		}
+		cond.IfVersion = version
+	}
+	if noneMatch := strings.TrimSpace(r.Header.Get("If-None-Match")); noneMatch == "*" && r.Method != http.MethodGet {
+		cond.IfAbsent = true
+	}
+
+	query := r.URL.Query()
+	if v := query.Get("if_version"); v != "" {
+		version, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || version <= 0 {
+			return cond, fmt.Errorf("bad if_version %s", v)
+		}
+		cond.IfVersion = version
+	}
+	if values, ok := query["if_value"]; ok {
+		cond.IfValue = &values[0]
+	}
+	if query.Get("if_absent") == "true" {
+		cond.IfAbsent = true
+	}
+	return cond, nil
+}
+
+type BatchRequest struct {
+	Ops []BatchOp `json:"ops"`
+}
+
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// HandleBatch applies inserts, updates and removes across tries and reports
+// the result of every operation in the order of the request.
+func (server *Server) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	var batchRequest BatchRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&batchRequest); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if len(batchRequest.Ops) == 0 {
+		http.Error(w, "ops is required", 400)
+		return
+	}
+	if len(batchRequest.Ops) > MaxBatchOps {
+		http.Error(w, fmt.Sprintf("at most %d ops in a batch", MaxBatchOps), 400)
+		return
+	}
+
+	response := BatchResponse{Results: server.Batch(batchRequest.Ops)}
+	if err := json.NewEncoder(w).Encode(&response); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
+
+// HandleTransaction applies the operations of the request all together or
+// not at all.
+func (server *Server) HandleTransaction(w http.ResponseWriter, r *http.Request) {
+	var batchRequest BatchRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&batchRequest); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if len(batchRequest.Ops) == 0 {
+		http.Error(w, "ops is required", 400)
+		return
+	}
+	if len(batchRequest.Ops) > MaxBatchOps {
+		http.Error(w, fmt.Sprintf("at most %d ops in a transaction", MaxBatchOps), 400)
+		return
+	}
+
+	results, err := server.Transaction(batchRequest.Ops)
+	if txErr, ok := err.(*TxError); ok {
+		switch txErr.Err {
+		case ErrTrieNotFound:
+			http.Error(w, err.Error(), 404)
+		case ErrKeyNotFound:
+			http.Error(w, err.Error(), 409)
+		case ErrOutOfMemory:
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		default:
+			http.Error(w, err.Error(), 400)
+		}
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	response := BatchResponse{Results: results}
+	if err := json.NewEncoder(w).Encode(&response); err != nil {
+		serverError(w, r, err)
 		return
 	}
 }
 
 type KeyGetResponse struct {
-	Key   string      `json:"key"`
-	Value interface{} `json:"value"`
+	Key     string      `json:"key"`
+	Value   interface{} `json:"value"`
+	Version int64       `json:"version"`
+	// 剩余的过期时间，单位为秒，不过期的key没有这个字段
+	TTL int64 `json:"ttl,omitempty"`
 }
 
+// HandleKeyGet returns a key with its version, also sent as ETag, and the
+// seconds left before it expires. It answers 304 if If-None-Match has the
+// current version.
 func (server *Server) HandleKeyGet(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	name := params["name"]
 	key := params["key"]
 
-	_, ok := server.DB[name]
+	value, version, expire, err := server.GetKeyExpire(name, key)
 
-	if !ok {
-		http.Error(w, "trie not found", 404)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
 		return
 	}
 
-	ret, value := server.DB[name].Find([]byte(key))
-
-	if !ret {
-		http.Error(w, "key not found", 404)
+	w.Header().Set("ETag", etag(version))
+	if r.Header.Get("If-None-Match") == etag(version) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	var response KeyGetResponse
 	response = KeyGetResponse{
-		Key:   key,
-		Value: value,
+		Key:     key,
+		Value:   value,
+		Version: version,
+	}
+	if expire > 0 {
+		// 不足一秒按一秒计算，过期之前ttl不会是0
+		response.TTL = (expire - Millisecond(time.Now()) + 999) / 1000
 	}
 
 	if err := json.NewEncoder(w).Encode(&response); err != nil {
-		http.Error(w, err.Error(), 500)
+		serverError(w, r, err)
 		return
 	}
 }
@@ -221,55 +494,566 @@ func (server *Server) HandleTrieCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	trie := server.GetTrie(name)
+	server.CreateTrie(name)
 
-	if trie == nil {
-		server.CreateTrie(name)
+	if err := json.NewEncoder(w).Encode(make(map[string]interface{})); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
+
+func (server *Server) HandleTrieDrop(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	name := params["name"]
+
+	if !server.DropTrie(name) {
+		http.Error(w, fmt.Sprintf("trie `%s` not found", name), 404)
+		return
 	}
 
 	if err := json.NewEncoder(w).Encode(make(map[string]interface{})); err != nil {
-		http.Error(w, err.Error(), 500)
+		serverError(w, r, err)
 		return
 	}
 }
 
-type TrieStateResponse struct {
-	Name       string `json:"name"`
-	NumberNode int32  `json:"number_node"`
-	NumberKey  int32  `json:"number_key"`
+func (server *Server) HandleTrieClear(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	name := params["name"]
+
+	if !server.ClearTrie(name) {
+		http.Error(w, fmt.Sprintf("trie `%s` not found", name), 404)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(make(map[string]interface{})); err != nil {
+		serverError(w, r, err)
+		return
+	}
 }
 
-func (server *Server) HandleTrieState(w http.ResponseWriter, r *http.Request) {
+// HandleTrieConfig updates the settings of a trie, a setting with an empty
+// value is removed.
+func (server *Server) HandleTrieConfig(w http.ResponseWriter, r *http.Request) {
+	var postData map[string]string
+
 	params := mux.Vars(r)
 	name := params["name"]
 
+	if err := json.NewDecoder(r.Body).Decode(&postData); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
 	trie := server.GetTrie(name)
 	if trie == nil {
 		http.Error(w, fmt.Sprintf("trie `%s` not found", name), 404)
 		return
 	}
 
-	var resp TrieStateResponse
-	resp = TrieStateResponse{
+	for key, value := range postData {
+		if key == "" {
+			http.Error(w, "config key must not be empty", 400)
+			return
+		}
+		if err := CheckLimit(key, value); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	for key, value := range postData {
+		server.ConfigTrie(name, key, value)
+	}
+
+	if err := json.NewEncoder(w).Encode(trie.ConfigMap()); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
+
+func (server *Server) HandleAofState(w http.ResponseWriter, r *http.Request) {
+	if server.AOF == nil {
+		http.Error(w, "aof is disabled", 400)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"segments": server.AOF.Segments()}); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
+
+func (server *Server) HandleAofSnapshot(w http.ResponseWriter, r *http.Request) {
+	if server.AOF == nil {
+		http.Error(w, "aof is disabled", 400)
+		return
+	}
+
+	if err := server.AOF.Snapshot(); err == ErrSnapshotInProgress {
+		http.Error(w, err.Error(), 409)
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	server.HandleAofState(w, r)
+}
+
+func (server *Server) HandleReplicationInfo(w http.ResponseWriter, r *http.Request) {
+	if server.Replication == nil {
+		http.Error(w, "replication is disabled", 400)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(server.Replication.Info()); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
+
+type WaitRequest struct {
+	Replicas int `json:"replicas"`
+	// 毫秒，0表示一直等待
+	Timeout int `json:"timeout"`
+}
+
+// HandleReplicationWait blocks until the given number of replicas applied
+// every write made before the request.
+func (server *Server) HandleReplicationWait(w http.ResponseWriter, r *http.Request) {
+	if server.Replication == nil {
+		http.Error(w, "replication is disabled", 400)
+		return
+	}
+
+	var waitRequest WaitRequest
+	if err := json.NewDecoder(r.Body).Decode(&waitRequest); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	acked := server.Replication.Wait(waitRequest.Replicas, time.Duration(waitRequest.Timeout)*time.Millisecond)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"replicas": acked}); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
+
+type CloneRequest struct {
+	As string `json:"as"`
+}
+
+// HandleTrieClone creates a copy of a trie under a new name.
+func (server *Server) HandleTrieClone(w http.ResponseWriter, r *http.Request) {
+	var cloneRequest CloneRequest
+
+	params := mux.Vars(r)
+	name := params["name"]
+
+	if err := json.NewDecoder(r.Body).Decode(&cloneRequest); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if cloneRequest.As == "" {
+		http.Error(w, "as is required", 400)
+		return
+	}
+
+	switch err := server.CloneTrie(name, cloneRequest.As); err {
+	case nil:
+	case ErrTrieNotFound:
+		http.Error(w, fmt.Sprintf("trie `%s` not found", name), 404)
+		return
+	case ErrTrieExists:
+		http.Error(w, fmt.Sprintf("trie `%s` already exists", cloneRequest.As), 409)
+		return
+	default:
+		serverError(w, r, err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(NewTrieStateResponse(cloneRequest.As, server.GetTrie(cloneRequest.As))); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
+
+type RenameRequest struct {
+	To string `json:"to"`
+}
+
+// HandleTrieRename renames a trie, it fails if the new name is taken.
+func (server *Server) HandleTrieRename(w http.ResponseWriter, r *http.Request) {
+	var renameRequest RenameRequest
+
+	params := mux.Vars(r)
+	name := params["name"]
+
+	if err := json.NewDecoder(r.Body).Decode(&renameRequest); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if renameRequest.To == "" {
+		http.Error(w, "to is required", 400)
+		return
+	}
+
+	switch err := server.RenameTrie(name, renameRequest.To); err {
+	case nil:
+	case ErrTrieNotFound:
+		http.Error(w, fmt.Sprintf("trie `%s` not found", name), 404)
+		return
+	case ErrTrieExists:
+		http.Error(w, fmt.Sprintf("trie `%s` already exists", renameRequest.To), 409)
+		return
+	default:
+		serverError(w, r, err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(NewTrieStateResponse(renameRequest.To, server.GetTrie(renameRequest.To))); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
+
+type SwapRequest struct {
+	With string `json:"with"`
+}
+
+// HandleTrieSwap exchanges two tries and returns their states after the swap.
+func (server *Server) HandleTrieSwap(w http.ResponseWriter, r *http.Request) {
+	var swapRequest SwapRequest
+
+	params := mux.Vars(r)
+	name := params["name"]
+
+	if err := json.NewDecoder(r.Body).Decode(&swapRequest); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if swapRequest.With == "" {
+		http.Error(w, "with is required", 400)
+		return
+	}
+
+	switch err := server.SwapTrie(name, swapRequest.With); err {
+	case nil:
+	case ErrTrieNotFound:
+		http.Error(w, "trie not found", 404)
+		return
+	default:
+		serverError(w, r, err)
+		return
+	}
+
+	states := make([]*TrieStateResponse, 0, 2)
+	for _, name := range []string{name, swapRequest.With} {
+		if trie := server.GetTrie(name); trie != nil {
+			states = append(states, NewTrieStateResponse(name, trie))
+		}
+	}
+	if err := json.NewEncoder(w).Encode(states); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
+
+// 差异较多时每写出这么多行刷新一次
+const diffFlushLines = 1000
+
+// HandleDiff streams the keys added, removed or changed from trie `from` to
+// trie `to` as JSON lines in lexicographic order.
+func (server *Server) HandleDiff(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if from == "" || to == "" {
+		http.Error(w, "from and to are required", 400)
+		return
+	}
+	for _, name := range []string{from, to} {
+		if server.GetTrie(name) == nil {
+			http.Error(w, fmt.Sprintf("trie `%s` not found", name), 404)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	lines := 0
+	// 开始写出之后不能再返回错误码，客户端断开时停止比较
+	server.DiffTries(from, to, func(entry DiffEntry) bool {
+		if err := encoder.Encode(&entry); err != nil {
+			return false
+		}
+		lines++
+		if flusher != nil && lines%diffFlushLines == 0 {
+			flusher.Flush()
+		}
+		return true
+	})
+}
+
+// 一页最多返回的key数
+const maxKeyListLimit = 10000
+
+// KeyListResponse is a page of keys, an empty or short page is the last one.
+type KeyListResponse struct {
+	Keys []string `json:"keys"`
+}
+
+// HandleKeyList pages through the keys of trie name in lexicographic order,
+// starting after the key after. limit defaults to 10 like the search.
+func (server *Server) HandleKeyList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+	if name == "" {
+		http.Error(w, "name is required", 400)
+		return
+	}
+	limit := 10
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxKeyListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxKeyListLimit), 400)
+			return
+		}
+		limit = n
+	}
+
+	keys, err := server.ListKeys(name, query.Get("after"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(&KeyListResponse{Keys: keys}); err != nil {
+		serverError(w, r, err)
+	}
+}
+
+type MergeRequest struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// 为空时等同于error
+	Policy string `json:"policy"`
+}
+
+// HandleMerge merges trie source into trie target in one transaction.
+func (server *Server) HandleMerge(w http.ResponseWriter, r *http.Request) {
+	var mergeRequest MergeRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&mergeRequest); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if mergeRequest.Source == "" || mergeRequest.Target == "" {
+		http.Error(w, "source and target are required", 400)
+		return
+	}
+	if mergeRequest.Policy == "" {
+		mergeRequest.Policy = MergeError
+	}
+
+	result, err := server.MergeTrie(mergeRequest.Source, mergeRequest.Target, mergeRequest.Policy)
+	if _, ok := err.(*ConflictError); ok {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+	switch err {
+	case nil:
+	case ErrTrieNotFound:
+		http.Error(w, "trie not found", 404)
+		return
+	case ErrOutOfMemory:
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	default:
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&result); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
+
+type RestoreRequest struct {
+	Name  string `json:"name"`
+	As    string `json:"as"`
+	Until string `json:"until"`
+	Seq   int64  `json:"seq"`
+}
+
+// HandleAofRestore restores a trie as it was at a point in time under a new name.
+func (server *Server) HandleAofRestore(w http.ResponseWriter, r *http.Request) {
+	var restoreRequest RestoreRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&restoreRequest); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if restoreRequest.Name == "" || restoreRequest.As == "" {
+		http.Error(w, "name and as are required", 400)
+		return
+	}
+	if restoreRequest.Until == "" && restoreRequest.Seq == 0 {
+		http.Error(w, "until or seq is required", 400)
+		return
+	}
+
+	target := RestoreTarget{Seq: restoreRequest.Seq}
+	if restoreRequest.Until != "" {
+		until, err := ParseRestoreTime(restoreRequest.Until, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		target.Time = until
+	}
+
+	err := server.RestoreTrie(restoreRequest.Name, restoreRequest.As, target)
+	switch err {
+	case nil:
+	case ErrTrieNotFound:
+		http.Error(w, fmt.Sprintf("trie `%s` not found at %s", restoreRequest.Name, target), 404)
+		return
+	case ErrTrieExists, ErrSnapshotInProgress:
+		http.Error(w, err.Error(), 409)
+		return
+	default:
+		serverError(w, r, err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(NewTrieStateResponse(restoreRequest.As, server.GetTrie(restoreRequest.As))); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
+
+type TrieStateResponse struct {
+	Name       string            `json:"name"`
+	NumberNode int32             `json:"number_node"`
+	NumberKey  int32             `json:"number_key"`
+	Memory     int64             `json:"memory"`
+	Config     map[string]string `json:"config"`
+}
+
+func NewTrieStateResponse(name string, trie *Trie) *TrieStateResponse {
+	return &TrieStateResponse{
 		Name:       name,
-		NumberNode: trie.NumberNode,
-		NumberKey:  trie.NumberKey,
+		NumberNode: atomic.LoadInt32(&trie.NumberNode),
+		NumberKey:  atomic.LoadInt32(&trie.NumberKey),
+		Memory:     trie.Memory(),
+		Config:     trie.ConfigMap(),
 	}
-	if err := json.NewEncoder(w).Encode(&resp); err != nil {
-		http.Error(w, err.Error(), 500)
+}
+
+// HandleTrieList returns the state of every trie ordered by name.
+func (server *Server) HandleTrieList(w http.ResponseWriter, r *http.Request) {
+	states := make([]*TrieStateResponse, 0)
+	for _, name := range server.Tries() {
+		if trie := server.GetTrie(name); trie != nil {
+			states = append(states, NewTrieStateResponse(name, trie))
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(states); err != nil {
+		serverError(w, r, err)
 		return
 	}
+}
 
+type InfoResponse struct {
+	Role  string `json:"role"`
+	Tries int    `json:"tries"`
+	Keys  int64  `json:"keys"`
+	Nodes int64  `json:"nodes"`
+	// 估算的内存占用(字节)和因为内存上限淘汰的key数量
+	Memory  int64 `json:"memory"`
+	Evicted int64 `json:"evicted"`
+	AOF     bool  `json:"aof"`
+	// AOF开启时的段数量
+	Segments    int              `json:"segments,omitempty"`
+	Replication *ReplicationInfo `json:"replication,omitempty"`
 }
 
-func (server *Server) InitHTTPServer() {
+// HandleInfo summarizes the server like the INFO command of the RESP listener.
+func (server *Server) HandleInfo(w http.ResponseWriter, r *http.Request) {
+	info := InfoResponse{Role: "primary", AOF: server.AOF != nil, Evicted: server.Evicted()}
+	for _, name := range server.Tries() {
+		if trie := server.GetTrie(name); trie != nil {
+			info.Tries++
+			info.Keys += int64(atomic.LoadInt32(&trie.NumberKey))
+			info.Nodes += int64(atomic.LoadInt32(&trie.NumberNode))
+			info.Memory += trie.Memory()
+		}
+	}
+	if server.AOF != nil {
+		info.Segments = len(server.AOF.Segments())
+	}
+	if server.Replication != nil {
+		info.Replication = server.Replication.Info()
+		info.Role = info.Replication.Role
+	}
+
+	if err := json.NewEncoder(w).Encode(&info); err != nil {
+		serverError(w, r, err)
+		return
+	}
+}
 
+func (server *Server) HandleTrieState(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	name := params["name"]
+
+	trie := server.GetTrie(name)
+	if trie == nil {
+		http.Error(w, fmt.Sprintf("trie `%s` not found", name), 404)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(NewTrieStateResponse(name, trie)); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+}
+
+func (server *Server) Router() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(server.RequestID)
+	r.Use(server.Instrument)
+	r.Use(server.Ready)
+	r.HandleFunc("/metrics", server.HandleMetrics).Methods(http.MethodGet)
 	r.HandleFunc("/api/trie/search", server.HandleSearch).Methods(http.MethodPost)
-	r.HandleFunc("/api/trie", server.HandleTrieCreate).Methods(http.MethodPost)
+	r.HandleFunc("/api/trie", server.HandleTrieList).Methods(http.MethodGet)
+	r.HandleFunc("/api/trie", server.Writable(server.HandleTrieCreate)).Methods(http.MethodPost)
 	r.HandleFunc("/api/trie/{name}", server.HandleTrieState).Methods(http.MethodGet)
-	r.HandleFunc("/api/trie/{name}", server.HandleKeyInsert).Methods(http.MethodPost)
-	r.HandleFunc("/api/trie/{name}/{key}", server.HandleKeyRemove).Methods(http.MethodDelete)
+	r.HandleFunc("/api/trie/{name}", server.Writable(server.HandleKeyInsert)).Methods(http.MethodPost)
+	r.HandleFunc("/api/trie/{name}", server.Writable(server.HandleTrieConfig)).Methods(http.MethodPut)
+	r.HandleFunc("/api/trie/{name}", server.Writable(server.HandleTrieDrop)).Methods(http.MethodDelete)
+	r.HandleFunc("/api/trie/{name}/clear", server.Writable(server.HandleTrieClear)).Methods(http.MethodPost)
+	r.HandleFunc("/api/trie/{name}/clone", server.Writable(server.HandleTrieClone)).Methods(http.MethodPost)
+	r.HandleFunc("/api/trie/{name}/rename", server.Writable(server.HandleTrieRename)).Methods(http.MethodPost)
+	r.HandleFunc("/api/trie/{name}/swap", server.Writable(server.HandleTrieSwap)).Methods(http.MethodPost)
+	r.HandleFunc("/api/batch", server.Writable(server.HandleBatch)).Methods(http.MethodPost)
+	r.HandleFunc("/api/transaction", server.Writable(server.HandleTransaction)).Methods(http.MethodPost)
+	r.HandleFunc("/api/diff", server.HandleDiff).Methods(http.MethodGet)
+	r.HandleFunc("/api/keys", server.HandleKeyList).Methods(http.MethodGet)
+	r.HandleFunc("/api/merge", server.Writable(server.HandleMerge)).Methods(http.MethodPost)
+	r.HandleFunc("/api/info", server.HandleInfo).Methods(http.MethodGet)
+	r.HandleFunc("/api/aof", server.HandleAofState).Methods(http.MethodGet)
+	r.HandleFunc("/api/aof/snapshot", server.HandleAofSnapshot).Methods(http.MethodPost)
+	r.HandleFunc("/api/aof/restore", server.Writable(server.HandleAofRestore)).Methods(http.MethodPost)
+	r.HandleFunc("/api/replication", server.HandleReplicationInfo).Methods(http.MethodGet)
+	r.HandleFunc("/api/replication/wait", server.HandleReplicationWait).Methods(http.MethodPost)
+	r.HandleFunc("/api/trie/{name}/{key}", server.Writable(server.HandleKeyRemove)).Methods(http.MethodDelete)
+	r.HandleFunc("/api/trie/{name}/{key}", server.Writable(server.HandleKeySet)).Methods(http.MethodPut)
 	r.HandleFunc("/api/trie/{name}/{key}", server.HandleKeyGet).Methods(http.MethodGet)
 
 	// debug模式打开pprof
@@ -287,64 +1071,138 @@ func (server *Server) InitHTTPServer() {
 		r.Handle("/debug/pprof/profile", pprof.Handler("profile"))
 	}
 
+	return r
+}
+
+func (server *Server) InitHTTPServer() {
+	r := server.Router()
+
 	go func() {
-		log.Printf("Init HTTP Server addr: %s\n", server.Config.Addr)
+		slog.Info("HTTP listen", "addr", server.Config.Addr)
 		if err := http.ListenAndServe(server.Config.Addr, r); err != nil {
-			log.Fatal(err.Error())
+			fatal("HTTP listen", err)
 		}
 	}()
 }
 
-func (server *Server) InitAOF() {
-	if server.Config.AOF.Fsync == 2 {
-		server.AOF.Cron()
-	}
-}
-
 func NewServer() *Server {
-	signals := make(chan os.Signal)
-	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
-	server := &Server{}
-	server.DB = make(map[string]*Trie)
+	server := &Server{Engine: NewEngine(), metrics: newHTTPMetrics()}
+	server.Engine.OnFeed = server.feedReplicas
 	// default aof is disabled
-	server.Config.AOF.Fsync = -1
+	server.Config.AOF.Fsync = FsyncDisabled
 	server.Config.AOF.FileName = "./aof.log"
 
 	return server
 }
 
 func (server *Server) InitConfig(configFile string) {
-	log.Printf("Load config file: %s\n", configFile)
 	var err error
 	var buf []byte
 
 	buf, err = ioutil.ReadFile(configFile)
 	if err != nil {
-		log.Fatalln(err.Error())
+		fatal("read config", err)
 	}
 	if err = yaml.Unmarshal(buf, &server.Config); err != nil {
-		log.Fatalln(err.Error())
+		fatal("parse config", err)
+	}
+	logger, err := NewLogger(os.Stderr, server.Config.Log.Level, server.Config.Log.Format)
+	if err != nil {
+		fatal("config of the log", err)
 	}
-	if server.Config.AOF.Fsync != -1 {
-		server.AOF = NewAOF(server.Config.AOF.FileName)
+	// log包的输出也写到这里
+	slog.SetDefault(logger)
+	slog.Info("config loaded", "file", configFile)
+	memory := server.Config.Memory
+	if err = (Limits{MaxMemory: memory.MaxMemory, MaxNodes: memory.MaxNodes, Eviction: memory.Eviction}).Check(); err != nil {
+		fatal("config of the memory", err)
+	}
+	if server.Config.Replication.Listen != "" || server.Config.Replication.ReplicaOf != "" {
+		server.Replication = NewReplication(server, server.Config.Replication.Listen, server.Config.Replication.ReplicaOf)
+		if server.Config.Replication.BacklogSize > 0 {
+			server.Replication.BacklogSize = server.Config.Replication.BacklogSize
+		}
+	}
+	if server.Config.RESP.Listen != "" {
+		server.RESP = NewRespServer(server, server.Config.RESP.Listen)
+	}
+	if server.Config.GRPC.Listen != "" {
+		server.GRPC = NewGrpcServer(server, server.Config.GRPC.Listen)
 	}
 
 }
 
-func (server *Server) Serve() {
-	if server.Config.AOF.Fsync == 2 {
-		server.AOF.Load(server)
-		for name, trie := range server.DB {
-			fmt.Println(name, trie.NumberNode, trie.NumberKey)
-		}
+// Options maps the aof section of the config to the options of the engine.
+func (server *Server) Options() Options {
+	return Options{
+		Dir:              server.Config.AOF.Dir,
+		FileName:         server.Config.AOF.FileName,
+		Fsync:            server.Config.AOF.Fsync,
+		LoadTruncated:    server.Config.AOF.LoadTruncated,
+		SegmentSize:      server.Config.AOF.SegmentSize,
+		SegmentAge:       time.Duration(server.Config.AOF.SegmentAge) * time.Second,
+		SnapshotSegments: server.Config.AOF.SnapshotSegments,
+		ArchiveDir:       server.Config.AOF.ArchiveDir,
+		Retention:        server.Config.AOF.Retention,
+		// Serve设置OnFeed之后再开始过期，删除命令才会发送给replica
+		ActiveExpire: false,
+		MaxMemory:    server.Config.Memory.MaxMemory,
+		MaxNodes:     server.Config.Memory.MaxNodes,
+		Eviction:     server.Config.Memory.Eviction,
 	}
-	signals := make(chan os.Signal)
+}
+
+func (server *Server) Serve() {
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	// 加载AOF期间HTTP返回503，其他监听在加载之后才启动
+	atomic.StoreInt32(&server.loading, 1)
 	server.InitHTTPServer()
-	server.InitAOF()
+	options := server.Options()
+	if server.Config.AOF.Fsync == FsyncDisabled {
+		// 没有AOF时Load只设置内存限制
+		options.Dir, options.FileName = "", ""
+	}
+	if err := server.Load(options); err != nil {
+		fatal("load AOF", err)
+	}
+	for _, name := range server.Tries() {
+		if trie := server.GetTrie(name); trie != nil {
+			slog.Info("trie loaded", "trie", name, "nodes", atomic.LoadInt32(&trie.NumberNode), "keys", atomic.LoadInt32(&trie.NumberKey))
+		}
+	}
+	atomic.StoreInt32(&server.loading, 0)
+
+	if !server.IsReplica() {
+		server.StartExpiration()
+	}
+	if server.Replication != nil {
+		if err := server.Replication.Start(); err != nil {
+			fatal("start replication", err)
+		}
+	}
+	if server.RESP != nil {
+		if err := server.RESP.Start(); err != nil {
+			fatal("start RESP", err)
+		}
+	}
+	if server.GRPC != nil {
+		if err := server.GRPC.Start(); err != nil {
+			fatal("start gRPC", err)
+		}
+	}
 	<-signals
-	if server.Config.AOF.Fsync != -1 {
-		server.AOF.Close()
+	if server.GRPC != nil {
+		server.GRPC.Close()
+	}
+	if server.RESP != nil {
+		server.RESP.Close()
+	}
+	if server.Replication != nil {
+		server.Replication.Close()
+	}
+	if err := server.Engine.Close(); err != nil {
+		slog.Error("close engine", "err", err)
 	}
 }
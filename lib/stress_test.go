@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 和 -race 一起运行，检查engine的并发访问，以及AOF回放之后和并发写入的结果一样
+func TestEngine_Stress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stress")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	options := DefaultOptions(dir)
+	engine, err := Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	engine.CreateTrie("dict")
+	engine.CreateTrie("ttl")
+	var wg sync.WaitGroup
+
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				fn(i)
+			}
+		}()
+	}
+
+	run(func(i int) {
+		engine.InsertKey("dict", "key"+strconv.Itoa(i%30), strconv.Itoa(i))
+		engine.InsertKey("ttl", "key"+strconv.Itoa(i%10), nil)
+	})
+	run(func(i int) {
+		// 两个goroutine写同一个key，回放的顺序要和执行的顺序一样
+		engine.InsertKey("dict", "key"+strconv.Itoa(i%30), "other"+strconv.Itoa(i))
+	})
+	run(func(i int) {
+		engine.RemoveKey("dict", "key"+strconv.Itoa(i%20))
+	})
+	run(func(i int) {
+		name := "tmp" + strconv.Itoa(i%5)
+		engine.CreateTrie(name)
+		engine.InsertKey(name, "a", nil)
+		engine.DropTrie(name)
+	})
+	run(func(i int) {
+		engine.InsertKeyTTL("ttl", "key"+strconv.Itoa(i%10), nil, time.Millisecond)
+		engine.expireCycle()
+	})
+	replayer := NewReplayer(engine)
+	replayer.Feed = true
+	run(func(i int) {
+		// 回放AOF时trie不存在会自动创建
+		replayer.Apply([][]byte{[]byte("INSERT"), []byte("replayed" + strconv.Itoa(i%3)), []byte("k"), []byte("")})
+		replayer.Apply([][]byte{[]byte("REMOVE"), []byte("replayed" + strconv.Itoa(i%3)), []byte("k")})
+	})
+	run(func(i int) {
+		engine.Batch([]BatchOp{
+			{Op: BatchInsert, Name: "dict", Key: "batch" + strconv.Itoa(i%10)},
+			{Op: BatchRemove, Name: "dict", Key: "key" + strconv.Itoa(i%30)},
+		})
+		engine.Transaction([]BatchOp{{Op: BatchInsert, Name: "dict", Key: "tx"}})
+	})
+	run(func(i int) {
+		engine.GetKey("dict", "key"+strconv.Itoa(i%30))
+		engine.PrefixSearch("dict", "key", 10)
+		engine.Match("dict", "key1key2")
+		engine.Segment("dict", "key1key2")
+		engine.Tries()
+	})
+	run(func(i int) {
+		if i%30 == 0 {
+			engine.Rewrite(ioutil.Discard)
+		}
+	})
+	// 状态接口在写入的同时读trie的计数
+	server := &Server{Engine: engine, metrics: newHTTPMetrics()}
+	router := server.Router()
+	run(func(i int) {
+		for _, path := range []string{"/api/trie/dict", "/api/trie", "/api/info"} {
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		}
+		server.InfoString()
+	})
+	wg.Wait()
+
+	count := int32(0)
+	trie := engine.GetTrie("dict")
+	trie.Range(func(key []byte, node *Node) bool {
+		count++
+		return true
+	})
+	if count != trie.NumberKey {
+		t.Errorf("counted %d keys, NumberKey is %d", count, trie.NumberKey)
+	}
+
+	// 等有ttl的key都过期，两边Range都不会返回它们
+	time.Sleep(5 * time.Millisecond)
+	var live bytes.Buffer
+	engine.Rewrite(&live)
+	engine.Close()
+
+	engine, err = Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer engine.Close()
+	var loaded bytes.Buffer
+	engine.Rewrite(&loaded)
+	if live.String() != loaded.String() {
+		t.Errorf("expected the replayed data to be the same, got\n%s\nwant\n%s", loaded.String(), live.String())
+	}
+}
+
+func TestServer_Loading(t *testing.T) {
+	server := NewServer()
+	server.CreateTrie("dict")
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	server.loading = 1
+	resp, err := http.Get(ts.URL + "/api/trie/dict")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("expected 503 while loading, got %d", resp.StatusCode)
+	}
+
+	server.loading = 0
+	resp, err = http.Get(ts.URL + "/api/trie/dict")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("expected 200 after loading, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,222 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TxError is the operation that aborted a transaction, nothing was applied.
+type TxError struct {
+	Index int
+	Err   error
+}
+
+func (e *TxError) Error() string {
+	return fmt.Sprintf("op %d: %s", e.Index, e.Err.Error())
+}
+
+func (e *TxError) Unwrap() error {
+	return e.Err
+}
+
+// View runs fn while no transaction is being applied, so fn sees either all
+// or none of the writes of every transaction.
+func (engine *Engine) View(fn func()) {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+	fn()
+}
+
+// Transaction applies the operations atomically with respect to readers and
+// writes them to the AOF between MULTI and EXEC. The transaction is aborted
+// with a *TxError if an operation is invalid, its trie does not exist or it
+// updates a missing key, checked against the data before the transaction.
+// Removing a missing key does not abort it.
+func (engine *Engine) Transaction(ops []BatchOp) ([]BatchResult, error) {
+	if len(ops) == 0 {
+		return []BatchResult{}, nil
+	}
+
+	engine.txMutex.Lock()
+	defer engine.txMutex.Unlock()
+
+	for i, op := range ops {
+		if err := engine.checkTxOp(op); err != nil {
+			return nil, &TxError{Index: i, Err: err}
+		}
+	}
+	// 在执行之前为所有写入腾出空间，淘汰的key不属于事务
+	inserts := make(map[string][]insertion)
+	first := -1
+	for i, op := range ops {
+		if op.Op == BatchRemove {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		inserts[op.Name] = append(inserts[op.Name], insertion{key: []byte(op.Key), value: op.value()})
+	}
+	if err := engine.reserve(inserts, engine.Feed); err != nil {
+		return nil, &TxError{Index: first, Err: err}
+	}
+
+	results := make([]BatchResult, len(ops))
+	cmds := make([][]byte, 0, len(ops)+2)
+	cmds = append(cmds, ConvertMulti())
+	for i, op := range ops {
+		trie := engine.GetTrie(op.Name)
+		key := []byte(op.Key)
+		exists, _ := trie.Find(key)
+
+		if op.Op == BatchRemove {
+			if !exists {
+				results[i] = BatchResult{Status: BatchNotFound, Error: ErrKeyNotFound.Error()}
+				continue
+			}
+			trie.Remove(key)
+			cmds = append(cmds, ConvertRemove(op.Name, op.Key))
+			results[i] = BatchResult{Status: BatchRemoved}
+			continue
+		}
+
+		value := op.value()
+		expire := expireAt(time.Duration(op.TTL) * time.Second)
+		version := trie.InsertExpire(key, value, 0, expire)
+		cmds = append(cmds, ConvertInsertExpire(op.Name, op.Key, ValueString(value), version, expire))
+		if exists {
+			results[i] = BatchResult{Status: BatchUpdated, Version: version}
+		} else {
+			results[i] = BatchResult{Status: BatchCreated, Version: version}
+		}
+	}
+	cmds = append(cmds, ConvertExec())
+
+	engine.feedMutex.Lock()
+	engine.feedBlock(cmds)
+	engine.syncAlways()
+	engine.feedMutex.Unlock()
+	return results, nil
+}
+
+// checkTxOp is called with txMutex held, so what it checks does not change
+// before the operation is applied.
+func (engine *Engine) checkTxOp(op BatchOp) error {
+	switch op.Op {
+	case BatchInsert, BatchUpdate, BatchRemove:
+	default:
+		return fmt.Errorf("unknown op `%s`", op.Op)
+	}
+	if op.Key == "" {
+		return fmt.Errorf("key is required")
+	}
+	if op.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative")
+	}
+
+	trie := engine.GetTrie(op.Name)
+	if trie == nil {
+		return ErrTrieNotFound
+	}
+	if op.Op == BatchUpdate {
+		if exists, _ := trie.Find([]byte(op.Key)); !exists {
+			return ErrKeyNotFound
+		}
+	}
+	return nil
+}
+
+// feedBlock writes the commands of a transaction, the caller holds feedMutex.
+func (engine *Engine) feedBlock(cmds [][]byte) {
+	if engine.AOF != nil {
+		engine.AOF.FeedBlock(cmds)
+	}
+	if engine.OnFeed != nil {
+		for _, cmd := range cmds {
+			engine.OnFeed(cmd)
+		}
+	}
+}
+
+// Replayer applies the commands read back from an AOF or a replication
+// stream. The commands between MULTI and EXEC are kept until EXEC and then
+// applied together, a transaction without EXEC is never applied.
+type Replayer struct {
+	Engine *Engine
+	// 执行的命令再写入Engine的AOF，replica用它记录主节点发来的命令
+	Feed bool
+
+	inTx bool
+	tx   [][][]byte
+}
+
+func NewReplayer(engine *Engine) *Replayer {
+	return &Replayer{Engine: engine}
+}
+
+// Pending reports whether a MULTI was read without its EXEC.
+func (r *Replayer) Pending() bool {
+	return r.inTx
+}
+
+func (r *Replayer) Apply(args [][]byte) error {
+	if len(args) == 1 {
+		switch strings.ToUpper(string(args[0])) {
+		case "MULTI":
+			if r.inTx {
+				return fmt.Errorf("nested MULTI")
+			}
+			r.inTx = true
+			r.tx = nil
+			return nil
+		case "EXEC":
+			if !r.inTx {
+				return fmt.Errorf("EXEC without MULTI")
+			}
+			r.inTx = false
+			tx := r.tx
+			r.tx = nil
+			return r.exec(tx)
+		}
+	}
+
+	if r.inTx {
+		r.tx = append(r.tx, args)
+		return nil
+	}
+	// 和本地写入一样持有txMutex，快照不会看到写入了却还没记录的命令
+	r.Engine.txMutex.RLock()
+	defer r.Engine.txMutex.RUnlock()
+	if err := r.Engine.Apply(args); err != nil {
+		return err
+	}
+	if r.Feed {
+		r.Engine.Feed(EncodeRecord(args...))
+	}
+	return nil
+}
+
+func (r *Replayer) exec(tx [][][]byte) error {
+	engine := r.Engine
+	engine.txMutex.Lock()
+	defer engine.txMutex.Unlock()
+
+	cmds := make([][]byte, 0, len(tx)+2)
+	cmds = append(cmds, ConvertMulti())
+	for _, args := range tx {
+		if err := engine.Apply(args); err != nil {
+			return err
+		}
+		cmds = append(cmds, EncodeRecord(args...))
+	}
+	cmds = append(cmds, ConvertExec())
+
+	if r.Feed {
+		engine.feedMutex.Lock()
+		engine.feedBlock(cmds)
+		engine.syncAlways()
+		engine.feedMutex.Unlock()
+	}
+	return nil
+}
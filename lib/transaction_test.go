@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestEngine_Transaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tx")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	options := DefaultOptions(dir)
+	options.Fsync = FsyncAlways
+	engine, err := Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	engine.CreateTrie("dict")
+	engine.CreateTrie("synonym")
+	engine.InsertKey("synonym", "土豆", nil)
+
+	one := "马铃薯"
+	_, err = engine.Transaction([]BatchOp{
+		{Op: BatchInsert, Name: "dict", Key: "土豆"},
+		{Op: BatchUpdate, Name: "synonym", Key: "洋芋", Value: &one},
+	})
+	if txErr, ok := err.(*TxError); !ok || txErr.Index != 1 || txErr.Err != ErrKeyNotFound {
+		t.Fatalf("expected the update to abort the transaction, got %v", err)
+	}
+	if _, err = engine.GetKey("dict", "土豆"); err != ErrKeyNotFound {
+		t.Errorf("aborted transaction applied")
+	}
+
+	results, err := engine.Transaction([]BatchOp{
+		{Op: BatchInsert, Name: "dict", Key: "土豆"},
+		{Op: BatchUpdate, Name: "synonym", Key: "土豆", Value: &one},
+		{Op: BatchRemove, Name: "synonym", Key: "洋芋"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if results[0].Status != BatchCreated || results[1].Status != BatchUpdated || results[2].Status != BatchNotFound {
+		t.Errorf("unexpected results %v", results)
+	}
+	segments := engine.AOF.Segments()
+	engine.Close()
+
+	// 模拟写到一半的事务
+	file, err := os.OpenFile(filepath.Join(dir, segments[len(segments)-1].Name), os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	file.Write(ConvertMulti())
+	file.Write(ConvertInsert("dict", "红薯", ""))
+	file.Close()
+
+	options.LoadTruncated = false
+	if _, err = Open(options); err == nil {
+		t.Fatal("expected load to fail on a transaction without EXEC")
+	}
+
+	options.LoadTruncated = true
+	engine, err = Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = engine.GetKey("dict", "红薯"); err != ErrKeyNotFound {
+		t.Errorf("incomplete transaction applied")
+	}
+	if value, _ := engine.GetKey("synonym", "土豆"); value != "马铃薯" {
+		t.Errorf("transaction not loaded")
+	}
+	engine.InsertKey("dict", "山药", nil)
+	engine.Close()
+
+	// 截断之后写入的命令不属于未完成的事务
+	engine, err = Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer engine.Close()
+	if _, err = engine.GetKey("dict", "山药"); err != nil {
+		t.Errorf("key written after truncation lost: %v", err)
+	}
+}
+
+func TestEngine_TransactionIsolation(t *testing.T) {
+	engine := NewEngine()
+	engine.CreateTrie("a")
+	engine.CreateTrie("b")
+
+	group := func(key string, op string) []BatchOp {
+		return []BatchOp{{Op: op, Name: "a", Key: key}, {Op: op, Name: "b", Key: key}}
+	}
+	engine.Transaction(group("x", BatchInsert))
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			engine.Transaction(append(group("x", BatchInsert), group("y", BatchRemove)...))
+			engine.Transaction(append(group("y", BatchInsert), group("x", BatchRemove)...))
+		}
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			wg.Wait()
+			return
+		default:
+		}
+		engine.View(func() {
+			ax, _ := engine.GetTrie("a").Find([]byte("x"))
+			bx, _ := engine.GetTrie("b").Find([]byte("x"))
+			ay, _ := engine.GetTrie("a").Find([]byte("y"))
+			if ax != bx || ax == ay {
+				t.Fatalf("saw half of a transaction: a/x=%t b/x=%t a/y=%t", ax, bx, ay)
+			}
+		})
+	}
+}
+
+func TestReplayer(t *testing.T) {
+	engine := NewEngine()
+	replayer := NewReplayer(engine)
+
+	records := [][][]byte{
+		{[]byte("CREATE"), []byte("dict")},
+		{[]byte("MULTI")},
+		{[]byte("INSERT"), []byte("dict"), []byte("abc"), []byte("")},
+	}
+	for _, args := range records {
+		if err := replayer.Apply(args); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if !replayer.Pending() || engine.GetTrie("dict").NumberKey != 0 {
+		t.Fatal("transaction applied before EXEC")
+	}
+	if err := replayer.Apply([][]byte{[]byte("EXEC")}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if engine.GetTrie("dict").NumberKey != 1 {
+		t.Error("transaction not applied on EXEC")
+	}
+	if err := replayer.Apply([][]byte{[]byte("EXEC")}); err == nil {
+		t.Error("expected EXEC without MULTI to fail")
+	}
+}
@@ -1,33 +1,173 @@
 package lib
 
 import (
+	"math"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 // An implement of trie tree
+//
+// 写入时复制从root到key的路径上的节点，修改副本之后原子地替换root，
+// 已经发布的节点不再修改。读取时取一次root，之后看到的都是同一个版本，
+// 不需要加锁，写入之间由trie的写锁串行执行。
 
 type Node struct {
 	IsKey    bool
 	Children map[uint8]*Node
 	Height   int
 	Value    interface{}
-	Lock     sync.Mutex
-	Fail     *Node
+	// key每次写入加1，删除后从1重新开始
+	Version int64
+	// 过期时间，毫秒时间戳，0表示不过期
+	ExpireAt int64
+	// 最近一次读写的毫秒时间戳和读写次数，淘汰key时使用，可以原子地修改
+	Access int64
+	Hits   uint32
+	Fail   *Node
+}
+
+// touch records an access of the key.
+func (node *Node) touch(now int64) {
+	atomic.StoreInt64(&node.Access, now)
+	if atomic.LoadUint32(&node.Hits) < math.MaxUint32 {
+		atomic.AddUint32(&node.Hits, 1)
+	}
+}
+
+// alive reports whether the node is a key that has not expired at now.
+func (node *Node) alive(now int64) bool {
+	return node.IsKey && (node.ExpireAt == 0 || node.ExpireAt > now)
+}
+
+// clone copies the node and its map of children so the copy can be changed
+// before it is published.
+func (node *Node) clone() *Node {
+	copied := &Node{
+		IsKey:    node.IsKey,
+		Children: make(map[uint8]*Node, len(node.Children)+1),
+		Height:   node.Height,
+		Value:    node.Value,
+		Version:  node.Version,
+		ExpireAt: node.ExpireAt,
+		Access:   atomic.LoadInt64(&node.Access),
+		Hits:     atomic.LoadUint32(&node.Hits),
+		Fail:     node.Fail,
+	}
+	for ord, child := range node.Children {
+		copied.Children[ord] = child
+	}
+	return copied
 }
 
 type Trie struct {
-	Root       *Node
+	// 当前版本的root，保存*Node
+	root       atomic.Value
 	NumberNode int32
 	NumberKey  int32
+	// 所有value的字节数，和节点数一起估算占用的内存
+	ValueBytes int64
+	// 每个trie的配置项，和数据一起记录在AOF中
+	Config     map[string]string
+	ConfigLock sync.RWMutex
+
+	// 串行执行写入
+	writeLock sync.Mutex
+
+	// 设置了过期时间的key，主动过期从中抽样
+	expires     map[string]int64
+	expiresLock sync.Mutex
 }
 
 func NewTrie() *Trie {
-	root := &Node{IsKey: false, Children: make(map[uint8]*Node), Height: -1}
-	trie := &Trie{Root: root, NumberNode: 0, NumberKey: 0}
+	trie := &Trie{NumberNode: 0, NumberKey: 0, Config: make(map[string]string), expires: make(map[string]int64)}
+	trie.root.Store(&Node{IsKey: false, Children: make(map[uint8]*Node), Height: -1})
 	return trie
 }
 
+// Root returns the root of the current version, the nodes under it never
+// change.
+func (trie *Trie) Root() *Node {
+	return trie.root.Load().(*Node)
+}
+
+// SetConfig sets a setting of the trie, an empty value removes it.
+func (trie *Trie) SetConfig(key string, value string) {
+	trie.ConfigLock.Lock()
+	defer trie.ConfigLock.Unlock()
+
+	if value == "" {
+		delete(trie.Config, key)
+		return
+	}
+	trie.Config[key] = value
+}
+
+func (trie *Trie) GetConfig(key string) (value string, ok bool) {
+	trie.ConfigLock.RLock()
+	defer trie.ConfigLock.RUnlock()
+
+	value, ok = trie.Config[key]
+	return value, ok
+}
+
+// ConfigMap returns a copy of all settings.
+func (trie *Trie) ConfigMap() map[string]string {
+	trie.ConfigLock.RLock()
+	defer trie.ConfigLock.RUnlock()
+
+	config := make(map[string]string, len(trie.Config))
+	for key, value := range trie.Config {
+		config[key] = value
+	}
+	return config
+}
+
+// Clone returns a trie that shares the current version of the nodes and
+// has a copy of the settings. Both tries copy the nodes a write changes, so
+// neither sees the writes of the other.
+func (trie *Trie) Clone() *Trie {
+	trie.writeLock.Lock()
+	defer trie.writeLock.Unlock()
+
+	clone := NewTrie()
+	clone.root.Store(trie.Root())
+	clone.NumberNode = atomic.LoadInt32(&trie.NumberNode)
+	clone.NumberKey = atomic.LoadInt32(&trie.NumberKey)
+	clone.ValueBytes = atomic.LoadInt64(&trie.ValueBytes)
+	clone.Config = trie.ConfigMap()
+
+	trie.expiresLock.Lock()
+	for key, expireAt := range trie.expires {
+		clone.expires[key] = expireAt
+	}
+	trie.expiresLock.Unlock()
+	return clone
+}
+
+// Clear removes every key but keeps the settings.
+func (trie *Trie) Clear() {
+	trie.writeLock.Lock()
+	defer trie.writeLock.Unlock()
+
+	root := &Node{IsKey: false, Children: make(map[uint8]*Node), Height: -1}
+	// AC自动机的root指向自己
+	if trie.Root().Fail != nil {
+		root.Fail = root
+	}
+	trie.root.Store(root)
+	atomic.StoreInt32(&trie.NumberNode, 0)
+	atomic.StoreInt32(&trie.NumberKey, 0)
+	atomic.StoreInt64(&trie.ValueBytes, 0)
+
+	trie.expiresLock.Lock()
+	trie.expires = make(map[string]int64)
+	trie.expiresLock.Unlock()
+}
+
 func CreateNode(isKey bool, height int) *Node {
 	node := &Node{IsKey: isKey, Height: height, Children: make(map[uint8]*Node)}
 	return node
@@ -45,18 +185,6 @@ func (node *Node) GetChild(ord uint8) *Node {
 	return node.Children[ord]
 }
 
-func (node *Node) Update(isKey bool, value interface{}) (ret bool) {
-	node.Lock.Lock()
-	defer node.Lock.Unlock()
-
-	ret = !node.IsKey
-
-	node.IsKey = isKey
-	node.Value = value
-
-	return ret
-}
-
 func (trie *Trie) increaseNumberNode() {
 	atomic.AddInt32(&trie.NumberNode, 1)
 }
@@ -75,8 +203,8 @@ func (trie *Trie) decreaseNumberKey() {
 
 func (trie *Trie) Walk(key []byte) (*Node, *Node, int) {
 	var i int
-	node := trie.Root
-	parent := trie.Root
+	node := trie.Root()
+	parent := node
 
 	for i = 0; i < len(key); i++ {
 		order := key[i]
@@ -93,100 +221,119 @@ func (trie *Trie) Walk(key []byte) (*Node, *Node, int) {
 }
 
 func (trie *Trie) Insert(key []byte, value interface{}) (oldValue interface{}, ret int) {
-	var parent *Node
-	var node *Node
+	oldValue, ret, _ = trie.insert(key, value, 0, 0)
+	return oldValue, ret
+}
 
-	keyLen := len(key)
-	ret = 0
-	parent = trie.Root
-	node = trie.Root
+// InsertVersion inserts a key with the given version, version 0 means the
+// current version of the key plus one. It returns the version of the key.
+func (trie *Trie) InsertVersion(key []byte, value interface{}, version int64) int64 {
+	_, _, version = trie.insert(key, value, version, 0)
+	return version
+}
 
-	if trie.Root == nil {
-		return oldValue, ret
-	}
+// InsertExpire is InsertVersion with the time the key expires at in
+// milliseconds, 0 means never. Inserting without it removes the expiry.
+func (trie *Trie) InsertExpire(key []byte, value interface{}, version int64, expireAt int64) int64 {
+	_, _, version = trie.insert(key, value, version, expireAt)
+	return version
+}
 
-	for i := 0; i < keyLen; i++ {
-		order := key[i]
-		parent = node
-		parent.Lock.Lock()
-		node = node.GetChild(order)
+// copyPath copies the nodes from the root to key, creating the missing ones.
+// path[i] is the copy of the node of key[:i], linked to the copy of its
+// parent, and path[0] is the new root. The caller holds writeLock.
+func (trie *Trie) copyPath(key []byte) (path []*Node, existed bool) {
+	path = make([]*Node, len(key)+1)
+	path[0] = trie.Root().clone()
+	existed = true
 
-		if node != nil {
-			// 最后一个节点是key
-			if i == keyLen-1 {
-				ret = 1
-				oldValue = node.Value
-				isKey := node.Update(true, value)
-				if isKey {
-					trie.increaseNumberKey()
-				}
-				parent.Lock.Unlock()
-				break
-
-			} else { // 不是最后一个节点，释放父节点的锁继续遍历
-				parent.Lock.Unlock()
-				continue
-			}
-		} else {
+	for i := 0; i < len(key); i++ {
+		order := key[i]
+		child := path[i].GetChild(order)
+		if child == nil {
+			existed = false
 			trie.increaseNumberNode()
-			node = CreateNode(i == keyLen-1, i)
-			parent.Children[order] = node
-			if i == keyLen-1 {
-				node.Value = value
-				trie.increaseNumberKey()
-			}
-			parent.Lock.Unlock()
+			child = CreateNode(false, i)
+		} else {
+			child = child.clone()
 		}
+		path[i].InsertChild(order, child)
+		path[i+1] = child
+	}
+	return path, existed
+}
 
+func (trie *Trie) insert(key []byte, value interface{}, version int64, expireAt int64) (oldValue interface{}, ret int, newVersion int64) {
+	trie.writeLock.Lock()
+	defer trie.writeLock.Unlock()
+
+	path, existed := trie.copyPath(key)
+	node := path[len(key)]
+
+	// 最后一个节点是key
+	if existed {
+		ret = 1
+		oldValue = node.Value
+	}
+	now := Millisecond(time.Now())
+	if version == 0 {
+		version = 1
+		// 过期的key重新写入时版本从1开始
+		if node.alive(now) {
+			version = node.Version + 1
+		}
 	}
+	if !node.IsKey {
+		trie.increaseNumberKey()
+	}
+	atomic.AddInt64(&trie.ValueBytes, valueSize(value)-valueSize(node.Value))
+	node.IsKey = true
+	node.Value = value
+	node.Version = version
+	node.ExpireAt = expireAt
+	node.touch(now)
 
-	return oldValue, ret
+	trie.root.Store(path[0])
+	trie.setExpire(key, expireAt)
+	return oldValue, ret, version
 }
 
 func (trie *Trie) Remove(key []byte) bool {
-	var parent *Node
-	var node *Node
+	trie.writeLock.Lock()
+	defer trie.writeLock.Unlock()
 
-	keyLen := len(key)
-	parent = trie.Root
-	node = trie.Root
+	return trie.remove(key)
+}
 
-	if trie.Root == nil {
+// remove deletes key and the nodes left without a key below them, it returns
+// false if key did not exist. The caller holds writeLock.
+func (trie *Trie) remove(key []byte) bool {
+	if _, node, step := trie.Walk(key); step != len(key) || node == nil || !node.IsKey {
 		return false
 	}
 
-	for i := 0; i < keyLen; i++ {
-		order := key[i]
-		parent = node
-		parent.Lock.Lock()
-		node = node.GetChild(order)
-
-		if node != nil {
-			if i == keyLen-1 {
-				node.Lock.Lock()
-				if node.IsKey {
-					trie.decreaseNumberKey()
-					node.IsKey = false
-				}
-
-				if len(node.Children) == 0 {
-					trie.decreaseNumberNode()
-					parent.RemoveChild(order)
-				}
-
-				node.Lock.Unlock()
-				parent.Lock.Unlock()
-				return false
-			}
-			parent.Lock.Unlock()
-			continue
-		} else {
-			parent.Lock.Unlock()
+	path, _ := trie.copyPath(key)
+	node := path[len(key)]
+	trie.decreaseNumberKey()
+	atomic.AddInt64(&trie.ValueBytes, -valueSize(node.Value))
+	node.IsKey = false
+	node.Value = nil
+	node.Version = 0
+	node.ExpireAt = 0
+
+	// 删除不再是key也没有子节点的节点，root保留
+	for i := len(key); i > 0; i-- {
+		node := path[i]
+		if node.IsKey || len(node.Children) > 0 {
 			break
 		}
-
+		trie.decreaseNumberNode()
+		path[i-1].RemoveChild(key[i-1])
 	}
-	return false
+
+	trie.root.Store(path[0])
+	trie.setExpire(key, 0)
+	return true
 }
 
 func (trie *Trie) Find(key []byte) (ret bool, value interface{}) {
@@ -196,14 +343,101 @@ func (trie *Trie) Find(key []byte) (ret bool, value interface{}) {
 
 	_, node, step := trie.Walk(key)
 
-	if step == keyLen && node.IsKey {
+	now := Millisecond(time.Now())
+	if step == keyLen && node.alive(now) {
 		ret = true
 		value = node.Value
+		node.touch(now)
 	}
 
 	return ret, value
 }
 
+// FindVersion is Find that also returns the version of the key.
+func (trie *Trie) FindVersion(key []byte) (ret bool, value interface{}, version int64) {
+	_, node, step := trie.Walk(key)
+
+	now := Millisecond(time.Now())
+	if step == len(key) && node != nil && node.alive(now) {
+		node.touch(now)
+		return true, node.Value, node.Version
+	}
+	return false, nil, 0
+}
+
+// FindExpire is FindVersion that also returns when the key expires in
+// milliseconds, 0 if it never expires.
+func (trie *Trie) FindExpire(key []byte) (ret bool, value interface{}, version int64, expireAt int64) {
+	_, node, step := trie.Walk(key)
+
+	now := Millisecond(time.Now())
+	if step == len(key) && node != nil && node.alive(now) {
+		node.touch(now)
+		return true, node.Value, node.Version, node.ExpireAt
+	}
+	return false, nil, 0, 0
+}
+
+func (trie *Trie) setExpire(key []byte, expireAt int64) {
+	trie.expiresLock.Lock()
+	defer trie.expiresLock.Unlock()
+
+	if expireAt == 0 {
+		delete(trie.expires, string(key))
+		return
+	}
+	trie.expires[string(key)] = expireAt
+}
+
+// SampleExpires picks up to n keys with an expiry in random order and
+// returns when they expire.
+func (trie *Trie) SampleExpires(n int) map[string]int64 {
+	trie.expiresLock.Lock()
+	defer trie.expiresLock.Unlock()
+
+	// map的遍历顺序是随机的
+	sample := make(map[string]int64, n)
+	for key, expireAt := range trie.expires {
+		if len(sample) >= n {
+			break
+		}
+		sample[key] = expireAt
+	}
+	return sample
+}
+
+// SampleExpired is SampleExpires that returns how many keys were picked and
+// the ones expired at now.
+func (trie *Trie) SampleExpired(n int, now int64) (sampled int, expired []string) {
+	sample := trie.SampleExpires(n)
+	for key, expireAt := range sample {
+		if expireAt <= now {
+			expired = append(expired, key)
+		}
+	}
+	return len(sample), expired
+}
+
+// RemoveExpired removes key if it is expired at now, it returns false if the
+// key was written again since it was sampled.
+func (trie *Trie) RemoveExpired(key []byte, now int64) bool {
+	trie.writeLock.Lock()
+	defer trie.writeLock.Unlock()
+
+	_, node, step := trie.Walk(key)
+
+	if step != len(key) || node == nil || !node.IsKey {
+		trie.setExpire(key, 0)
+		return false
+	}
+	if node.alive(now) {
+		// 重新写入的key以节点上的过期时间为准
+		trie.setExpire(key, node.ExpireAt)
+		return false
+	}
+	return trie.remove(key)
+}
+
 func (trie *Trie) SeekAfter(key []byte) (it *Iterator) {
 	_, node, _ := trie.Walk(key)
 
@@ -218,7 +452,8 @@ func (trie *Trie) SeekAfter(key []byte) (it *Iterator) {
 func (trie *Trie) SeekBefore(key []byte) []int {
 	var i int
 	var flags []int
-	node := trie.Root
+	node := trie.Root()
+	now := Millisecond(time.Now())
 
 	for i = 0; i < len(key); i++ {
 		order := key[i]
@@ -227,7 +462,7 @@ func (trie *Trie) SeekBefore(key []byte) []int {
 
 		if node == nil {
 			break
-		} else if node.IsKey {
+		} else if node.alive(now) {
 			flags = append(flags, i)
 		}
 
@@ -236,9 +471,68 @@ func (trie *Trie) SeekBefore(key []byte) []int {
 	return flags
 }
 
+// ForwardMatch returns the keys that are prefixes of text, shortest first.
+func (trie *Trie) ForwardMatch(text string) []string {
+	keys := make([]string, 0)
+	for _, idx := range trie.SeekBefore([]byte(text)) {
+		keys = append(keys, text[0:idx+1])
+	}
+	return keys
+}
+
+// PrefixSearch returns up to limit keys starting with prefix, shorter keys first.
+func (trie *Trie) PrefixSearch(prefix string, limit int) []string {
+	keys := make([]string, 0)
+	it := trie.SeekAfter([]byte(prefix))
+	now := Millisecond(time.Now())
+	for it.HasNext() && len(keys) < limit {
+		k, node, _ := it.Next()
+		if node.alive(now) {
+			keys = append(keys, string(k))
+		}
+	}
+	return keys
+}
+
+type Hit struct {
+	Key   string
+	Start int
+	End   int
+}
+
+// MatchAll finds every key occurring in text, ordered by start and then by
+// length, the same result as an AC automaton built from all keys.
+func (trie *Trie) MatchAll(text string) []Hit {
+	hits := make([]Hit, 0)
+	for start := 0; start < len(text); start++ {
+		for _, idx := range trie.SeekBefore([]byte(text[start:])) {
+			hits = append(hits, Hit{Key: text[start : start+idx+1], Start: start, End: start + idx + 1})
+		}
+	}
+	return hits
+}
+
+// Segment splits text with forward maximum matching: it takes the longest key
+// at each position, or a single character when no key matches.
+func (trie *Trie) Segment(text string) []string {
+	segments := make([]string, 0)
+	for start := 0; start < len(text); {
+		end := start
+		if flags := trie.SeekBefore([]byte(text[start:])); len(flags) > 0 {
+			end = start + flags[len(flags)-1] + 1
+		} else {
+			_, size := utf8.DecodeRuneInString(text[start:])
+			end = start + size
+		}
+		segments = append(segments, text[start:end])
+		start = end
+	}
+	return segments
+}
+
 func (trie *Trie) BFS(fn func(key []byte, node *Node, parent *Node)) {
 	queue := NewQueue()
-	queue.Put(make([]byte, 0), trie.Root, nil)
+	queue.Put(make([]byte, 0), trie.Root(), nil)
 
 	for !queue.Empty() {
 		suffix, node, parent := queue.Get()
@@ -252,3 +546,72 @@ func (trie *Trie) BFS(fn func(key []byte, node *Node, parent *Node)) {
 		}
 	}
 }
+
+// Range visits every key that has not expired in lexicographic order until
+// fn returns false.
+func (trie *Trie) Range(fn func(key []byte, node *Node) bool) {
+	trie.rangeNode(make([]byte, 0), trie.Root(), Millisecond(time.Now()), fn)
+}
+
+func (trie *Trie) rangeNode(key []byte, node *Node, now int64, fn func(key []byte, node *Node) bool) bool {
+	if node.alive(now) && !fn(key, node) {
+		return false
+	}
+
+	for _, ord := range sortedChildren(node) {
+		child := node.Children[uint8(ord)]
+		if child == nil {
+			continue
+		}
+		path := make([]byte, len(key)+1)
+		copy(path, key)
+		path[len(key)] = uint8(ord)
+		if !trie.rangeNode(path, child, now, fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RangeAfter is Range starting at the first key greater than after, it skips
+// the subtrees before after instead of visiting them.
+func (trie *Trie) RangeAfter(after []byte, fn func(key []byte, node *Node) bool) {
+	trie.rangeAfter(make([]byte, 0), trie.Root(), after, Millisecond(time.Now()), fn)
+}
+
+// rangeAfter visits the keys under node greater than after, key is a prefix
+// of after so node itself is never visited.
+func (trie *Trie) rangeAfter(key []byte, node *Node, after []byte, now int64, fn func(key []byte, node *Node) bool) bool {
+	for _, ord := range sortedChildren(node) {
+		child := node.Children[uint8(ord)]
+		if child == nil {
+			continue
+		}
+		bounded := len(key) < len(after)
+		if bounded && ord < int(after[len(key)]) {
+			continue
+		}
+		path := make([]byte, len(key)+1)
+		copy(path, key)
+		path[len(key)] = uint8(ord)
+		if bounded && ord == int(after[len(key)]) {
+			if !trie.rangeAfter(path, child, after, now, fn) {
+				return false
+			}
+		} else if !trie.rangeNode(path, child, now, fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortedChildren(node *Node) []int {
+	ords := make([]int, 0, len(node.Children))
+	for ord := range node.Children {
+		ords = append(ords, int(ord))
+	}
+	sort.Ints(ords)
+	return ords
+}
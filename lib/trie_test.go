@@ -51,3 +51,80 @@ func TestTrie_Insert(t *testing.T) {
 		}
 	}
 }
+
+func TestTrie_Snapshot(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert([]byte("北京"), "1")
+	root := trie.Root()
+
+	trie.Insert([]byte("北京"), "2")
+	trie.Insert([]byte("北京大学"), nil)
+	trie.Remove([]byte("北京"))
+
+	// 旧版本的root不受之后写入的影响
+	_, node, _ := trie.Walk([]byte("北京"))
+	if node == nil || node.IsKey {
+		t.Error("expected the key removed from the current version")
+	}
+	node = root
+	for _, ord := range []byte("北京") {
+		node = node.Children[ord]
+	}
+	if !node.IsKey || node.Value != "1" || len(node.Children) != 0 {
+		t.Errorf("old version changed: %v %v %d", node.IsKey, node.Value, len(node.Children))
+	}
+}
+
+func TestTrie_ConcurrentReadWrite(t *testing.T) {
+	trie := NewTrie()
+	var w sync.WaitGroup
+	done := make(chan struct{})
+
+	for i := 0; i < 4; i++ {
+		w.Add(1)
+		go func(i int) {
+			defer w.Done()
+			for j := 0; j < 1000; j++ {
+				key := []byte(fmt.Sprintf("key%d-%d", i, j%50))
+				trie.Insert(key, j)
+				if j%3 == 0 {
+					trie.Remove(key)
+				}
+			}
+		}(i)
+	}
+
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				trie.Find([]byte("key0-1"))
+				trie.PrefixSearch("key", 100)
+				trie.MatchAll("key1-2key3-4")
+				trie.Range(func(key []byte, node *Node) bool {
+					return true
+				})
+			}
+		}()
+	}
+
+	w.Wait()
+	close(done)
+	readers.Wait()
+
+	count := int32(0)
+	trie.Range(func(key []byte, node *Node) bool {
+		count++
+		return true
+	})
+	if count != trie.NumberKey {
+		t.Errorf("counted %d keys, NumberKey is %d", count, trie.NumberKey)
+	}
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"time"
+)
+
+// 主动过期每轮的间隔，每次从一个trie抽样的key数量和每轮最多占用的时间
+const (
+	expireInterval = 100 * time.Millisecond
+	expireSamples  = 20
+	expireBudget   = 25 * time.Millisecond
+)
+
+// expireAt converts a ttl to the time the key expires at in milliseconds,
+// 0 for a ttl that is not positive.
+func expireAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return Millisecond(time.Now().Add(ttl))
+}
+
+// InsertKeyTTL is InsertKey for a key that expires after ttl, a ttl that is
+// not positive never expires.
+func (engine *Engine) InsertKeyTTL(name string, key string, value interface{}, ttl time.Duration) error {
+	_, err := engine.insertKeyTTL(name, key, value, ttl)
+	return err
+}
+
+// insertKeyTTL is InsertKeyTTL returning the new version of the key.
+func (engine *Engine) insertKeyTTL(name string, key string, value interface{}, ttl time.Duration) (int64, error) {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+
+	trie := engine.GetTrie(name)
+	if trie == nil {
+		return 0, ErrTrieNotFound
+	}
+
+	engine.feedMutex.Lock()
+	defer engine.feedMutex.Unlock()
+	defer engine.syncAlways()
+	if err := engine.reserveKey(name, []byte(key), value, engine.feed); err != nil {
+		return 0, err
+	}
+
+	expire := expireAt(ttl)
+	version := trie.InsertExpire([]byte(key), value, 0, expire)
+	engine.feed(ConvertInsertExpire(name, key, ValueString(value), version, expire))
+	return version, nil
+}
+
+// GetKeyExpire returns the value, the version and when the key expires in
+// milliseconds, 0 if it never expires.
+func (engine *Engine) GetKeyExpire(name string, key string) (interface{}, int64, int64, error) {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+
+	trie := engine.GetTrie(name)
+	if trie == nil {
+		return nil, 0, 0, ErrTrieNotFound
+	}
+
+	ret, value, version, expire := trie.FindExpire([]byte(key))
+	if !ret {
+		return nil, 0, 0, ErrKeyNotFound
+	}
+	return value, version, expire, nil
+}
+
+// StartExpiration removes expired keys in the background until Close and
+// logs a REMOVE for each of them. Only a primary should run it, a replica
+// removes them when it receives the REMOVE.
+func (engine *Engine) StartExpiration() {
+	engine.expireOnce.Do(func() {
+		engine.expireStop = make(chan struct{})
+		go engine.expireLoop(engine.expireStop)
+	})
+}
+
+func (engine *Engine) expireLoop(stop chan struct{}) {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			engine.expireCycle()
+		}
+	}
+}
+
+// expireCycle samples the keys with an expiry of every trie and removes the
+// expired ones. It samples a trie again while more than a quarter of the
+// sample was expired, until the time budget of the cycle is used.
+func (engine *Engine) expireCycle() int {
+	deadline := time.Now().Add(expireBudget)
+	removed := 0
+	for _, name := range engine.Tries() {
+		trie := engine.GetTrie(name)
+		for trie != nil && time.Now().Before(deadline) {
+			sampled, expired := trie.SampleExpired(expireSamples, Millisecond(time.Now()))
+			removed += engine.removeExpired(name, trie, expired)
+			if len(expired)*4 <= sampled {
+				break
+			}
+		}
+	}
+	return removed
+}
+
+func (engine *Engine) removeExpired(name string, trie *Trie, keys []string) int {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+
+	// 抽样之后trie可能被删除或者重新创建
+	if engine.GetTrie(name) != trie {
+		return 0
+	}
+
+	engine.feedMutex.Lock()
+	defer engine.feedMutex.Unlock()
+	now := Millisecond(time.Now())
+	removed := 0
+	for _, key := range keys {
+		if trie.RemoveExpired([]byte(key), now) {
+			engine.feed(ConvertRemove(name, key))
+			removed++
+		}
+	}
+	if removed > 0 {
+		engine.syncAlways()
+	}
+	return removed
+}
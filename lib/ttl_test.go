@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrie_Expire(t *testing.T) {
+	trie := NewTrie()
+	past := Millisecond(time.Now()) - 1
+	trie.Insert([]byte("北京"), nil)
+	trie.InsertExpire([]byte("北京大学"), nil, 0, past)
+	trie.InsertExpire([]byte("北京大"), nil, 0, Millisecond(time.Now().Add(time.Hour)))
+
+	if ret, _ := trie.Find([]byte("北京大学")); ret {
+		t.Error("found an expired key")
+	}
+	if keys := trie.ForwardMatch("北京大学"); !reflect.DeepEqual(keys, []string{"北京", "北京大"}) {
+		t.Errorf("unexpected forward match %v", keys)
+	}
+	if keys := trie.PrefixSearch("北京", 10); !reflect.DeepEqual(keys, []string{"北京", "北京大"}) {
+		t.Errorf("unexpected prefix search %v", keys)
+	}
+	if hits := trie.MatchAll("北京大学"); len(hits) != 2 {
+		t.Errorf("unexpected hits %v", hits)
+	}
+	count := 0
+	trie.Range(func(key []byte, node *Node) bool {
+		count++
+		return true
+	})
+	if count != 2 {
+		t.Errorf("expected range to skip the expired key, visited %d", count)
+	}
+
+	// 过期的key重新写入时版本从1开始，不带过期时间写入会去掉过期时间
+	if version := trie.InsertVersion([]byte("北京大学"), nil, 0); version != 1 {
+		t.Errorf("expected version 1 for an expired key, got %d", version)
+	}
+	if ret, _, _, expire := trie.FindExpire([]byte("北京大学")); !ret || expire != 0 {
+		t.Errorf("expected the key to never expire, got %t %d", ret, expire)
+	}
+	if sampled, _ := trie.SampleExpired(10, Millisecond(time.Now())); sampled != 1 {
+		t.Errorf("expected one key with an expiry, got %d", sampled)
+	}
+}
+
+func TestEngine_ExpireCycle(t *testing.T) {
+	engine := NewEngine()
+	engine.CreateTrie("dict")
+	var fed []string
+	engine.OnFeed = func(cmd []byte) {
+		fed = append(fed, string(cmd))
+	}
+
+	trie := engine.GetTrie("dict")
+	past := Millisecond(time.Now()) - 1
+	for i := 0; i < 100; i++ {
+		trie.InsertExpire([]byte("key"+strconv.Itoa(i)), nil, 0, past)
+	}
+	engine.InsertKeyTTL("dict", "live", nil, time.Hour)
+	fed = nil
+
+	if removed := engine.expireCycle(); removed != 100 {
+		t.Errorf("expected 100 keys removed, got %d", removed)
+	}
+	if trie.NumberKey != 1 || len(fed) != 100 || !strings.Contains(fed[0], "REMOVE") {
+		t.Errorf("unexpected keys %d and commands %d", trie.NumberKey, len(fed))
+	}
+	if removed := engine.expireCycle(); removed != 0 {
+		t.Errorf("expected nothing to remove, got %d", removed)
+	}
+}
+
+func TestEngine_ExpireReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ttl")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	options := DefaultOptions(dir)
+	options.Fsync = FsyncAlways
+	options.ActiveExpire = false
+	engine, err := Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	engine.CreateTrie("dict")
+	engine.InsertKeyTTL("dict", "long", "1", time.Hour)
+	engine.InsertKeyTTL("dict", "short", "2", 50*time.Millisecond)
+	_, _, expire, _ := engine.GetKeyExpire("dict", "long")
+	engine.Close()
+
+	time.Sleep(60 * time.Millisecond)
+	engine, err = Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, _, e, err := engine.GetKeyExpire("dict", "long"); err != nil || e != expire {
+		t.Errorf("expected expiry %d after replay, got %d %v", expire, e, err)
+	}
+	if engine.GetTrie("dict").NumberKey != 1 {
+		t.Error("expired key loaded")
+	}
+
+	// 快照中也记录过期时间
+	if err = engine.Snapshot(); err != nil {
+		t.Fatal(err.Error())
+	}
+	engine.Close()
+	engine, err = Open(options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer engine.Close()
+	if _, _, e, _ := engine.GetKeyExpire("dict", "long"); e != expire {
+		t.Errorf("expected expiry %d after snapshot, got %d", expire, e)
+	}
+}
+
+func TestServer_TTL(t *testing.T) {
+	server := NewServer()
+	server.CreateTrie("dict")
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/api/trie/dict/abc", strings.NewReader(`{"value":"1","ttl":100}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(ts.URL + "/api/trie/dict/abc")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	var response KeyGetResponse
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err.Error())
+	}
+	if response.TTL < 99 || response.TTL > 100 {
+		t.Errorf("unexpected ttl %d", response.TTL)
+	}
+}
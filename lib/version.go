@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrConditionFailed = errors.New("condition failed")
+
+// Condition of a conditional write, the zero value always holds.
+type Condition struct {
+	// key不存在时才写入
+	IfAbsent bool
+	// key存在时才写入
+	IfExists bool
+	// key存在并且版本相同，0表示不检查
+	IfVersion int64
+	// key存在并且value相同
+	IfValue *string
+}
+
+func (cond Condition) holds(exists bool, value interface{}, version int64) bool {
+	if cond.IfAbsent && exists {
+		return false
+	}
+	if (cond.IfExists || cond.IfVersion > 0 || cond.IfValue != nil) && !exists {
+		return false
+	}
+	if cond.IfVersion > 0 && cond.IfVersion != version {
+		return false
+	}
+	if cond.IfValue != nil && *cond.IfValue != ValueString(value) {
+		return false
+	}
+	return true
+}
+
+// GetKeyVersion returns the value and the version of a key.
+func (engine *Engine) GetKeyVersion(name string, key string) (interface{}, int64, error) {
+	engine.txMutex.RLock()
+	defer engine.txMutex.RUnlock()
+
+	trie := engine.GetTrie(name)
+	if trie == nil {
+		return nil, 0, ErrTrieNotFound
+	}
+
+	ret, value, version := trie.FindVersion([]byte(key))
+	if !ret {
+		return nil, 0, ErrKeyNotFound
+	}
+	return value, version, nil
+}
+
+// SetKey inserts or replaces a key if cond holds and returns its new version,
+// it returns ErrConditionFailed if not. Conditional writes hold the lock of
+// transactions, so no other write happens between the check and the write,
+// unconditional writes are InsertKeyTTL. The key expires after ttl if it is
+// positive.
+func (engine *Engine) SetKey(name string, key string, value interface{}, ttl time.Duration, cond Condition) (int64, error) {
+	if cond == (Condition{}) {
+		return engine.insertKeyTTL(name, key, value, ttl)
+	}
+
+	engine.txMutex.Lock()
+	defer engine.txMutex.Unlock()
+
+	trie := engine.GetTrie(name)
+	if trie == nil {
+		return 0, ErrTrieNotFound
+	}
+
+	exists, old, version := trie.FindVersion([]byte(key))
+	if !cond.holds(exists, old, version) {
+		return version, ErrConditionFailed
+	}
+	if err := engine.reserveKey(name, []byte(key), value, engine.Feed); err != nil {
+		return version, err
+	}
+
+	expire := expireAt(ttl)
+	version = trie.InsertExpire([]byte(key), value, 0, expire)
+	engine.Feed(ConvertInsertExpire(name, key, ValueString(value), version, expire))
+	return version, nil
+}
+
+// DeleteKey removes a key if cond holds, it returns ErrKeyNotFound if the key
+// does not exist.
+func (engine *Engine) DeleteKey(name string, key string, cond Condition) error {
+	if cond == (Condition{}) {
+		return engine.removeKey(name, key)
+	}
+
+	engine.txMutex.Lock()
+	defer engine.txMutex.Unlock()
+
+	trie := engine.GetTrie(name)
+	if trie == nil {
+		return ErrTrieNotFound
+	}
+
+	exists, old, version := trie.FindVersion([]byte(key))
+	if !exists {
+		return ErrKeyNotFound
+	}
+	if !cond.holds(exists, old, version) {
+		return ErrConditionFailed
+	}
+
+	trie.Remove([]byte(key))
+	engine.Feed(ConvertRemove(name, key))
+	return nil
+}
@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrie_Version(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert([]byte("ab"), nil)
+	trie.Insert([]byte("abc"), nil)
+	trie.Insert([]byte("abc"), "1")
+	if _, _, version := trie.FindVersion([]byte("abc")); version != 2 {
+		t.Errorf("expected version 2, got %d", version)
+	}
+
+	// 删除之后版本重新开始
+	trie.Remove([]byte("ab"))
+	trie.Insert([]byte("ab"), nil)
+	if _, _, version := trie.FindVersion([]byte("ab")); version != 1 {
+		t.Errorf("expected version 1 after remove, got %d", version)
+	}
+
+	if version := trie.InsertVersion([]byte("abd"), nil, 7); version != 7 {
+		t.Errorf("expected version 7, got %d", version)
+	}
+	if ret, _, _ := trie.FindVersion([]byte("a")); ret {
+		t.Error("found a prefix that is not a key")
+	}
+}
+
+func TestEngine_VersionReplay(t *testing.T) {
+	engine := NewEngine()
+	engine.CreateTrie("dict")
+	for i := 0; i < 3; i++ {
+		engine.InsertKey("dict", "abc", nil)
+	}
+
+	var buf bytes.Buffer
+	if err := engine.Rewrite(&buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	// 旧的INSERT没有版本号，回放时加1
+	buf.Write(ConvertInsert("dict", "abc", "v"))
+
+	loaded := NewEngine()
+	applyAll(t, loaded, &buf)
+	if value, version, _ := loaded.GetKeyVersion("dict", "abc"); value != "v" || version != 4 {
+		t.Errorf("expected v at version 4, got %v at %d", value, version)
+	}
+}
+
+func TestEngine_Condition(t *testing.T) {
+	engine := NewEngine()
+	engine.CreateTrie("dict")
+
+	if _, err := engine.SetKey("dict", "abc", "1", 0, Condition{IfExists: true}); err != ErrConditionFailed {
+		t.Errorf("expected update of a missing key to fail, got %v", err)
+	}
+	version, err := engine.SetKey("dict", "abc", "1", 0, Condition{IfAbsent: true})
+	if err != nil || version != 1 {
+		t.Fatalf("unexpected insert %d %v", version, err)
+	}
+	if _, err = engine.SetKey("dict", "abc", "2", 0, Condition{IfAbsent: true}); err != ErrConditionFailed {
+		t.Errorf("expected insert of an existing key to fail, got %v", err)
+	}
+	if _, err = engine.SetKey("dict", "abc", "2", 0, Condition{IfVersion: 2}); err != ErrConditionFailed {
+		t.Errorf("expected a stale version to fail, got %v", err)
+	}
+	one := "1"
+	if version, err = engine.SetKey("dict", "abc", "2", 0, Condition{IfVersion: 1, IfValue: &one}); err != nil || version != 2 {
+		t.Errorf("unexpected update %d %v", version, err)
+	}
+
+	if err = engine.DeleteKey("dict", "abc", Condition{IfValue: &one}); err != ErrConditionFailed {
+		t.Errorf("expected delete with an old value to fail, got %v", err)
+	}
+	if err = engine.DeleteKey("dict", "abc", Condition{IfVersion: 2}); err != nil {
+		t.Errorf("unexpected delete error %v", err)
+	}
+	if err = engine.DeleteKey("dict", "abc", Condition{}); err != ErrKeyNotFound {
+		t.Errorf("expected key not found, got %v", err)
+	}
+}
+
+// 不带条件的写入和普通写入一样只持有读锁，不阻塞读请求
+func TestEngine_ConditionUnconditional(t *testing.T) {
+	engine := NewEngine()
+	engine.CreateTrie("dict")
+
+	engine.txMutex.RLock()
+	done := make(chan error)
+	go func() {
+		version, err := engine.SetKey("dict", "abc", "1", 0, Condition{})
+		if err == nil && version != 1 {
+			err = fmt.Errorf("expected version 1, got %d", version)
+		}
+		if err == nil {
+			err = engine.DeleteKey("dict", "abc", Condition{})
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("unconditional writes wait for the transaction lock")
+	}
+	engine.txMutex.RUnlock()
+
+	if _, err := engine.SetKey("missing", "abc", "1", 0, Condition{}); err != ErrTrieNotFound {
+		t.Errorf("expected trie not found, got %v", err)
+	}
+	if err := engine.DeleteKey("missing", "abc", Condition{}); err != ErrTrieNotFound {
+		t.Errorf("expected trie not found, got %v", err)
+	}
+}
+
+func TestServer_ETag(t *testing.T) {
+	server := NewServer()
+	server.CreateTrie("dict")
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	request := func(method string, path string, body string, header string, value string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := request(http.MethodPut, "/api/trie/dict/abc", `{"value":"1"}`, "If-None-Match", "*")
+	if resp.StatusCode != 200 || resp.Header.Get("ETag") != `"1"` {
+		t.Fatalf("unexpected insert %d %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if resp = request(http.MethodPut, "/api/trie/dict/abc", `{"value":"2"}`, "If-None-Match", "*"); resp.StatusCode != 412 {
+		t.Errorf("expected 412 for an existing key, got %d", resp.StatusCode)
+	}
+	if resp = request(http.MethodPut, "/api/trie/dict/abc", `{"value":"2"}`, "If-Match", `"1"`); resp.StatusCode != 200 {
+		t.Errorf("expected update to succeed, got %d", resp.StatusCode)
+	}
+	if resp = request(http.MethodPut, "/api/trie/dict/abc", `{"value":"3"}`, "If-Match", `"1"`); resp.StatusCode != 412 || resp.Header.Get("ETag") != `"2"` {
+		t.Errorf("expected 412 with the current version, got %d %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	if resp = request(http.MethodGet, "/api/trie/dict/abc", "", "If-None-Match", `"2"`); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", resp.StatusCode)
+	}
+	if resp = request(http.MethodDelete, "/api/trie/dict/abc", "", "If-Match", `"1"`); resp.StatusCode != 412 {
+		t.Errorf("expected 412 for delete of an old version, got %d", resp.StatusCode)
+	}
+	if resp = request(http.MethodDelete, "/api/trie/dict/abc?if_value=2", "", "If-Match", `"2"`); resp.StatusCode != 200 {
+		t.Errorf("expected delete to succeed, got %d", resp.StatusCode)
+	}
+	if resp = request(http.MethodPut, "/api/trie/nothing/abc", `{}`, "", ""); resp.StatusCode != 404 {
+		t.Errorf("expected 404 for a missing trie, got %d", resp.StatusCode)
+	}
+}
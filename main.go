@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"github.com/open-ds/sm/lib"
+	"os"
 )
 
 var (
@@ -10,6 +11,11 @@ var (
 )
 
 func main() {
+	// sm aof <command> 离线检查和修复AOF文件
+	if len(os.Args) > 1 && os.Args[1] == "aof" {
+		os.Exit(aofMain(os.Args[2:]))
+	}
+
 	flag.StringVar(&config, "c", "./config/config.yaml", "config file")
 	flag.Parse()
 
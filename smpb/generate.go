@@ -0,0 +1,5 @@
+// Package smpb contains the gRPC service definition of sm and the code
+// generated from it.
+package smpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative sm.proto
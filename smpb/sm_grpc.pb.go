@@ -0,0 +1,441 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: sm.proto
+
+package smpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	SM_CreateTrie_FullMethodName   = "/sm.SM/CreateTrie"
+	SM_DropTrie_FullMethodName     = "/sm.SM/DropTrie"
+	SM_Insert_FullMethodName       = "/sm.SM/Insert"
+	SM_Remove_FullMethodName       = "/sm.SM/Remove"
+	SM_Get_FullMethodName          = "/sm.SM/Get"
+	SM_PrefixSearch_FullMethodName = "/sm.SM/PrefixSearch"
+	SM_ForwardMatch_FullMethodName = "/sm.SM/ForwardMatch"
+	SM_Match_FullMethodName        = "/sm.SM/Match"
+	SM_Segment_FullMethodName      = "/sm.SM/Segment"
+)
+
+// SMClient is the client API for SM service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// SM exposes the same operations as the HTTP API.
+type SMClient interface {
+	CreateTrie(ctx context.Context, in *CreateTrieRequest, opts ...grpc.CallOption) (*CreateTrieResponse, error)
+	DropTrie(ctx context.Context, in *DropTrieRequest, opts ...grpc.CallOption) (*DropTrieResponse, error)
+	Insert(ctx context.Context, in *InsertRequest, opts ...grpc.CallOption) (*InsertResponse, error)
+	Remove(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*RemoveResponse, error)
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// PrefixSearch streams the keys starting with prefix in batches, shorter keys first.
+	PrefixSearch(ctx context.Context, in *PrefixSearchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PrefixSearchResponse], error)
+	// ForwardMatch returns the keys that are prefixes of text.
+	ForwardMatch(ctx context.Context, in *ForwardMatchRequest, opts ...grpc.CallOption) (*ForwardMatchResponse, error)
+	// Match finds every key occurring anywhere in text, like an Aho-Corasick automaton.
+	Match(ctx context.Context, in *MatchRequest, opts ...grpc.CallOption) (*MatchResponse, error)
+	// Segment splits text into the longest keys from left to right.
+	Segment(ctx context.Context, in *SegmentRequest, opts ...grpc.CallOption) (*SegmentResponse, error)
+}
+
+type sMClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSMClient(cc grpc.ClientConnInterface) SMClient {
+	return &sMClient{cc}
+}
+
+func (c *sMClient) CreateTrie(ctx context.Context, in *CreateTrieRequest, opts ...grpc.CallOption) (*CreateTrieResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CreateTrieResponse)
+	err := c.cc.Invoke(ctx, SM_CreateTrie_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sMClient) DropTrie(ctx context.Context, in *DropTrieRequest, opts ...grpc.CallOption) (*DropTrieResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DropTrieResponse)
+	err := c.cc.Invoke(ctx, SM_DropTrie_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sMClient) Insert(ctx context.Context, in *InsertRequest, opts ...grpc.CallOption) (*InsertResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(InsertResponse)
+	err := c.cc.Invoke(ctx, SM_Insert_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sMClient) Remove(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*RemoveResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RemoveResponse)
+	err := c.cc.Invoke(ctx, SM_Remove_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sMClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, SM_Get_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sMClient) PrefixSearch(ctx context.Context, in *PrefixSearchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PrefixSearchResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &SM_ServiceDesc.Streams[0], SM_PrefixSearch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[PrefixSearchRequest, PrefixSearchResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type SM_PrefixSearchClient = grpc.ServerStreamingClient[PrefixSearchResponse]
+
+func (c *sMClient) ForwardMatch(ctx context.Context, in *ForwardMatchRequest, opts ...grpc.CallOption) (*ForwardMatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ForwardMatchResponse)
+	err := c.cc.Invoke(ctx, SM_ForwardMatch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sMClient) Match(ctx context.Context, in *MatchRequest, opts ...grpc.CallOption) (*MatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MatchResponse)
+	err := c.cc.Invoke(ctx, SM_Match_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sMClient) Segment(ctx context.Context, in *SegmentRequest, opts ...grpc.CallOption) (*SegmentResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SegmentResponse)
+	err := c.cc.Invoke(ctx, SM_Segment_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SMServer is the server API for SM service.
+// All implementations must embed UnimplementedSMServer
+// for forward compatibility.
+//
+// SM exposes the same operations as the HTTP API.
+type SMServer interface {
+	CreateTrie(context.Context, *CreateTrieRequest) (*CreateTrieResponse, error)
+	DropTrie(context.Context, *DropTrieRequest) (*DropTrieResponse, error)
+	Insert(context.Context, *InsertRequest) (*InsertResponse, error)
+	Remove(context.Context, *RemoveRequest) (*RemoveResponse, error)
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// PrefixSearch streams the keys starting with prefix in batches, shorter keys first.
+	PrefixSearch(*PrefixSearchRequest, grpc.ServerStreamingServer[PrefixSearchResponse]) error
+	// ForwardMatch returns the keys that are prefixes of text.
+	ForwardMatch(context.Context, *ForwardMatchRequest) (*ForwardMatchResponse, error)
+	// Match finds every key occurring anywhere in text, like an Aho-Corasick automaton.
+	Match(context.Context, *MatchRequest) (*MatchResponse, error)
+	// Segment splits text into the longest keys from left to right.
+	Segment(context.Context, *SegmentRequest) (*SegmentResponse, error)
+	mustEmbedUnimplementedSMServer()
+}
+
+// UnimplementedSMServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSMServer struct{}
+
+func (UnimplementedSMServer) CreateTrie(context.Context, *CreateTrieRequest) (*CreateTrieResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method CreateTrie not implemented")
+}
+func (UnimplementedSMServer) DropTrie(context.Context, *DropTrieRequest) (*DropTrieResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method DropTrie not implemented")
+}
+func (UnimplementedSMServer) Insert(context.Context, *InsertRequest) (*InsertResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Insert not implemented")
+}
+func (UnimplementedSMServer) Remove(context.Context, *RemoveRequest) (*RemoveResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Remove not implemented")
+}
+func (UnimplementedSMServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedSMServer) PrefixSearch(*PrefixSearchRequest, grpc.ServerStreamingServer[PrefixSearchResponse]) error {
+	return status.Error(codes.Unimplemented, "method PrefixSearch not implemented")
+}
+func (UnimplementedSMServer) ForwardMatch(context.Context, *ForwardMatchRequest) (*ForwardMatchResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ForwardMatch not implemented")
+}
+func (UnimplementedSMServer) Match(context.Context, *MatchRequest) (*MatchResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Match not implemented")
+}
+func (UnimplementedSMServer) Segment(context.Context, *SegmentRequest) (*SegmentResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Segment not implemented")
+}
+func (UnimplementedSMServer) mustEmbedUnimplementedSMServer() {}
+func (UnimplementedSMServer) testEmbeddedByValue()            {}
+
+// UnsafeSMServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SMServer will
+// result in compilation errors.
+type UnsafeSMServer interface {
+	mustEmbedUnimplementedSMServer()
+}
+
+func RegisterSMServer(s grpc.ServiceRegistrar, srv SMServer) {
+	// If the following call panics, it indicates UnimplementedSMServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&SM_ServiceDesc, srv)
+}
+
+func _SM_CreateTrie_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateTrieRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SMServer).CreateTrie(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SM_CreateTrie_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SMServer).CreateTrie(ctx, req.(*CreateTrieRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SM_DropTrie_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DropTrieRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SMServer).DropTrie(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SM_DropTrie_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SMServer).DropTrie(ctx, req.(*DropTrieRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SM_Insert_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InsertRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SMServer).Insert(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SM_Insert_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SMServer).Insert(ctx, req.(*InsertRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SM_Remove_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SMServer).Remove(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SM_Remove_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SMServer).Remove(ctx, req.(*RemoveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SM_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SMServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SM_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SMServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SM_PrefixSearch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PrefixSearchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SMServer).PrefixSearch(m, &grpc.GenericServerStream[PrefixSearchRequest, PrefixSearchResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type SM_PrefixSearchServer = grpc.ServerStreamingServer[PrefixSearchResponse]
+
+func _SM_ForwardMatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ForwardMatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SMServer).ForwardMatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SM_ForwardMatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SMServer).ForwardMatch(ctx, req.(*ForwardMatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SM_Match_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SMServer).Match(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SM_Match_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SMServer).Match(ctx, req.(*MatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SM_Segment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SegmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SMServer).Segment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SM_Segment_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SMServer).Segment(ctx, req.(*SegmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// SM_ServiceDesc is the grpc.ServiceDesc for SM service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SM_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sm.SM",
+	HandlerType: (*SMServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateTrie",
+			Handler:    _SM_CreateTrie_Handler,
+		},
+		{
+			MethodName: "DropTrie",
+			Handler:    _SM_DropTrie_Handler,
+		},
+		{
+			MethodName: "Insert",
+			Handler:    _SM_Insert_Handler,
+		},
+		{
+			MethodName: "Remove",
+			Handler:    _SM_Remove_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _SM_Get_Handler,
+		},
+		{
+			MethodName: "ForwardMatch",
+			Handler:    _SM_ForwardMatch_Handler,
+		},
+		{
+			MethodName: "Match",
+			Handler:    _SM_Match_Handler,
+		},
+		{
+			MethodName: "Segment",
+			Handler:    _SM_Segment_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PrefixSearch",
+			Handler:       _SM_PrefixSearch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "sm.proto",
+}